@@ -1,11 +1,13 @@
 package client
 
 import (
+	"fmt"
 	"io"
 	"time"
 
 	"github.com/hb-go/grpc-contrib/registry"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 var (
@@ -32,14 +34,15 @@ func Client(s *registry.Service, options ...Option) (*grpc.ClientConn, io.Closer
 
 	addr := registry.NewTarget(s, opts.RegistryOptions...)
 
-	conn, err := pool.Get(addr, opts.DialOptions...)
+	key := poolKey(addr, opts.Credentials)
+	conn, err := pool.get(key, addr, opts.DialOptions...)
 	if err != nil {
 		return nil, nil, err
 	}
 
 	c := &funcCloser{
 		CloseFunc: func() error {
-			pool.Put(addr, conn, err)
+			pool.put(key, conn, err)
 			return nil
 		},
 	}
@@ -47,6 +50,15 @@ func Client(s *registry.Service, options ...Option) (*grpc.ClientConn, io.Closer
 	return conn.GetCC(), c, nil
 }
 
+// poolKey is the key of the conns in the pool, the conns of an address
+// dialed with different credentials aren't shared
+func poolKey(addr string, creds credentials.TransportCredentials) string {
+	if creds == nil {
+		return addr
+	}
+	return fmt.Sprintf("%s#%T@%p", addr, creds, creds)
+}
+
 type funcCloser struct {
 	CloseFunc func() error
 }
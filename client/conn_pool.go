@@ -35,8 +35,13 @@ func NewPool(size int, ttl time.Duration) *Pool {
 }
 
 func (p *Pool) Get(addr string, opts ...grpc.DialOption) (*poolConn, error) {
+	return p.get(addr, addr, opts...)
+}
+
+// get returns a conn of the key, a new one is dialed to the address
+func (p *Pool) get(key, addr string, opts ...grpc.DialOption) (*poolConn, error) {
 	p.Lock()
-	conns := p.conns[addr]
+	conns := p.conns[key]
 	now := time.Now().Unix()
 
 	// while we have conns check age and then return one
@@ -44,7 +49,7 @@ func (p *Pool) Get(addr string, opts ...grpc.DialOption) (*poolConn, error) {
 	for len(conns) > 0 {
 		conn := conns[len(conns)-1]
 		conns = conns[:len(conns)-1]
-		p.conns[addr] = conns
+		p.conns[key] = conns
 
 		// if conn is old or not ready kill it and move on
 		if d := now - conn.created; d > p.ttl || conn.cc.GetState() != connectivity.Ready {
@@ -78,6 +83,11 @@ func (p *Pool) Get(addr string, opts ...grpc.DialOption) (*poolConn, error) {
 }
 
 func (p *Pool) Put(addr string, conn *poolConn, err error) {
+	p.put(addr, conn, err)
+}
+
+// put returns the conn to the pool of the key
+func (p *Pool) put(key string, conn *poolConn, err error) {
 	// don't store the conn if it has errored
 	if err != nil {
 		conn.cc.Close()
@@ -86,13 +96,13 @@ func (p *Pool) Put(addr string, conn *poolConn, err error) {
 
 	// otherwise put it back for reuse
 	p.Lock()
-	conns := p.conns[addr]
+	conns := p.conns[key]
 	if len(conns) >= p.size {
 		p.Unlock()
 		conn.cc.Close()
 		return
 	}
-	p.conns[addr] = append(conns, conn)
+	p.conns[key] = append(conns, conn)
 	p.Unlock()
 }
 
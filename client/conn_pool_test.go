@@ -2,12 +2,14 @@ package client
 
 import (
 	"context"
+	"crypto/tls"
 	"net"
 	"sync"
 	"testing"
 	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 
 	pb "github.com/hb-go/grpc-contrib/proto"
 )
@@ -75,6 +77,23 @@ func TestGRPCPool_5(t *testing.T) {
 	testPool(t, 5, time.Minute)
 }
 
+func TestPoolKey(t *testing.T) {
+	addr := "registry:///foo"
+	one := credentials.NewTLS(&tls.Config{ServerName: "one"})
+	two := credentials.NewTLS(&tls.Config{ServerName: "two"})
+
+	if exp, act := addr, poolKey(addr, nil); exp != act {
+		t.Fatalf("Expected %s, got %s", exp, act)
+	}
+	if poolKey(addr, one) != poolKey(addr, one) {
+		t.Fatal("Expected the same key of the same credentials")
+	}
+	// the conns of other credentials aren't shared
+	if poolKey(addr, one) == poolKey(addr, two) || poolKey(addr, one) == addr {
+		t.Fatal("Expected different keys of different credentials")
+	}
+}
+
 func benchPool(t *testing.B, addr string, p *Pool) {
 
 	wg := sync.WaitGroup{}
@@ -3,6 +3,7 @@ package client
 import (
 	"github.com/hb-go/grpc-contrib/registry"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 type Option func(options *Options)
@@ -11,11 +12,14 @@ type Options struct {
 	Name            string
 	RegistryOptions []registry.Option
 	DialOptions     []grpc.DialOption
+	// 传输层凭证，为空时WithInsecure
+	Credentials credentials.TransportCredentials
 }
 
-// 默认gRPC DialOption
+// 默认gRPC DialOption，传输层安全由Credentials指定。
+// 不再包含grpc.WithInsecure：未设置Credentials时由newOptions追加，
+// 直接使用DefaultDialOpts调用grpc.Dial的需自行追加grpc.WithInsecure()
 var DefaultDialOpts = []grpc.DialOption{
-	grpc.WithInsecure(),
 	grpc.WithBalancerName("round_robin"),
 	grpc.WithBlock(),
 }
@@ -30,6 +34,12 @@ func newOptions(options ...Option) Options {
 		o(&opts)
 	}
 
+	security := grpc.WithInsecure()
+	if opts.Credentials != nil {
+		security = grpc.WithTransportCredentials(opts.Credentials)
+	}
+	opts.DialOptions = append([]grpc.DialOption{security}, opts.DialOptions...)
+
 	return opts
 }
 
@@ -53,3 +63,10 @@ func WithDialOptions(option ...grpc.DialOption) Option {
 		options.DialOptions = append(options.DialOptions, option...)
 	}
 }
+
+// gRPC TransportCredentials，如consul.NewClientCredentials的Connect mTLS
+func WithTransportCredentials(creds credentials.TransportCredentials) Option {
+	return func(options *Options) {
+		options.Credentials = creds
+	}
+}
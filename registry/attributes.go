@@ -0,0 +1,51 @@
+package registry
+
+import (
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/resolver"
+)
+
+type nodeIdKey struct{}
+type versionKey struct{}
+type metadataKey struct{}
+
+// newAddress returns the resolver address of the node, the node Id, the version
+// and the metadata of the node are attached as attributes of the address.
+func newAddress(s *Service, n *Node) resolver.Address {
+	return resolver.Address{
+		Addr: n.Address,
+		Attributes: attributes.New(
+			nodeIdKey{}, n.Id,
+			versionKey{}, s.Version,
+			metadataKey{}, n.Metadata,
+		),
+	}
+}
+
+// NodeIdFromAddress returns the Id of the node of a resolved address
+func NodeIdFromAddress(addr resolver.Address) (string, bool) {
+	if addr.Attributes == nil {
+		return "", false
+	}
+	id, ok := addr.Attributes.Value(nodeIdKey{}).(string)
+	return id, ok
+}
+
+// VersionFromAddress returns the service version of the node of a resolved address
+func VersionFromAddress(addr resolver.Address) (string, bool) {
+	if addr.Attributes == nil {
+		return "", false
+	}
+	v, ok := addr.Attributes.Value(versionKey{}).(string)
+	return v, ok
+}
+
+// MetadataFromAddress returns the metadata of the node of a resolved address,
+// e.g. the zone or the weight. It is shared by the addresses and must not be modified.
+func MetadataFromAddress(addr resolver.Address) (map[string]string, bool) {
+	if addr.Attributes == nil {
+		return nil, false
+	}
+	md, ok := addr.Attributes.Value(metadataKey{}).(map[string]string)
+	return md, ok
+}
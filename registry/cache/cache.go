@@ -2,8 +2,10 @@
 package cache
 
 import (
+	"context"
 	"math"
 	"math/rand"
+	"strings"
 	"sync"
 	"time"
 
@@ -13,7 +15,7 @@ import (
 // Cache is the registry cache interface
 type Cache interface {
 	// embed the registry interface
-	registry.Registry
+	registry.ContextRegistry
 	// stop the cache watcher
 	Stop()
 }
@@ -29,7 +31,7 @@ type cache struct {
 	registry.Registry
 	opts Options
 
-	// registry cache
+	// registry cache, keyed by namespace + "/" + service
 	sync.RWMutex
 	cache   map[string][]*registry.Service
 	ttls    map[string]time.Time
@@ -38,8 +40,8 @@ type cache struct {
 	// used to stop the cache
 	exit chan bool
 
-	// indicate whether its running
-	running bool
+	// indicate whether the watcher of a namespace is running
+	running map[string]bool
 	// status of the registry
 	// used to hold onto the cache
 	// in failure state
@@ -99,24 +101,41 @@ func (c *cache) quit() bool {
 	}
 }
 
-func (c *cache) del(service string) {
+// cacheKey is the key of the service in the namespace, the services
+// of the namespaces are cached apart
+func cacheKey(ns, service string) string {
+	return ns + "/" + service
+}
+
+// namespaceContext returns the context of the calls in the namespace
+func namespaceContext(ns string) context.Context {
+	if len(ns) == 0 {
+		return context.Background()
+	}
+	return registry.NewNamespaceContext(context.Background(), ns)
+}
+
+func (c *cache) del(key string) {
 	// don't blow away cache in error state
 	if err := c.status; err != nil {
 		return
 	}
 	// otherwise delete entries
-	delete(c.cache, service)
-	delete(c.ttls, service)
+	delete(c.cache, key)
+	delete(c.ttls, key)
 }
 
-func (c *cache) get(service string) ([]*registry.Service, error) {
+func (c *cache) get(ctx context.Context, service string) ([]*registry.Service, error) {
+	ns, _ := registry.NamespaceFromContext(ctx)
+	key := cacheKey(ns, service)
+
 	// read lock
 	c.RLock()
 
 	// check the cache first
-	services := c.cache[service]
+	services := c.cache[key]
 	// get cache ttl
-	ttl := c.ttls[service]
+	ttl := c.ttls[key]
 	// make a copy
 	cp := registry.Copy(services)
 
@@ -130,7 +149,7 @@ func (c *cache) get(service string) ([]*registry.Service, error) {
 	// get does the actual request for a service and cache it
 	get := func(service string, cached []*registry.Service) ([]*registry.Service, error) {
 		// ask the registry
-		services, err := c.Registry.GetService(service)
+		services, err := registry.WithContext(c.Registry).GetServiceContext(ctx, service)
 		if err != nil {
 			// check the cache
 			if len(cached) > 0 {
@@ -151,14 +170,14 @@ func (c *cache) get(service string) ([]*registry.Service, error) {
 
 		// cache results
 		c.Lock()
-		c.set(service, registry.Copy(services))
+		c.set(key, registry.Copy(services))
 		c.Unlock()
 
 		return services, nil
 	}
 
 	// watch service if not watched
-	_, ok := c.watched[service]
+	_, ok := c.watched[key]
 
 	// unlock the read lock
 	c.RUnlock()
@@ -168,11 +187,12 @@ func (c *cache) get(service string) ([]*registry.Service, error) {
 		c.Lock()
 
 		// set to watched
-		c.watched[service] = true
+		c.watched[key] = true
 
-		// only kick it off if not running
-		if !c.running {
-			go c.run()
+		// only kick off the watcher of the namespace if not running
+		if !c.running[ns] {
+			c.running[ns] = true
+			go c.run(ns)
 		}
 
 		c.Unlock()
@@ -182,35 +202,43 @@ func (c *cache) get(service string) ([]*registry.Service, error) {
 	return get(service, cp)
 }
 
-func (c *cache) set(service string, services []*registry.Service) {
-	c.cache[service] = services
-	c.ttls[service] = time.Now().Add(c.opts.TTL)
+func (c *cache) set(key string, services []*registry.Service) {
+	c.cache[key] = services
+	c.ttls[key] = time.Now().Add(c.opts.TTL)
 }
 
-func (c *cache) update(res *registry.Result) {
+// update applies the result of the watcher of the namespace
+func (c *cache) update(ns string, res *registry.Result) {
 	if res == nil || res.Service == nil {
 		return
 	}
 
+	key := cacheKey(ns, res.Service.Name)
+
 	c.Lock()
 	defer c.Unlock()
 
 	// only save watched services
-	if _, ok := c.watched[res.Service.Name]; !ok {
+	if _, ok := c.watched[key]; !ok {
 		return
 	}
 
-	services, ok := c.cache[res.Service.Name]
+	services, ok := c.cache[key]
 	if !ok {
 		// we're not going to cache anything
 		// unless there was already a lookup
 		return
 	}
 
+	action, err := res.EventType()
+	if err != nil {
+		return
+	}
+
 	if len(res.Service.Nodes) == 0 {
-		switch res.Action {
-		case "delete":
-			c.del(res.Service.Name)
+		switch action {
+		case registry.Delete:
+			c.del(key)
 		}
 		return
 	}
@@ -225,10 +253,10 @@ func (c *cache) update(res *registry.Result) {
 		}
 	}
 
-	switch res.Action {
-	case "create", "update":
+	switch action {
+	case registry.Create, registry.Update:
 		if service == nil {
-			c.set(res.Service.Name, append(services, res.Service))
+			c.set(key, append(services, res.Service))
 			return
 		}
 
@@ -247,8 +275,8 @@ func (c *cache) update(res *registry.Result) {
 		}
 
 		services[index] = res.Service
-		c.set(res.Service.Name, services)
-	case "delete":
+		c.set(key, services)
+	case registry.Delete:
 		if service == nil {
 			return
 		}
@@ -273,7 +301,7 @@ func (c *cache) update(res *registry.Result) {
 		if len(nodes) > 0 {
 			service.Nodes = nodes
 			services[index] = service
-			c.set(service.Name, services)
+			c.set(key, services)
 			return
 		}
 
@@ -282,7 +310,7 @@ func (c *cache) update(res *registry.Result) {
 		// only have one thing to delete
 		// nuke the thing
 		if len(services) == 1 {
-			c.del(service.Name)
+			c.del(key)
 			return
 		}
 
@@ -296,22 +324,22 @@ func (c *cache) update(res *registry.Result) {
 		}
 
 		// save
-		c.set(service.Name, srvs)
+		c.set(key, srvs)
 	}
 }
 
-// run starts the cache watcher loop
+// run starts the cache watcher loop of the namespace
 // it creates a new watcher if there's a problem
-func (c *cache) run() {
-	c.Lock()
-	c.running = true
-	c.Unlock()
-
+func (c *cache) run(ns string) {
 	// reset watcher on exit
 	defer func() {
 		c.Lock()
-		c.watched = make(map[string]bool)
-		c.running = false
+		for key := range c.watched {
+			if strings.HasPrefix(key, ns+"/") {
+				delete(c.watched, key)
+			}
+		}
+		delete(c.running, ns)
 		c.Unlock()
 	}()
 
@@ -328,7 +356,7 @@ func (c *cache) run() {
 		time.Sleep(time.Duration(j) * time.Millisecond)
 
 		// create new watcher
-		w, err := c.Registry.Watch()
+		w, err := registry.WithContext(c.Registry).WatchContext(namespaceContext(ns))
 		if err != nil {
 			if c.quit() {
 				return
@@ -354,7 +382,7 @@ func (c *cache) run() {
 		a = 0
 
 		// watch for events
-		if err := c.watch(w); err != nil {
+		if err := c.watch(ns, w); err != nil {
 			if c.quit() {
 				return
 			}
@@ -382,7 +410,7 @@ func (c *cache) run() {
 
 // watch loops the next event and calls update
 // it returns if there's an error
-func (c *cache) watch(w registry.Watcher) error {
+func (c *cache) watch(ns string, w registry.Watcher) error {
 	// used to stop the watch
 	stop := make(chan bool)
 
@@ -413,13 +441,17 @@ func (c *cache) watch(w registry.Watcher) error {
 			c.setStatus(nil)
 		}
 
-		c.update(res)
+		c.update(ns, res)
 	}
 }
 
 func (c *cache) GetService(service string) ([]*registry.Service, error) {
+	return c.GetServiceContext(context.Background(), service)
+}
+
+func (c *cache) GetServiceContext(ctx context.Context, service string) ([]*registry.Service, error) {
 	// get the service
-	services, err := c.get(service)
+	services, err := c.get(ctx, service)
 	if err != nil {
 		return nil, err
 	}
@@ -433,6 +465,22 @@ func (c *cache) GetService(service string) ([]*registry.Service, error) {
 	return services, nil
 }
 
+func (c *cache) RegisterContext(ctx context.Context, s *registry.Service, opts ...registry.RegisterOption) error {
+	return registry.WithContext(c.Registry).RegisterContext(ctx, s, opts...)
+}
+
+func (c *cache) DeregisterContext(ctx context.Context, s *registry.Service) error {
+	return registry.WithContext(c.Registry).DeregisterContext(ctx, s)
+}
+
+func (c *cache) ListServicesContext(ctx context.Context) ([]*registry.Service, error) {
+	return registry.WithContext(c.Registry).ListServicesContext(ctx)
+}
+
+func (c *cache) WatchContext(ctx context.Context, opts ...registry.WatchOption) (registry.Watcher, error) {
+	return registry.WithContext(c.Registry).WatchContext(ctx, opts...)
+}
+
 func (c *cache) Stop() {
 	c.Lock()
 	defer c.Unlock()
@@ -464,6 +512,7 @@ func New(r registry.Registry, opts ...Option) Cache {
 		Registry: r,
 		opts:     options,
 		watched:  make(map[string]bool),
+		running:  make(map[string]bool),
 		cache:    make(map[string][]*registry.Service),
 		ttls:     make(map[string]time.Time),
 		exit:     make(chan bool),
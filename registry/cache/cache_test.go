@@ -0,0 +1,88 @@
+package cache
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/hb-go/grpc-contrib/registry"
+	"github.com/hb-go/grpc-contrib/registry/memory"
+)
+
+// nsRegistry keeps a memory registry per namespace
+type nsRegistry struct {
+	registry.Registry
+
+	mu         sync.Mutex
+	namespaces map[string]registry.Registry
+}
+
+func newNsRegistry() *nsRegistry {
+	return &nsRegistry{Registry: memory.NewRegistry(), namespaces: make(map[string]registry.Registry)}
+}
+
+func (r *nsRegistry) ns(ctx context.Context) registry.Registry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ns, _ := registry.NamespaceFromContext(ctx)
+	m, ok := r.namespaces[ns]
+	if !ok {
+		m = memory.NewRegistry()
+		r.namespaces[ns] = m
+	}
+	return m
+}
+
+func (r *nsRegistry) RegisterContext(ctx context.Context, s *registry.Service, opts ...registry.RegisterOption) error {
+	return r.ns(ctx).Register(s, opts...)
+}
+
+func (r *nsRegistry) DeregisterContext(ctx context.Context, s *registry.Service) error {
+	return r.ns(ctx).Deregister(s)
+}
+
+func (r *nsRegistry) GetServiceContext(ctx context.Context, name string) ([]*registry.Service, error) {
+	return r.ns(ctx).GetService(name)
+}
+
+func (r *nsRegistry) ListServicesContext(ctx context.Context) ([]*registry.Service, error) {
+	return r.ns(ctx).ListServices()
+}
+
+func (r *nsRegistry) WatchContext(ctx context.Context, opts ...registry.WatchOption) (registry.Watcher, error) {
+	return r.ns(ctx).Watch(opts...)
+}
+
+func TestCacheNamespace(t *testing.T) {
+	r := newNsRegistry()
+	c := New(r)
+	defer c.Stop()
+
+	prod := registry.NewNamespaceContext(context.Background(), "prod")
+	staging := registry.NewNamespaceContext(context.Background(), "staging")
+
+	for ctx, addr := range map[context.Context]string{prod: "10.0.0.1:8080", staging: "10.0.1.1:8080"} {
+		s := &registry.Service{Name: "svc", Version: "1.0.0", Nodes: []*registry.Node{{Id: "svc-1", Address: addr}}}
+		if err := r.RegisterContext(ctx, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the same service name is cached per namespace
+	for i := 0; i < 2; i++ {
+		for ctx, exp := range map[context.Context]string{prod: "10.0.0.1:8080", staging: "10.0.1.1:8080"} {
+			services, err := c.GetServiceContext(ctx, "svc")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if act := services[0].Nodes[0].Address; exp != act {
+				t.Fatalf("Expected %s, got %s", exp, act)
+			}
+		}
+	}
+
+	if _, err := c.GetServiceContext(context.Background(), "svc"); err != registry.ErrNotFound {
+		t.Fatalf("Expected %v, got %v", registry.ErrNotFound, err)
+	}
+}
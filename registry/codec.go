@@ -0,0 +1,101 @@
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// SchemaVersion is the version of the records written by the codecs.
+// It is raised by one when fields are added, the records of newer versions
+// are decoded best-effort so the nodes of a rolling upgrade read each other.
+// An incompatible change raises it to the next multiple of SchemaMajor,
+// the records of a newer major version are refused with ErrSchemaVersion.
+const SchemaVersion = 1
+
+// SchemaMajor is the step of the schema version of an incompatible change
+const SchemaMajor = 1000
+
+var (
+	// JSONCodec encodes the records as JSON, a record of schema version 0
+	// is a plain JSON service of the earlier releases
+	JSONCodec Codec = jsonCodec{}
+	// ProtoCodec encodes the records in the protobuf wire format,
+	// which is smaller than JSON
+	ProtoCodec Codec = protoCodec{}
+
+	// DefaultCodec is the codec of the registries if none is set
+	DefaultCodec = JSONCodec
+
+	ErrEmptyRecord = errors.New("empty record")
+	// ErrSchemaVersion is returned for a record of a newer major schema version
+	ErrSchemaVersion = errors.New("unsupported schema version")
+)
+
+// Codec encodes the services stored by the registries.
+// The codecs decode the records of each other, so a registry can switch
+// the codec in a rolling upgrade.
+type Codec interface {
+	// Marshal encodes the service as a record of the SchemaVersion
+	Marshal(s *Service) ([]byte, error)
+	// Unmarshal decodes a record of any schema version
+	Unmarshal(b []byte) (*Service, error)
+	// Name of the codec, e.g. json
+	Name() string
+}
+
+// isJSON reports whether the record is JSON, a protobuf record
+// starts with the tag of the schema version instead
+func isJSON(b []byte) bool {
+	for _, c := range b {
+		switch c {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		return c == '{'
+	}
+	return false
+}
+
+// checkSchema refuses the records of a newer major schema version,
+// their layout is incompatible
+func checkSchema(v uint64) error {
+	if v/SchemaMajor > SchemaVersion/SchemaMajor {
+		return fmt.Errorf("%w: %d", ErrSchemaVersion, v)
+	}
+	return nil
+}
+
+type jsonRecord struct {
+	Schema int `json:"schema,omitempty"`
+	*Service
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(s *Service) ([]byte, error) {
+	return json.Marshal(&jsonRecord{Schema: SchemaVersion, Service: s})
+}
+
+func (jsonCodec) Unmarshal(b []byte) (*Service, error) {
+	if len(b) == 0 {
+		return nil, ErrEmptyRecord
+	}
+	if !isJSON(b) {
+		return protoCodec{}.Unmarshal(b)
+	}
+
+	r := &jsonRecord{Service: &Service{}}
+	if err := json.Unmarshal(b, r); err != nil {
+		return nil, err
+	}
+	if err := checkSchema(uint64(r.Schema)); err != nil {
+		return nil, err
+	}
+
+	return r.Service, nil
+}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
@@ -0,0 +1,334 @@
+package registry
+
+import (
+	"sort"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The protobuf records are encoded by hand to spare generated code,
+// the layout in proto3 is:
+//
+//	message Record {
+//	  uint32 schema = 1;
+//	  string name = 2;
+//	  string version = 3;
+//	  map<string, string> metadata = 4;
+//	  repeated Method methods = 5;
+//	  repeated Node nodes = 6;
+//	}
+//	message Node {
+//	  string id = 1;
+//	  string address = 2;
+//	  map<string, string> metadata = 3;
+//	}
+//	message Method {
+//	  string name = 1;
+//	  repeated Binding bindings = 2;
+//	}
+//	message Binding {
+//	  string method = 1;
+//	  PathTmpl path_tmpl = 2;
+//	  bool assume_colon_verb = 3;
+//	}
+//	message PathTmpl {
+//	  int64 version = 1;
+//	  repeated int64 op_codes = 2;
+//	  repeated string pool = 3;
+//	  string verb = 4;
+//	  repeated string fields = 5;
+//	  string template = 6;
+//	}
+//
+// Fields are only ever added, the unknown fields of newer records are skipped.
+// Only a record of a newer major schema version is refused.
+
+type protoCodec struct{}
+
+func (protoCodec) Marshal(s *Service) ([]byte, error) {
+	b := protowire.AppendTag(nil, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, SchemaVersion)
+	b = appendString(b, 2, s.Name)
+	b = appendString(b, 3, s.Version)
+	b = appendMap(b, 4, s.Metadata)
+	for _, m := range s.Methods {
+		b = appendMessage(b, 5, marshalMethod(m))
+	}
+	for _, n := range s.Nodes {
+		b = appendMessage(b, 6, marshalNode(n))
+	}
+	return b, nil
+}
+
+func (protoCodec) Unmarshal(b []byte) (*Service, error) {
+	if len(b) == 0 {
+		return nil, ErrEmptyRecord
+	}
+	if isJSON(b) {
+		return jsonCodec{}.Unmarshal(b)
+	}
+
+	s := &Service{}
+	err := consumeFields(b, func(num protowire.Number, v []byte, x uint64) error {
+		var err error
+		switch num {
+		case 1:
+			err = checkSchema(x)
+		case 2:
+			s.Name = string(v)
+		case 3:
+			s.Version = string(v)
+		case 4:
+			if s.Metadata == nil {
+				s.Metadata = make(map[string]string)
+			}
+			err = consumeMapEntry(v, s.Metadata)
+		case 5:
+			var m *Method
+			if m, err = unmarshalMethod(v); err == nil {
+				s.Methods = append(s.Methods, m)
+			}
+		case 6:
+			var n *Node
+			if n, err = unmarshalNode(v); err == nil {
+				s.Nodes = append(s.Nodes, n)
+			}
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (protoCodec) Name() string {
+	return "proto"
+}
+
+func marshalNode(n *Node) []byte {
+	b := appendString(nil, 1, n.Id)
+	b = appendString(b, 2, n.Address)
+	return appendMap(b, 3, n.Metadata)
+}
+
+func unmarshalNode(b []byte) (*Node, error) {
+	n := &Node{}
+	err := consumeFields(b, func(num protowire.Number, v []byte, x uint64) error {
+		switch num {
+		case 1:
+			n.Id = string(v)
+		case 2:
+			n.Address = string(v)
+		case 3:
+			if n.Metadata == nil {
+				n.Metadata = make(map[string]string)
+			}
+			return consumeMapEntry(v, n.Metadata)
+		}
+		return nil
+	})
+	return n, err
+}
+
+func marshalMethod(m *Method) []byte {
+	b := appendString(nil, 1, m.Name)
+	for _, bd := range m.Bindings {
+		b = appendMessage(b, 2, marshalBinding(bd))
+	}
+	return b
+}
+
+func unmarshalMethod(b []byte) (*Method, error) {
+	m := &Method{}
+	err := consumeFields(b, func(num protowire.Number, v []byte, x uint64) error {
+		switch num {
+		case 1:
+			m.Name = string(v)
+		case 2:
+			bd, err := unmarshalBinding(v)
+			if err != nil {
+				return err
+			}
+			m.Bindings = append(m.Bindings, bd)
+		}
+		return nil
+	})
+	return m, err
+}
+
+func marshalBinding(bd *Binding) []byte {
+	b := appendString(nil, 1, bd.Method)
+	if bd.PathTmpl != nil {
+		b = appendMessage(b, 2, marshalPathTmpl(bd.PathTmpl))
+	}
+	if bd.AssumeColonVerb {
+		b = protowire.AppendTag(b, 3, protowire.VarintType)
+		b = protowire.AppendVarint(b, 1)
+	}
+	return b
+}
+
+func unmarshalBinding(b []byte) (*Binding, error) {
+	bd := &Binding{}
+	err := consumeFields(b, func(num protowire.Number, v []byte, x uint64) error {
+		var err error
+		switch num {
+		case 1:
+			bd.Method = string(v)
+		case 2:
+			bd.PathTmpl, err = unmarshalPathTmpl(v)
+		case 3:
+			bd.AssumeColonVerb = x != 0
+		}
+		return err
+	})
+	return bd, err
+}
+
+func marshalPathTmpl(p *PathTmpl) []byte {
+	var b []byte
+	if p.Version != 0 {
+		b = protowire.AppendTag(b, 1, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(p.Version))
+	}
+	if len(p.OpCodes) > 0 {
+		var packed []byte
+		for _, op := range p.OpCodes {
+			packed = protowire.AppendVarint(packed, uint64(op))
+		}
+		b = appendMessage(b, 2, packed)
+	}
+	for _, v := range p.Pool {
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendString(b, v)
+	}
+	b = appendString(b, 4, p.Verb)
+	for _, v := range p.Fields {
+		b = protowire.AppendTag(b, 5, protowire.BytesType)
+		b = protowire.AppendString(b, v)
+	}
+	return appendString(b, 6, p.Template)
+}
+
+func unmarshalPathTmpl(b []byte) (*PathTmpl, error) {
+	p := &PathTmpl{}
+	err := consumeFields(b, func(num protowire.Number, v []byte, x uint64) error {
+		switch num {
+		case 1:
+			p.Version = int(x)
+		case 2:
+			// packed, or a single unpacked value
+			if v == nil {
+				p.OpCodes = append(p.OpCodes, int(x))
+				return nil
+			}
+			for len(v) > 0 {
+				op, n := protowire.ConsumeVarint(v)
+				if n < 0 {
+					return protowire.ParseError(n)
+				}
+				p.OpCodes = append(p.OpCodes, int(op))
+				v = v[n:]
+			}
+		case 3:
+			p.Pool = append(p.Pool, string(v))
+		case 4:
+			p.Verb = string(v)
+		case 5:
+			p.Fields = append(p.Fields, string(v))
+		case 6:
+			p.Template = string(v)
+		}
+		return nil
+	})
+	return p, err
+}
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if len(s) == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendMessage(b []byte, num protowire.Number, m []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, m)
+}
+
+// appendMap appends the map entries sorted by key, so equal maps are encoded equally
+func appendMap(b []byte, num protowire.Number, md map[string]string) []byte {
+	keys := make([]string, 0, len(md))
+	for k := range md {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		entry := appendString(nil, 1, k)
+		entry = appendString(entry, 2, md[k])
+		b = appendMessage(b, num, entry)
+	}
+	return b
+}
+
+func consumeMapEntry(b []byte, md map[string]string) error {
+	var k, v string
+	err := consumeFields(b, func(num protowire.Number, val []byte, x uint64) error {
+		switch num {
+		case 1:
+			k = string(val)
+		case 2:
+			v = string(val)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	md[k] = v
+	return nil
+}
+
+// consumeFields calls fn with the value of each varint or length-delimited field,
+// the fields of other wire types are skipped.
+// The value of a varint field is x, v is nil then.
+func consumeFields(b []byte, fn func(num protowire.Number, v []byte, x uint64) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		var v []byte
+		var x uint64
+		switch typ {
+		case protowire.VarintType:
+			x, n = protowire.ConsumeVarint(b)
+		case protowire.BytesType:
+			v, n = protowire.ConsumeBytes(b)
+			if v == nil && n >= 0 {
+				v = []byte{}
+			}
+		default:
+			if n = protowire.ConsumeFieldValue(num, typ, b); n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+			continue
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if err := fn(num, v, x); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func newCodecService() *Service {
+	return &Service{
+		Name:     "foo",
+		Version:  "1.0.0",
+		Metadata: map[string]string{"a": "1", "b": "2"},
+		Methods: []*Method{
+			{
+				Name: "Get",
+				Bindings: []*Binding{
+					{
+						Method: "GET",
+						PathTmpl: &PathTmpl{
+							Version:  1,
+							OpCodes:  []int{2, 0, 4, 1},
+							Pool:     []string{"v1", "foo"},
+							Fields:   []string{"id"},
+							Template: "/v1/foo/{id}",
+						},
+						AssumeColonVerb: true,
+					},
+				},
+			},
+		},
+		Nodes: []*Node{
+			{Id: "node-1", Address: "127.0.0.1:8080", Metadata: map[string]string{"zone": "a"}},
+		},
+	}
+}
+
+func TestCodec(t *testing.T) {
+	exp := newCodecService()
+
+	for _, c := range []Codec{JSONCodec, ProtoCodec} {
+		b, err := c.Marshal(exp)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// each codec decodes the records of the others
+		for _, d := range []Codec{JSONCodec, ProtoCodec} {
+			act, err := d.Unmarshal(b)
+			if err != nil {
+				t.Fatalf("%s decode of %s record error: %v", d.Name(), c.Name(), err)
+			}
+			if !reflect.DeepEqual(exp, act) {
+				t.Fatalf("%s decode of %s record, expected %+v, got %+v", d.Name(), c.Name(), exp, act)
+			}
+		}
+	}
+
+	j, _ := JSONCodec.Marshal(exp)
+	p, _ := ProtoCodec.Marshal(exp)
+	if len(p) >= len(j) {
+		t.Fatalf("Expected the protobuf record to be smaller, got %d >= %d", len(p), len(j))
+	}
+}
+
+func TestCodecLegacy(t *testing.T) {
+	// records of the earlier releases are plain JSON without a schema version
+	exp := newCodecService()
+	b, err := json.Marshal(exp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	act, err := JSONCodec.Unmarshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(exp, act) {
+		t.Fatalf("Expected %+v, got %+v", exp, act)
+	}
+
+	// and the records of the codec are read by the earlier releases
+	b, _ = JSONCodec.Marshal(exp)
+	var legacy *Service
+	if err := json.Unmarshal(b, &legacy); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(exp, legacy) {
+		t.Fatalf("Expected %+v, got %+v", exp, legacy)
+	}
+}
+
+func TestCodecError(t *testing.T) {
+	for _, c := range []Codec{JSONCodec, ProtoCodec} {
+		for _, b := range [][]byte{nil, []byte("{bad"), {0x08, 0xff}} {
+			if _, err := c.Unmarshal(b); err == nil {
+				t.Fatalf("Expected %s decode error for %q", c.Name(), b)
+			}
+		}
+	}
+}
+
+func TestCodecSchemaVersion(t *testing.T) {
+	s := newCodecService()
+
+	records := func(v uint64) [][]byte {
+		j, err := json.Marshal(&jsonRecord{Schema: int(v), Service: s})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// a newer record with a field unknown to this version
+		p := protowire.AppendTag(nil, 1, protowire.VarintType)
+		p = protowire.AppendVarint(p, v)
+		p = appendString(p, 2, s.Name)
+		p = appendString(p, 99, "unknown")
+		return [][]byte{j, p}
+	}
+
+	// a record of a newer minor schema version is decoded by both codecs
+	for _, c := range []Codec{JSONCodec, ProtoCodec} {
+		for _, b := range records(SchemaVersion + 1) {
+			r, err := c.Unmarshal(b)
+			if err != nil {
+				t.Fatalf("Expected %s to decode a newer record, got %v", c.Name(), err)
+			}
+			if exp, act := s.Name, r.Name; exp != act {
+				t.Fatalf("Expected %s name `%s`, got `%s`.", c.Name(), exp, act)
+			}
+		}
+	}
+
+	// a record of a newer major schema version is refused by both codecs
+	for _, c := range []Codec{JSONCodec, ProtoCodec} {
+		for _, b := range records(SchemaMajor) {
+			if _, err := c.Unmarshal(b); !errors.Is(err, ErrSchemaVersion) {
+				t.Fatalf("Expected %s %v, got %v", c.Name(), ErrSchemaVersion, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package consul
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+
+	"github.com/hb-go/grpc-contrib/registry"
+)
+
+// healthCheck is a check of the nodes by the consul agent
+type healthCheck struct {
+	// grpc checks the grpc.health.v1 service, else the http path
+	grpc     bool
+	path     string
+	interval time.Duration
+
+	service         string
+	timeout         time.Duration
+	deregisterAfter time.Duration
+	tls             bool
+	tlsSkipVerify   bool
+}
+
+func (hc *healthCheck) agentCheck(node *registry.Node) *consul.AgentServiceCheck {
+	deregTTL := hc.deregisterAfter
+	if deregTTL <= time.Duration(0) {
+		deregTTL = getDeregisterTTL(hc.interval)
+	}
+
+	check := &consul.AgentServiceCheck{
+		Interval:                       fmt.Sprintf("%v", hc.interval),
+		DeregisterCriticalServiceAfter: fmt.Sprintf("%v", deregTTL),
+		TLSSkipVerify:                  hc.tlsSkipVerify,
+	}
+	if hc.timeout > time.Duration(0) {
+		check.Timeout = fmt.Sprintf("%v", hc.timeout)
+	}
+
+	if hc.grpc {
+		check.GRPC = node.Address
+		if len(hc.service) > 0 {
+			check.GRPC += "/" + hc.service
+		}
+		check.GRPCUseTLS = hc.tls
+		return check
+	}
+
+	scheme := "http://"
+	if hc.tls {
+		scheme = "https://"
+	}
+	check.HTTP = scheme + node.Address + "/" + strings.TrimPrefix(hc.path, "/")
+	check.Method = "GET"
+	return check
+}
+
+// newCheck returns the check of the node and its interval,
+// a health check of the register options takes precedence over
+// the TCPCheck of the registry, which takes precedence over the TTL check.
+func (c *consulRegistry) newCheck(node *registry.Node, options registry.RegisterOptions) (*consul.AgentServiceCheck, time.Duration) {
+	if options.Context != nil {
+		if hc, ok := options.Context.Value("consul_health_check").(*healthCheck); ok {
+			return hc.agentCheck(node), hc.interval
+		}
+	}
+
+	if c.opts.Context != nil {
+		if tcpCheckInterval, ok := c.opts.Context.Value("consul_tcp_check").(time.Duration); ok {
+			return &consul.AgentServiceCheck{
+				TCP:                            node.Address,
+				Interval:                       fmt.Sprintf("%v", tcpCheckInterval),
+				DeregisterCriticalServiceAfter: fmt.Sprintf("%v", getDeregisterTTL(tcpCheckInterval)),
+			}, tcpCheckInterval
+		}
+	}
+
+	// if the TTL is greater than 0 create an associated check
+	if options.TTL > time.Duration(0) {
+		return &consul.AgentServiceCheck{
+			TTL:                            fmt.Sprintf("%v", options.TTL),
+			DeregisterCriticalServiceAfter: fmt.Sprintf("%v", getDeregisterTTL(options.TTL)),
+		}, 0
+	}
+
+	return nil, 0
+}
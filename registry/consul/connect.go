@@ -0,0 +1,386 @@
+package consul
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+	"github.com/hb-go/grpc-contrib/registry"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/grpclog"
+)
+
+var (
+	// ErrNotConsul is returned for the credentials of a registry which is not consul
+	ErrNotConsul = errors.New("registry is not consul")
+	// ErrUnauthorized is returned if the intentions deny the connection
+	ErrUnauthorized = errors.New("connection unauthorized by intentions")
+	// ErrServiceMismatch is returned if the server isn't the service dialed
+	ErrServiceMismatch = errors.New("server certificate of another service")
+
+	// authorizeTimeout bounds the authorization of a connection if the registry has no timeout
+	authorizeTimeout = 10 * time.Second
+)
+
+// connectTLS holds the Connect leaf certificate of the service and the CA roots
+// of the local agent, both are watched with blocking queries and rotated on change.
+type connectTLS struct {
+	client  *consul.Client
+	service string
+	// auth authorizes the connections, its requests are bounded by the timeout
+	auth *consul.Client
+
+	mu    sync.RWMutex
+	cert  *tls.Certificate
+	roots *x509.CertPool
+	// trustDomain of the roots, the host of the SPIFFE URIs
+	trustDomain string
+}
+
+func newConnectTLS(ctx context.Context, r registry.Registry, service string) (*connectTLS, error) {
+	cr, ok := r.(*consulRegistry)
+	if !ok {
+		return nil, ErrNotConsul
+	}
+
+	// the handshake of the server has no context, the authorization
+	// is bounded by the timeout of the registry instead
+	config := *cr.config
+	hc := *config.HttpClient
+	if hc.Timeout <= 0 {
+		hc.Timeout = authorizeTimeout
+	}
+	config.HttpClient = &hc
+	auth, err := consul.NewClient(&config)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &connectTLS{
+		client:  cr.Client(),
+		service: service,
+		auth:    auth,
+	}
+
+	// load both before the first handshake
+	rootsIdx, err := c.loadRoots(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+	leafIdx, err := c.loadLeaf(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	go c.watch(ctx, "roots", rootsIdx, c.loadRoots)
+	go c.watch(ctx, "leaf", leafIdx, c.loadLeaf)
+
+	return c, nil
+}
+
+// watch reloads the certificates until the context is done
+func (c *connectTLS) watch(ctx context.Context, name string, index uint64, load func(context.Context, uint64) (uint64, error)) {
+	for {
+		last, err := load(ctx, index)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			grpclog.Warningf("grpc-contrib.registry: consul connect %s of %s error: %v", name, c.service, err)
+			if !waitRetry(ctx) {
+				return
+			}
+			continue
+		}
+
+		// the index went backwards, e.g. the servers were restored
+		if last < index {
+			last = 0
+		}
+		index = last
+	}
+}
+
+// loadRoots loads the CA roots, it is a blocking query until the index changes if index is set
+func (c *connectTLS) loadRoots(ctx context.Context, index uint64) (uint64, error) {
+	q := (&consul.QueryOptions{WaitIndex: index}).WithContext(ctx)
+	list, meta, err := c.client.Agent().ConnectCARoots(q)
+	if err != nil {
+		return 0, err
+	}
+	if meta.LastIndex == index {
+		return index, nil
+	}
+
+	// the inactive roots are trusted as well, during a rotation of the CA
+	roots := x509.NewCertPool()
+	for _, root := range list.Roots {
+		if !roots.AppendCertsFromPEM([]byte(root.RootCertPEM)) {
+			return 0, fmt.Errorf("invalid CA root %s", root.ID)
+		}
+	}
+
+	c.mu.Lock()
+	c.roots = roots
+	c.trustDomain = list.TrustDomain
+	c.mu.Unlock()
+
+	return meta.LastIndex, nil
+}
+
+// loadLeaf loads the leaf certificate, it is a blocking query until the index changes if index is set
+func (c *connectTLS) loadLeaf(ctx context.Context, index uint64) (uint64, error) {
+	q := (&consul.QueryOptions{WaitIndex: index}).WithContext(ctx)
+	leaf, meta, err := c.client.Agent().ConnectCALeaf(c.service, q)
+	if err != nil {
+		return 0, err
+	}
+	if meta.LastIndex == index {
+		return index, nil
+	}
+
+	cert, err := tls.X509KeyPair([]byte(leaf.CertPEM), []byte(leaf.PrivateKeyPEM))
+	if err != nil {
+		return 0, err
+	}
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.mu.Unlock()
+
+	return meta.LastIndex, nil
+}
+
+func (c *connectTLS) certificate() (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// verify verifies the peer certificate against the current CA roots,
+// the host name isn't verified as the identity of Connect is the SPIFFE URI.
+func (c *connectTLS) verify(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return errors.New("no peer certificate")
+	}
+
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	c.mu.RLock()
+	roots := c.roots
+	c.mu.RUnlock()
+
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err
+}
+
+func (c *connectTLS) serverConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return c.certificate()
+		},
+		// verified against the rotated roots by VerifyPeerCertificate
+		ClientAuth:            tls.RequireAnyClientCert,
+		VerifyPeerCertificate: c.verify,
+	}
+}
+
+func (c *connectTLS) clientConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return c.certificate()
+		},
+		// verified against the rotated roots by VerifyPeerCertificate,
+		// the service by the SPIFFE URI after the handshake
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: c.verify,
+	}
+}
+
+// authorize authorizes the connection of the peer to the service by the intentions
+func (c *connectTLS) authorize(info credentials.AuthInfo) error {
+	tlsInfo, ok := info.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.PeerCertificates) == 0 {
+		return errors.New("no peer certificate")
+	}
+
+	cert := tlsInfo.State.PeerCertificates[0]
+	if len(cert.URIs) == 0 {
+		return errors.New("no SPIFFE URI in the peer certificate")
+	}
+
+	auth, err := c.auth.Agent().ConnectAuthorize(&consul.AgentAuthorizeParams{
+		Target:           c.service,
+		ClientCertURI:    cert.URIs[0].String(),
+		ClientCertSerial: hexString(cert.SerialNumber.Bytes()),
+	})
+	if err != nil {
+		return err
+	}
+	if !auth.Authorized {
+		return fmt.Errorf("%w: %s", ErrUnauthorized, auth.Reason)
+	}
+
+	return nil
+}
+
+// verifyService verifies the SPIFFE URI of the server certificate is the one
+// of the service in the trust domain of the roots, like
+// spiffe://<trust domain>/ns/<namespace>/dc/<datacenter>/svc/<service>
+func (c *connectTLS) verifyService(info credentials.AuthInfo, service string) error {
+	tlsInfo, ok := info.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.PeerCertificates) == 0 {
+		return errors.New("no peer certificate")
+	}
+
+	c.mu.RLock()
+	trustDomain := c.trustDomain
+	c.mu.RUnlock()
+
+	for _, uri := range tlsInfo.State.PeerCertificates[0].URIs {
+		if uri.Scheme != "spiffe" {
+			continue
+		}
+		if len(trustDomain) > 0 && !strings.EqualFold(uri.Host, trustDomain) {
+			continue
+		}
+		if serviceOfURI(uri) == service {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: expected %s", ErrServiceMismatch, service)
+}
+
+// serviceOfURI returns the service of a SPIFFE URI of consul
+func serviceOfURI(uri *url.URL) string {
+	parts := strings.Split(strings.Trim(uri.Path, "/"), "/")
+	for i := 0; i+1 < len(parts); i += 2 {
+		if parts[i] == "svc" {
+			return parts[i+1]
+		}
+	}
+	return ""
+}
+
+// serviceOfAuthority returns the service dialed, the authority is the
+// endpoint of the target, e.g. api or api?version=1.0.0
+func serviceOfAuthority(authority string) string {
+	if i := strings.IndexByte(authority, '?'); i >= 0 {
+		authority = authority[:i]
+	}
+	if host, _, err := net.SplitHostPort(authority); err == nil {
+		return host
+	}
+	return authority
+}
+
+// hexString returns the bytes in hex separated by ':', like the serial numbers of consul
+func hexString(b []byte) string {
+	parts := make([]string, 0, len(b))
+	for _, v := range b {
+		parts = append(parts, fmt.Sprintf("%02x", v))
+	}
+	return strings.Join(parts, ":")
+}
+
+// connectCredentials authorizes the connections of the servers by the intentions,
+// the clients verify the servers are the services dialed
+type connectCredentials struct {
+	credentials.TransportCredentials
+	tls *connectTLS
+}
+
+func (cc *connectCredentials) ServerHandshake(rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	conn, info, err := cc.TransportCredentials.ServerHandshake(rawConn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := cc.tls.authorize(info); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	return conn, info, nil
+}
+
+func (cc *connectCredentials) ClientHandshake(ctx context.Context, authority string, rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	conn, info, err := cc.TransportCredentials.ClientHandshake(ctx, authority, rawConn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := cc.tls.verifyService(info, serviceOfAuthority(authority)); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	return conn, info, nil
+}
+
+func (cc *connectCredentials) Clone() credentials.TransportCredentials {
+	return &connectCredentials{
+		TransportCredentials: cc.TransportCredentials.Clone(),
+		tls:                  cc.tls,
+	}
+}
+
+// NewServerCredentials returns the Connect-native mTLS credentials of the service
+// for grpc.Creds. The leaf certificate and the CA roots are fetched from the local
+// agent and rotated on change until the context is done, the connections are
+// authorized by the intentions. The service should be registered with Connect.
+func NewServerCredentials(ctx context.Context, r registry.Registry, service string) (credentials.TransportCredentials, error) {
+	c, err := newConnectTLS(ctx, r, service)
+	if err != nil {
+		return nil, err
+	}
+
+	return &connectCredentials{
+		TransportCredentials: credentials.NewTLS(c.serverConfig()),
+		tls:                  c,
+	}, nil
+}
+
+// NewClientCredentials returns the Connect-native mTLS credentials of the service
+// for grpc.WithTransportCredentials, the client is authorized by the intentions
+// of the servers and the servers must have the certificate of the service dialed,
+// the service of the authority of the target. The leaf certificate and the CA roots are fetched from the local
+// agent and rotated on change until the context is done.
+func NewClientCredentials(ctx context.Context, r registry.Registry, service string) (credentials.TransportCredentials, error) {
+	c, err := newConnectTLS(ctx, r, service)
+	if err != nil {
+		return nil, err
+	}
+
+	return &connectCredentials{
+		TransportCredentials: credentials.NewTLS(c.clientConfig()),
+		tls:                  c,
+	}, nil
+}
@@ -0,0 +1,316 @@
+package consul
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+	"github.com/hb-go/grpc-contrib/registry"
+	"google.golang.org/grpc/credentials"
+)
+
+type mockCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  string
+}
+
+func newMockCA(t *testing.T) *mockCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Consul CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &mockCA{
+		cert: cert,
+		key:  key,
+		pem:  string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+	}
+}
+
+func (ca *mockCA) leaf(t *testing.T, service string, serial int64) *consul.LeafCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri, _ := url.Parse("spiffe://11111111.consul/ns/default/dc/dc1/svc/" + service)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: service},
+		URIs:         []*url.URL{uri},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kb, _ := x509.MarshalECPrivateKey(key)
+	return &consul.LeafCert{
+		Service:       service,
+		ServiceURI:    uri.String(),
+		CertPEM:       string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		PrivateKeyPEM: string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb})),
+	}
+}
+
+// newMockAgent serves the Connect endpoints of the agent, the queries
+// with the current index block until the request is canceled
+func newMockAgent(t *testing.T, ca *mockCA, authorized *int32, authorize *consul.AgentAuthorizeParams, opts ...registry.Option) (*consulRegistry, func()) {
+	mux := http.NewServeMux()
+	blocking := func(w http.ResponseWriter, r *http.Request, obj interface{}) {
+		if r.URL.Query().Get("index") == "1" {
+			<-r.Context().Done()
+			return
+		}
+		w.Header().Set("X-Consul-Index", "1")
+		json.NewEncoder(w).Encode(obj)
+	}
+	mux.HandleFunc("/v1/agent/connect/ca/roots", func(w http.ResponseWriter, r *http.Request) {
+		blocking(w, r, &consul.CARootList{
+			Roots: []*consul.CARoot{{ID: "root", RootCertPEM: ca.pem, Active: true}},
+		})
+	})
+	mux.HandleFunc("/v1/agent/connect/ca/leaf/", func(w http.ResponseWriter, r *http.Request) {
+		service := strings.TrimPrefix(r.URL.Path, "/v1/agent/connect/ca/leaf/")
+		blocking(w, r, ca.leaf(t, service, 0x1234))
+	})
+	mux.HandleFunc("/v1/agent/connect/authorize", func(w http.ResponseWriter, r *http.Request) {
+		// the agent doesn't answer
+		if atomic.LoadInt32(authorized) == 2 {
+			<-r.Context().Done()
+			return
+		}
+		json.NewDecoder(r.Body).Decode(authorize)
+		json.NewEncoder(w).Encode(&consul.AgentAuthorize{
+			Authorized: atomic.LoadInt32(authorized) == 1,
+			Reason:     "intention",
+		})
+	})
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go http.Serve(l, mux)
+
+	cfg := consul.DefaultConfig()
+	cfg.Address = l.Addr().String()
+	cr := NewRegistry(append([]registry.Option{registry.Addrs(cfg.Address), Config(cfg)}, opts...)...).(*consulRegistry)
+
+	return cr, func() {
+		l.Close()
+	}
+}
+
+// handshake returns the errors of the handshakes of the client and the server
+func handshake(t *testing.T, server, client credentials.TransportCredentials, authority string) (error, error) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	serr := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			serr <- err
+			return
+		}
+		defer conn.Close()
+		_, _, err = server.ServerHandshake(conn)
+		serr <- err
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, _, cerr := client.ClientHandshake(context.Background(), authority, conn)
+	return cerr, <-serr
+}
+
+func TestConnectCredentials(t *testing.T) {
+	ca := newMockCA(t)
+	authorized := int32(1)
+	var authorize consul.AgentAuthorizeParams
+	cr, cl := newMockAgent(t, ca, &authorized, &authorize)
+	defer cl()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server, err := NewServerCredentials(ctx, cr, "api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClientCredentials(ctx, cr, "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cerr, serr := handshake(t, server, client, "api")
+	if cerr != nil || serr != nil {
+		t.Fatalf("Expected the handshake, got client %v, server %v", cerr, serr)
+	}
+	if exp, act := "spiffe://11111111.consul/ns/default/dc/dc1/svc/web", authorize.ClientCertURI; exp != act {
+		t.Fatalf("Expected %s, got %s", exp, act)
+	}
+	if exp, act := "12:34", authorize.ClientCertSerial; exp != act {
+		t.Fatalf("Expected %s, got %s", exp, act)
+	}
+	if exp, act := "api", authorize.Target; exp != act {
+		t.Fatalf("Expected %s, got %s", exp, act)
+	}
+
+	// the intentions deny the connection
+	atomic.StoreInt32(&authorized, 0)
+	if _, serr := handshake(t, server, client, "api"); !errors.Is(serr, ErrUnauthorized) {
+		t.Fatalf("Expected %v, got %v", ErrUnauthorized, serr)
+	}
+}
+
+func TestConnectCredentials_UntrustedPeer(t *testing.T) {
+	ca := newMockCA(t)
+	authorized := int32(1)
+	var authorize consul.AgentAuthorizeParams
+	cr, cl := newMockAgent(t, ca, &authorized, &authorize)
+	defer cl()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c, err := newConnectTLS(ctx, cr, "api")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a certificate of another CA isn't trusted
+	other := newMockCA(t)
+	block, _ := pem.Decode([]byte(other.leaf(t, "web", 1).CertPEM))
+	if err := c.verify([][]byte{block.Bytes}, nil); err == nil {
+		t.Fatalf("Expected the certificate of another CA to be refused")
+	}
+
+	block, _ = pem.Decode([]byte(ca.leaf(t, "web", 1).CertPEM))
+	if err := c.verify([][]byte{block.Bytes}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewServerCredentials(ctx, registry.DefaultRegistry, "api"); err != ErrNotConsul {
+		t.Fatalf("Expected %v, got %v", ErrNotConsul, err)
+	}
+}
+
+func TestConnectCredentials_ServiceMismatch(t *testing.T) {
+	ca := newMockCA(t)
+	authorized := int32(1)
+	var authorize consul.AgentAuthorizeParams
+	cr, cl := newMockAgent(t, ca, &authorized, &authorize)
+	defer cl()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server, err := NewServerCredentials(ctx, cr, "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClientCredentials(ctx, cr, "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the server of db is dialed as api
+	if cerr, _ := handshake(t, server, client, "api"); !errors.Is(cerr, ErrServiceMismatch) {
+		t.Fatalf("Expected %v, got %v", ErrServiceMismatch, cerr)
+	}
+
+	// the authority of the target has the versions
+	if cerr, serr := handshake(t, server, client, "db?version=1.0.0"); cerr != nil || serr != nil {
+		t.Fatalf("Expected the handshake, got client %v, server %v", cerr, serr)
+	}
+
+	for authority, exp := range map[string]string{
+		"api":                "api",
+		"api:8080":           "api",
+		"api?version=1|2":    "api",
+		"api:8080?version=1": "api",
+	} {
+		if act := serviceOfAuthority(authority); exp != act {
+			t.Fatalf("Expected %s, got %s", exp, act)
+		}
+	}
+
+	uri, _ := url.Parse("spiffe://11111111.consul/ns/default/dc/dc1/svc/api")
+	if exp, act := "api", serviceOfURI(uri); exp != act {
+		t.Fatalf("Expected %s, got %s", exp, act)
+	}
+}
+
+func TestConnectCredentials_AuthorizeTimeout(t *testing.T) {
+	ca := newMockCA(t)
+	authorized := int32(2)
+	var authorize consul.AgentAuthorizeParams
+	cr, cl := newMockAgent(t, ca, &authorized, &authorize, registry.Timeout(100*time.Millisecond))
+	defer cl()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server, err := NewServerCredentials(ctx, cr, "api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClientCredentials(ctx, cr, "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, serr := handshake(t, server, client, "api")
+		done <- serr
+	}()
+
+	select {
+	case serr := <-done:
+		if serr == nil {
+			t.Fatalf("Expected the authorization to time out")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the authorization to be bounded by the timeout")
+	}
+}
@@ -1,9 +1,9 @@
 package consul
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
-	"fmt"
 	"net"
 	"net/http"
 	"runtime"
@@ -17,7 +17,7 @@ import (
 	hash "github.com/mitchellh/hashstructure"
 )
 
-const schema = "registry"
+const schema = "consul"
 const queryValSeq = "|"
 
 type consulRegistry struct {
@@ -29,6 +29,12 @@ type consulRegistry struct {
 
 	// connect enabled
 	connect bool
+	// legacyTags encodes all in tags as well
+	legacyTags bool
+	// failover datacenters in order, if there are no healthy nodes
+	failover []string
+	// preparedQuery executes the prepared query named after the service
+	preparedQuery bool
 
 	queryOptions *consul.QueryOptions
 
@@ -79,6 +85,11 @@ func configure(c *consulRegistry, opts ...registry.Option) {
 		o(&c.opts)
 	}
 
+	// the scheme of the targets and the resolver builder
+	if len(c.opts.Scheme) == 0 {
+		c.opts.Scheme = schema
+	}
+
 	// use default config
 	config := consul.DefaultConfig()
 
@@ -90,6 +101,15 @@ func configure(c *consulRegistry, opts ...registry.Option) {
 		if cn, ok := c.opts.Context.Value("consul_connect").(bool); ok {
 			c.connect = cn
 		}
+		if lt, ok := c.opts.Context.Value("consul_legacy_tags").(bool); ok {
+			c.legacyTags = lt
+		}
+		if fo, ok := c.opts.Context.Value("consul_failover").([]string); ok {
+			c.failover = fo
+		}
+		if pq, ok := c.opts.Context.Value("consul_prepared_query").(bool); ok {
+			c.preparedQuery = pq
+		}
 
 		// Use the consul query options passed in the options, if available
 		if qo, ok := c.opts.Context.Value("consul_query_options").(*consul.QueryOptions); ok && qo != nil {
@@ -160,71 +180,125 @@ func (r *consulRegistry) NewTarget(s *registry.Service, opts ...registry.Option)
 		o(&options)
 	}
 
+	// the datacenter is the authority of the target
+	dc := options.Namespace
+	if len(dc) == 0 {
+		dc = r.opts.Namespace
+	}
+
 	if len(options.Versions) == 0 {
-		return schema + ":///" + s.Name
+		return r.opts.Scheme + "://" + dc + "/" + s.Name
 	}
 
-	return schema + ":///" + s.Name + "?version=" + strings.Join(options.Versions, queryValSeq)
+	return r.opts.Scheme + "://" + dc + "/" + s.Name + "?version=" + strings.Join(options.Versions, queryValSeq)
+}
+
+// agentWrite is a PUT to an agent endpoint which can be canceled by the context,
+// the agent methods of the consul api don't take a context.
+func (c *consulRegistry) agentWrite(ctx context.Context, endpoint string, in interface{}) error {
+	_, err := c.Client().Raw().Write(endpoint, in, nil, (&consul.WriteOptions{}).WithContext(ctx))
+	return err
 }
 
 func (c *consulRegistry) Deregister(s *registry.Service) error {
+	return c.DeregisterContext(context.Background(), s)
+}
+
+func (c *consulRegistry) DeregisterContext(ctx context.Context, s *registry.Service) error {
 	if len(s.Nodes) == 0 {
 		return errors.New("Require at least one node")
 	}
 
-	// delete our hash and time check of the service
-	c.Lock()
-	delete(c.register, s.Name)
-	delete(c.lastChecked, s.Name)
-	c.Unlock()
+	var gerr error
+
+	// deregister each node individually
+	for _, node := range s.Nodes {
+		// delete our hash and time check of the node
+		key := nodeKey(s.Name, node.Id)
+		c.Lock()
+		delete(c.register, key)
+		delete(c.lastChecked, key)
+		c.Unlock()
+
+		if err := c.agentWrite(ctx, "/v1/agent/service/deregister/"+node.Id, nil); err != nil && gerr == nil {
+			gerr = err
+		}
+	}
 
-	node := s.Nodes[0]
-	return c.Client().Agent().ServiceDeregister(node.Id)
+	return gerr
 }
 
 func (c *consulRegistry) Register(s *registry.Service, opts ...registry.RegisterOption) error {
+	return c.RegisterContext(context.Background(), s, opts...)
+}
+
+func (c *consulRegistry) RegisterContext(ctx context.Context, s *registry.Service, opts ...registry.RegisterOption) error {
 	if len(s.Nodes) == 0 {
 		return errors.New("Require at least one node")
 	}
 
-	var regTCPCheck bool
-	var regInterval time.Duration
-
 	var options registry.RegisterOptions
 	for _, o := range opts {
 		o(&options)
 	}
 
-	if c.opts.Context != nil {
-		if tcpCheckInterval, ok := c.opts.Context.Value("consul_tcp_check").(time.Duration); ok {
-			regTCPCheck = true
-			regInterval = tcpCheckInterval
+	var gerr error
+
+	// register each node individually, a failed node doesn't stop the others
+	for _, node := range s.Nodes {
+		if err := c.registerNode(ctx, s, node, options); err != nil && gerr == nil {
+			gerr = err
 		}
 	}
 
-	// create hash of service; uint64
-	h, err := hash.Hash(s, nil)
+	return gerr
+}
+
+// nodeKey is the key of a node in the bookkeeping,
+// the nodes of a service are registered apart
+func nodeKey(service, id string) string {
+	return service + "/" + id
+}
+
+func (c *consulRegistry) registerNode(ctx context.Context, s *registry.Service, node *registry.Node, options registry.RegisterOptions) error {
+	check, regInterval := c.newCheck(node, options)
+	// the TTL check is passed by the registry, the others by the agent
+	passTTL := check != nil && len(check.TTL) > 0
+
+	// create hash of the service node and its check; uint64
+	h, err := hash.Hash(struct {
+		Service *registry.Service
+		Check   *consul.AgentServiceCheck
+	}{
+		Service: &registry.Service{
+			Name:     s.Name,
+			Version:  s.Version,
+			Metadata: s.Metadata,
+			Methods:  s.Methods,
+			Nodes:    []*registry.Node{node},
+		},
+		Check: check,
+	}, nil)
 	if err != nil {
 		return err
 	}
 
-	// use first node
-	node := s.Nodes[0]
+	key := nodeKey(s.Name, node.Id)
 
 	// get existing hash and last checked time
 	c.Lock()
-	v, ok := c.register[s.Name]
-	lastChecked := c.lastChecked[s.Name]
+	v, ok := c.register[key]
+	lastChecked := c.lastChecked[key]
 	c.Unlock()
 
 	// if it's already registered and matches then just pass the check
 	if ok && v == h {
-		if options.TTL == time.Duration(0) {
+		if !passTTL {
 			// ensure that our service hasn't been deregistered by Consul
 			if time.Since(lastChecked) <= getDeregisterTTL(regInterval) {
 				return nil
 			}
-			services, _, err := c.Client().Health().Checks(s.Name, c.queryOptions)
+			services, _, err := c.Client().Health().Checks(s.Name, c.queryOptions.WithContext(ctx))
 			if err == nil {
 				for _, v := range services {
 					if v.ServiceID == node.Id {
@@ -235,37 +309,14 @@ func (c *consulRegistry) Register(s *registry.Service, opts ...registry.Register
 		} else {
 			// if the err is nil we're all good, bail out
 			// if not, we don't know what the state is, so full re-register
-			if err := c.Client().Agent().PassTTL("service:"+node.Id, ""); err == nil {
+			if err := c.agentWrite(ctx, "/v1/agent/check/pass/service:"+node.Id, nil); err == nil {
 				return nil
 			}
 		}
 	}
 
-	// encode the tags
-	tags := encodeMetadata(node.Metadata)
-	tags = append(tags, encodeMethods(s.Methods)...)
-	tags = append(tags, encodeVersion(s.Version)...)
-
-	var check *consul.AgentServiceCheck
-
-	if regTCPCheck {
-		deregTTL := getDeregisterTTL(regInterval)
-
-		check = &consul.AgentServiceCheck{
-			TCP:                            node.Address,
-			Interval:                       fmt.Sprintf("%v", regInterval),
-			DeregisterCriticalServiceAfter: fmt.Sprintf("%v", deregTTL),
-		}
-
-		// if the TTL is greater than 0 create an associated check
-	} else if options.TTL > time.Duration(0) {
-		deregTTL := getDeregisterTTL(options.TTL)
-
-		check = &consul.AgentServiceCheck{
-			TTL:                            fmt.Sprintf("%v", options.TTL),
-			DeregisterCriticalServiceAfter: fmt.Sprintf("%v", deregTTL),
-		}
-	}
+	// encode the meta and the tags
+	meta, tags := encodeMeta(s, node, c.legacyTags)
 
 	host, pt, _ := net.SplitHostPort(node.Address)
 	if host == "" {
@@ -278,6 +329,7 @@ func (c *consulRegistry) Register(s *registry.Service, opts ...registry.Register
 		ID:      node.Id,
 		Name:    s.Name,
 		Tags:    tags,
+		Meta:    meta,
 		Port:    port,
 		Address: host,
 		Check:   check,
@@ -290,102 +342,151 @@ func (c *consulRegistry) Register(s *registry.Service, opts ...registry.Register
 		}
 	}
 
-	if err := c.Client().Agent().ServiceRegister(asr); err != nil {
+	if err := c.agentWrite(ctx, "/v1/agent/service/register", asr); err != nil {
 		return err
 	}
 
-	// save our hash and time check of the service
+	// save our hash and time check of the node
 	c.Lock()
-	c.register[s.Name] = h
-	c.lastChecked[s.Name] = time.Now()
+	c.register[key] = h
+	c.lastChecked[key] = time.Now()
 	c.Unlock()
 
-	// if the TTL is 0 we don't mess with the checks
-	if options.TTL == time.Duration(0) {
+	// if there is no TTL check we don't mess with the checks
+	if !passTTL {
 		return nil
 	}
 
 	// pass the healthcheck
-	return c.Client().Agent().PassTTL("service:"+node.Id, "")
+	return c.agentWrite(ctx, "/v1/agent/check/pass/service:"+node.Id, nil)
 }
 
 func (c *consulRegistry) GetService(name string) ([]*registry.Service, error) {
-	var rsp []*consul.ServiceEntry
-	var err error
+	return c.GetServiceContext(context.Background(), name)
+}
 
-	// if we're connect enabled only get connect services
-	if c.connect {
-		rsp, _, err = c.Client().Health().Connect(name, "", false, c.queryOptions)
-	} else {
-		rsp, _, err = c.Client().Health().Service(name, "", false, c.queryOptions)
-	}
-	if err != nil {
-		return nil, err
+func (c *consulRegistry) GetServiceContext(ctx context.Context, name string) ([]*registry.Service, error) {
+	return c.lookup(ctx, name, c.datacenters(ctx))
+}
+
+// datacenters returns the datacenters of a call in the failover order, the one
+// of the target or else of the registry, "" for the one of the agent, then the
+// failover ones.
+func (c *consulRegistry) datacenters(ctx context.Context) []string {
+	dc := c.opts.Namespace
+	if ns, ok := registry.NamespaceFromContext(ctx); ok {
+		dc = ns
+	}
+
+	dcs := []string{dc}
+	for _, f := range c.failover {
+		var seen bool
+		for _, d := range dcs {
+			if d == f {
+				seen = true
+				break
+			}
+		}
+		if !seen {
+			dcs = append(dcs, f)
+		}
 	}
+	return dcs
+}
 
-	serviceMap := map[string]*registry.Service{}
+// lookup returns the services of the first datacenter with healthy nodes,
+// or of the first one answering if none has.
+func (c *consulRegistry) lookup(ctx context.Context, name string, dcs []string) ([]*registry.Service, error) {
+	var first map[string]*registry.Service
+	var gerr error
 
-	for _, s := range rsp {
-		if s.Service.Service != name {
+	for _, dc := range dcs {
+		entries, err := c.serviceEntries(ctx, name, dc)
+		if err != nil {
+			if gerr == nil {
+				gerr = err
+			}
 			continue
 		}
 
-		// version is now a tag
-		version, _ := decodeVersion(s.Service.Tags)
-		// service ID is now the node id
-		id := s.Service.ID
-		// key is always the version
-		key := version
+		serviceMap := toServiceMap(name, entries)
+		if healthy(serviceMap) {
+			return toServices(serviceMap), nil
+		}
+		if first == nil {
+			first = serviceMap
+		}
+	}
+
+	if first == nil && gerr != nil {
+		return nil, gerr
+	}
+	return toServices(first), nil
+}
 
-		// address is service address
-		address := s.Service.Address
+// serviceEntries returns the entries of the service in the datacenter,
+// by a prepared query or a health query.
+func (c *consulRegistry) serviceEntries(ctx context.Context, name, dc string) ([]*consul.ServiceEntry, error) {
+	if !c.preparedQuery {
+		entries, _, err := c.healthEntries(ctx, name, dc, 0)
+		return entries, err
+	}
 
-		// use node address
-		if len(address) == 0 {
-			address = s.Node.Address
-		}
+	q := c.queryOptions.WithContext(ctx)
+	if len(dc) > 0 {
+		q.Datacenter = dc
+	}
 
-		svc, ok := serviceMap[key]
-		if !ok {
-			svc = &registry.Service{
-				Methods: decodeMethods(s.Service.Tags),
-				Name:    s.Service.Service,
-				Version: version,
-			}
-			serviceMap[key] = svc
-		}
+	rsp, _, err := c.Client().PreparedQuery().Execute(name, q)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*consul.ServiceEntry, 0, len(rsp.Nodes))
+	for i := range rsp.Nodes {
+		entries = append(entries, &rsp.Nodes[i])
+	}
+	return entries, nil
+}
 
-		var del bool
+// healthEntries returns the entries of the service in the datacenter and the index
+// of the result, it is a blocking query until the index changes if index is set.
+func (c *consulRegistry) healthEntries(ctx context.Context, name, dc string, index uint64) ([]*consul.ServiceEntry, uint64, error) {
+	q := c.queryOptions.WithContext(ctx)
+	if len(dc) > 0 {
+		q.Datacenter = dc
+	}
+	q.WaitIndex = index
 
-		for _, check := range s.Checks {
-			// delete the node if the status is critical
-			if check.Status == "critical" {
-				del = true
-				break
-			}
+	if filter, ok := ctx.Value(filterKey{}).(string); ok && len(filter) > 0 {
+		if len(q.Filter) > 0 {
+			q.Filter = "(" + q.Filter + ") and (" + filter + ")"
+		} else {
+			q.Filter = filter
 		}
+	}
 
-		// if delete then skip the node
-		if del {
-			continue
-		}
+	var rsp []*consul.ServiceEntry
+	var meta *consul.QueryMeta
+	var err error
 
-		svc.Nodes = append(svc.Nodes, &registry.Node{
-			Id:       id,
-			Address:  hostPort(address, s.Service.Port),
-			Metadata: decodeMetadata(s.Service.Tags),
-		})
+	// if we're connect enabled only get connect services
+	if c.connect {
+		rsp, meta, err = c.Client().Health().Connect(name, "", false, q)
+	} else {
+		rsp, meta, err = c.Client().Health().Service(name, "", false, q)
 	}
-
-	var services []*registry.Service
-	for _, service := range serviceMap {
-		services = append(services, service)
+	if err != nil {
+		return nil, 0, err
 	}
-	return services, nil
+	return rsp, meta.LastIndex, nil
 }
 
 func (c *consulRegistry) ListServices() ([]*registry.Service, error) {
-	rsp, _, err := c.Client().Catalog().Services(c.queryOptions)
+	return c.ListServicesContext(context.Background())
+}
+
+func (c *consulRegistry) ListServicesContext(ctx context.Context) ([]*registry.Service, error) {
+	rsp, _, err := c.Client().Catalog().Services(c.queryOptions.WithContext(ctx))
 	if err != nil {
 		return nil, err
 	}
@@ -400,7 +501,11 @@ func (c *consulRegistry) ListServices() ([]*registry.Service, error) {
 }
 
 func (c *consulRegistry) Watch(opts ...registry.WatchOption) (registry.Watcher, error) {
-	return newConsulWatcher(c, opts...)
+	return c.WatchContext(context.Background(), opts...)
+}
+
+func (c *consulRegistry) WatchContext(ctx context.Context, opts ...registry.WatchOption) (registry.Watcher, error) {
+	return newConsulWatcher(ctx, c, opts...)
 }
 
 func (c *consulRegistry) String() string {
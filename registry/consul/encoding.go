@@ -6,6 +6,11 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+
+	"google.golang.org/grpc/grpclog"
 
 	"github.com/hb-go/grpc-contrib/registry"
 )
@@ -23,24 +28,32 @@ func encode(buf []byte) string {
 	return hex.EncodeToString(b.Bytes())
 }
 
-func decode(d string) []byte {
+func decode(d string) ([]byte, error) {
 	hr, err := hex.DecodeString(d)
 	if err != nil {
-		return nil
+		return nil, err
 	}
 
 	br := bytes.NewReader(hr)
 	zr, err := zlib.NewReader(br)
 	if err != nil {
-		return nil
+		return nil, err
 	}
 
-	rbuf, err := ioutil.ReadAll(zr)
+	return ioutil.ReadAll(zr)
+}
+
+// decodeTag decodes the JSON value of a tag, a failure is logged
+func decodeTag(tag string, v interface{}) bool {
+	buf, err := decode(tag[2:])
+	if err == nil {
+		err = json.Unmarshal(buf, v)
+	}
 	if err != nil {
-		return nil
+		grpclog.Warningf("grpc-contrib.registry: consul decode tag %s error: %v", tag, err)
+		return false
 	}
-
-	return rbuf
+	return true
 }
 
 func encodeMethods(en []*registry.Method) []string {
@@ -70,14 +83,9 @@ func decodeMethods(tags []string) []*registry.Method {
 		}
 
 		var e *registry.Method
-		var buf []byte
 
 		// New encoding is hex
-		if tag[1] == '-' {
-			buf = decode(tag[2:])
-		}
-
-		if err := json.Unmarshal(buf, &e); err == nil {
+		if tag[1] == '-' && decodeTag(tag, &e) {
 			en = append(en, e)
 		}
 
@@ -116,15 +124,9 @@ func decodeMetadata(tags []string) map[string]string {
 		}
 
 		var kv map[string]string
-		var buf []byte
 
 		// New encoding is hex
-		if tag[1] == '-' {
-			buf = decode(tag[2:])
-		}
-
-		// Now unmarshal
-		if err := json.Unmarshal(buf, &kv); err == nil {
+		if tag[1] == '-' && decodeTag(tag, &kv) {
 			for k, v := range kv {
 				md[k] = v
 			}
@@ -148,8 +150,124 @@ func decodeVersion(tags []string) (string, bool) {
 
 		// New encoding is hex
 		if tag[1] == '-' {
-			return string(decode(tag[2:])), true
+			buf, err := decode(tag[2:])
+			if err != nil {
+				grpclog.Warningf("grpc-contrib.registry: consul decode tag %s error: %v", tag, err)
+				return "", false
+			}
+			return string(buf), true
 		}
 	}
 	return "", false
 }
+
+const (
+	// metaVersion and metaMethods are the keys of the service meta
+	// holding the version and the names of the methods
+	metaVersion = "version"
+	metaMethods = "methods"
+
+	// limits of the service meta of consul
+	metaMaxPairs    = 64
+	metaMaxKeyLen   = 128
+	metaMaxValueLen = 512
+)
+
+// metaKeyRegexp matches the keys allowed in the service meta,
+// the consul- prefix is reserved
+var metaKeyRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+func validMeta(k, v string) bool {
+	return len(k) <= metaMaxKeyLen && len(v) <= metaMaxValueLen &&
+		metaKeyRegexp.MatchString(k) && !strings.HasPrefix(k, "consul-") &&
+		k != metaVersion && k != metaMethods
+}
+
+// encodeMeta stores the version, the names of the methods and the node metadata
+// in the service meta, readable in the UI and usable in filter expressions.
+// What doesn't fit in the meta, e.g. the methods with bindings or metadata keys
+// not allowed by consul, is encoded in tags.
+// With legacy all is encoded in tags as well, for the readers of the tags only.
+func encodeMeta(s *registry.Service, node *registry.Node, legacy bool) (map[string]string, []string) {
+	meta := map[string]string{
+		metaVersion: s.Version,
+	}
+
+	var tags []string
+	if legacy {
+		tags = encodeMetadata(node.Metadata)
+		tags = append(tags, encodeMethods(s.Methods)...)
+		tags = append(tags, encodeVersion(s.Version)...)
+	}
+
+	var names []string
+	var tagMethods []*registry.Method
+	for _, m := range s.Methods {
+		if len(m.Bindings) > 0 || strings.Contains(m.Name, ",") {
+			tagMethods = append(tagMethods, m)
+			continue
+		}
+		names = append(names, m.Name)
+	}
+	if methods := strings.Join(names, ","); len(methods) <= metaMaxValueLen {
+		if len(methods) > 0 {
+			meta[metaMethods] = methods
+		}
+	} else {
+		tagMethods = s.Methods
+	}
+	if !legacy {
+		tags = append(tags, encodeMethods(tagMethods)...)
+	}
+
+	// sorted, so the same keys overflow to tags each time
+	keys := make([]string, 0, len(node.Metadata))
+	for k := range node.Metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	tagMetadata := make(map[string]string)
+	for _, k := range keys {
+		v := node.Metadata[k]
+		if len(meta) < metaMaxPairs && validMeta(k, v) {
+			meta[k] = v
+		} else {
+			tagMetadata[k] = v
+		}
+	}
+	if !legacy {
+		tags = append(tags, encodeMetadata(tagMetadata)...)
+	}
+
+	return meta, tags
+}
+
+// decodeMeta returns the version, the methods and the node metadata of a service,
+// from the service meta and the tags, including the legacy encoding in tags only.
+func decodeMeta(meta map[string]string, tags []string) (string, []*registry.Method, map[string]string) {
+	// the legacy tags hold all the methods if there is a version tag
+	tagVersion, legacy := decodeVersion(tags)
+
+	version, ok := meta[metaVersion]
+	if !ok {
+		version = tagVersion
+	}
+
+	methods := decodeMethods(tags)
+	if names, ok := meta[metaMethods]; ok && len(names) > 0 && !legacy {
+		for _, name := range strings.Split(names, ",") {
+			methods = append(methods, &registry.Method{Name: name})
+		}
+	}
+
+	md := decodeMetadata(tags)
+	for k, v := range meta {
+		if k == metaVersion || k == metaMethods {
+			continue
+		}
+		md[k] = v
+	}
+
+	return version, methods, md
+}
@@ -1,7 +1,10 @@
 package consul
 
 import (
+	"reflect"
 	"testing"
+
+	"github.com/hb-go/grpc-contrib/registry"
 )
 
 func TestEncodingVersion(t *testing.T) {
@@ -39,3 +42,71 @@ func TestEncodingVersion(t *testing.T) {
 		}
 	}
 }
+
+func TestEncodingMeta(t *testing.T) {
+	s := &registry.Service{
+		Name:    "foo",
+		Version: "1.0.0",
+		Methods: []*registry.Method{
+			{Name: "Get"},
+			{Name: "List"},
+			{Name: "Post", Bindings: []*registry.Binding{{Method: "POST"}}},
+		},
+	}
+	node := &registry.Node{
+		Id:      "node-1",
+		Address: "127.0.0.1:8080",
+		Metadata: map[string]string{
+			"zone":    "a",
+			"version": "reserved",
+			"a.b":     "not allowed",
+		},
+	}
+
+	meta, tags := encodeMeta(s, node, false)
+
+	expMeta := map[string]string{"version": "1.0.0", "methods": "Get,List", "zone": "a"}
+	if !reflect.DeepEqual(expMeta, meta) {
+		t.Fatalf("Expected meta %v, got %v", expMeta, meta)
+	}
+	// the method with bindings and the 2 metadata not allowed in the meta
+	if exp, act := 3, len(tags); exp != act {
+		t.Fatalf("Expected %d tags, got %d: %v", exp, act, tags)
+	}
+
+	for _, legacy := range []bool{false, true} {
+		meta, tags := encodeMeta(s, node, legacy)
+
+		version, methods, md := decodeMeta(meta, tags)
+		if version != s.Version {
+			t.Fatalf("Expected version %s, got %s", s.Version, version)
+		}
+		if !reflect.DeepEqual(node.Metadata, md) {
+			t.Fatalf("Expected metadata %v, got %v", node.Metadata, md)
+		}
+		names := map[string]bool{}
+		for _, m := range methods {
+			names[m.Name] = true
+		}
+		if len(methods) != 3 || !names["Get"] || !names["List"] || !names["Post"] {
+			t.Fatalf("Expected the methods Get, List and Post, got %v", names)
+		}
+
+		// readers of the legacy tags only
+		if legacy {
+			if v, ok := decodeVersion(tags); !ok || v != s.Version {
+				t.Fatalf("Expected version tag %s, got %s", s.Version, v)
+			}
+		}
+	}
+
+	// the legacy tags only
+	tags = encodeMetadata(node.Metadata)
+	tags = append(tags, encodeMethods(s.Methods)...)
+	tags = append(tags, encodeVersion(s.Version)...)
+
+	version, methods, md := decodeMeta(nil, tags)
+	if version != s.Version || len(methods) != 3 || !reflect.DeepEqual(node.Metadata, md) {
+		t.Fatalf("Unexpected legacy decoding %s %v %v", version, methods, md)
+	}
+}
@@ -18,6 +18,33 @@ func Connect() registry.Option {
 	}
 }
 
+// LegacyTags encodes the version, the methods and the metadata in the tags
+// as well as in the service meta, for the readers of the tags only
+// during a migration.
+func LegacyTags() registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, "consul_legacy_tags", true)
+	}
+}
+
+type filterKey struct{}
+
+// NewFilterContext returns a context which filters the nodes of GetServiceContext
+// with a consul filter expression [1], e.g. on the service meta:
+//
+//	Service.Meta.version == "1.0.0" and Service.Meta.zone == "a"
+//
+// It is combined with the filter of the QueryOptions.
+//
+// [1] https://www.consul.io/api-docs/features/filtering
+//
+func NewFilterContext(ctx context.Context, filter string) context.Context {
+	return context.WithValue(ctx, filterKey{}, filter)
+}
+
 func Config(c *consul.Config) registry.Option {
 	return func(o *registry.Options) {
 		if o.Context == nil {
@@ -79,3 +106,105 @@ func TCPCheck(t time.Duration) registry.Option {
 		o.Context = context.WithValue(o.Context, "consul_tcp_check", t)
 	}
 }
+
+// CheckOption configures a health check of GRPCCheck or HTTPCheck
+type CheckOption func(*healthCheck)
+
+// CheckTimeout is the timeout of a check, the consul default is 10s
+func CheckTimeout(t time.Duration) CheckOption {
+	return func(c *healthCheck) {
+		c.timeout = t
+	}
+}
+
+// CheckDeregisterAfter deregisters a node once its check is critical for `t`,
+// by default a minute and the check interval.
+func CheckDeregisterAfter(t time.Duration) CheckOption {
+	return func(c *healthCheck) {
+		c.deregisterAfter = t
+	}
+}
+
+// CheckTLS checks over TLS, the certificate of the node is not verified
+// if skipVerify is set.
+func CheckTLS(skipVerify bool) CheckOption {
+	return func(c *healthCheck) {
+		c.tls = true
+		c.tlsSkipVerify = skipVerify
+	}
+}
+
+// CheckService is the service checked by GRPCCheck, by default the
+// overall health of the server.
+func CheckService(name string) CheckOption {
+	return func(c *healthCheck) {
+		c.service = name
+	}
+}
+
+//
+// GRPCCheck registers the nodes with a check of their `grpc.health.v1.Health`
+// service every `t` interval, instead of the TCPCheck or the TTL check.
+// It will enabled only if `t` is greater than 0.
+// See `gRPC + Interval` for more information [1].
+//
+// [1] https://www.consul.io/docs/agent/checks.html
+//
+func GRPCCheck(t time.Duration, opts ...CheckOption) registry.RegisterOption {
+	return registerCheck(&healthCheck{grpc: true, interval: t}, opts...)
+}
+
+//
+// HTTPCheck registers the nodes with a check of a GET of the `path` of their
+// address every `t` interval, instead of the TCPCheck or the TTL check.
+// It will enabled only if `t` is greater than 0.
+// See `HTTP + Interval` for more information [1].
+//
+// [1] https://www.consul.io/docs/agent/checks.html
+//
+func HTTPCheck(path string, t time.Duration, opts ...CheckOption) registry.RegisterOption {
+	return registerCheck(&healthCheck{path: path, interval: t}, opts...)
+}
+
+func registerCheck(c *healthCheck, opts ...CheckOption) registry.RegisterOption {
+	for _, o := range opts {
+		o(c)
+	}
+	return func(o *registry.RegisterOptions) {
+		if c.interval <= time.Duration(0) {
+			return
+		}
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, "consul_health_check", c)
+	}
+}
+
+// Failover is the ordered list of datacenters the services are looked up in
+// if there are no healthy nodes in the datacenter of the target, or else of
+// the registry or of the agent. The datacenter of the target is its authority,
+// e.g. `registry://dc2/greeter`.
+func Failover(dcs ...string) registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, "consul_failover", dcs)
+	}
+}
+
+// PreparedQuery looks up the services by executing the prepared query named
+// after the service in each datacenter, e.g. a template with the failover
+// policy of the query [1].
+//
+// [1] https://www.consul.io/api-docs/query
+//
+func PreparedQuery() registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, "consul_prepared_query", true)
+	}
+}
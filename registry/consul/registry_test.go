@@ -2,10 +2,13 @@ package consul
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"net"
 	"net/http"
+	"reflect"
+	"sync"
 	"testing"
 	"time"
 
@@ -14,10 +17,25 @@ import (
 )
 
 type mockRegistry struct {
-	body   []byte
+	body []byte
+	// bodies by the datacenter of the request
+	bodies map[string][]byte
 	status int
 	err    error
 	url    string
+
+	// paths and filters of the requests
+	mu       sync.Mutex
+	requests []string
+	filter   string
+}
+
+func (rg *mockRegistry) reset() []string {
+	rg.mu.Lock()
+	defer rg.mu.Unlock()
+	requests := rg.requests
+	rg.requests = nil
+	return requests
 }
 
 func encodeData(obj interface{}) ([]byte, error) {
@@ -32,11 +50,20 @@ func encodeData(obj interface{}) ([]byte, error) {
 func newMockServer(rg *mockRegistry, l net.Listener) error {
 	mux := http.NewServeMux()
 	mux.HandleFunc(rg.url, func(w http.ResponseWriter, r *http.Request) {
+		rg.mu.Lock()
+		rg.requests = append(rg.requests, r.URL.Path)
+		rg.filter = r.URL.Query().Get("filter")
+		rg.mu.Unlock()
+
 		if rg.err != nil {
 			http.Error(w, rg.err.Error(), 500)
 			return
 		}
 		w.WriteHeader(rg.status)
+		if body, ok := rg.bodies[r.URL.Query().Get("dc")]; ok {
+			w.Write(body)
+			return
+		}
 		w.Write(rg.body)
 	})
 	return http.Serve(l, mux)
@@ -56,7 +83,7 @@ func newConsulTestRegistry(r *mockRegistry) (*consulRegistry, func()) {
 	var cr = &consulRegistry{
 		config:      cfg,
 		Address:     []string{cfg.Address},
-		opts:        registry.Options{},
+		opts:        registry.Options{Scheme: schema},
 		register:    make(map[string]uint64),
 		lastChecked: make(map[string]time.Time),
 		queryOptions: &consul.QueryOptions{
@@ -206,3 +233,239 @@ func TestConsul_GetService_WithUnhealthyServiceNodes(t *testing.T) {
 		t.Fatalf("Expected len of nodes to be `%d`, got `%d`.", exp, act)
 	}
 }
+
+func TestConsul_Register_WithNodes(t *testing.T) {
+	rg := &mockRegistry{
+		status: 200,
+		url:    "/v1/agent/",
+	}
+	cr, cl := newConsulTestRegistry(rg)
+	defer cl()
+
+	// drop the probe of the client
+	rg.reset()
+
+	service := &registry.Service{
+		Name:    "service-name",
+		Version: "v1.0.0",
+		Nodes: []*registry.Node{
+			{Id: "node-1", Address: "127.0.0.1:8080"},
+			{Id: "node-2", Address: "127.0.0.1:8081"},
+		},
+	}
+
+	if err := cr.Register(service, registry.RegisterTTL(time.Minute)); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+
+	exp := []string{
+		"/v1/agent/service/register",
+		"/v1/agent/check/pass/service:node-1",
+		"/v1/agent/service/register",
+		"/v1/agent/check/pass/service:node-2",
+	}
+	if act := rg.reset(); !reflect.DeepEqual(exp, act) {
+		t.Fatalf("Expected requests %v, got %v", exp, act)
+	}
+
+	// unchanged nodes only pass the TTL check
+	if err := cr.Register(service, registry.RegisterTTL(time.Minute)); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+
+	exp = []string{
+		"/v1/agent/check/pass/service:node-1",
+		"/v1/agent/check/pass/service:node-2",
+	}
+	if act := rg.reset(); !reflect.DeepEqual(exp, act) {
+		t.Fatalf("Expected requests %v, got %v", exp, act)
+	}
+
+	if exp, act := 2, len(cr.register); exp != act {
+		t.Fatalf("Expected %d registered nodes, got %d", exp, act)
+	}
+
+	if err := cr.Deregister(service); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+
+	exp = []string{
+		"/v1/agent/service/deregister/node-1",
+		"/v1/agent/service/deregister/node-2",
+	}
+	if act := rg.reset(); !reflect.DeepEqual(exp, act) {
+		t.Fatalf("Expected requests %v, got %v", exp, act)
+	}
+
+	if exp, act := 0, len(cr.register); exp != act {
+		t.Fatalf("Expected %d registered nodes, got %d", exp, act)
+	}
+}
+
+func TestConsul_Register_WithHealthCheck(t *testing.T) {
+	rg := &mockRegistry{
+		status: 200,
+		url:    "/v1/agent/",
+	}
+	cr, cl := newConsulTestRegistry(rg)
+	defer cl()
+
+	node := &registry.Node{Id: "node-1", Address: "127.0.0.1:8080"}
+
+	testData := []struct {
+		opt registry.RegisterOption
+		exp consul.AgentServiceCheck
+	}{
+		{
+			GRPCCheck(time.Second, CheckService("helloworld.Greeter"), CheckTLS(true), CheckTimeout(time.Second)),
+			consul.AgentServiceCheck{
+				GRPC:                           "127.0.0.1:8080/helloworld.Greeter",
+				GRPCUseTLS:                     true,
+				TLSSkipVerify:                  true,
+				Interval:                       "1s",
+				Timeout:                        "1s",
+				DeregisterCriticalServiceAfter: "1m5s",
+			},
+		},
+		{
+			HTTPCheck("/health", 10*time.Second, CheckDeregisterAfter(2*time.Minute)),
+			consul.AgentServiceCheck{
+				HTTP:                           "http://127.0.0.1:8080/health",
+				Method:                         "GET",
+				Interval:                       "10s",
+				DeregisterCriticalServiceAfter: "2m0s",
+			},
+		},
+	}
+
+	for _, d := range testData {
+		var options registry.RegisterOptions
+		registry.RegisterTTL(time.Minute)(&options)
+		d.opt(&options)
+
+		check, _ := cr.newCheck(node, options)
+		if !reflect.DeepEqual(&d.exp, check) {
+			t.Fatalf("Expected check %+v, got %+v", d.exp, check)
+		}
+	}
+
+	// the check of the agent is not passed by the registry
+	rg.reset()
+	service := &registry.Service{Name: "service-name", Nodes: []*registry.Node{node}}
+	if err := cr.Register(service, registry.RegisterTTL(time.Minute), GRPCCheck(time.Second)); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if err := cr.Register(service, registry.RegisterTTL(time.Minute), GRPCCheck(time.Second)); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+
+	exp := []string{"/v1/agent/service/register"}
+	if act := rg.reset(); !reflect.DeepEqual(exp, act) {
+		t.Fatalf("Expected requests %v, got %v", exp, act)
+	}
+}
+
+func TestConsul_GetService_WithMeta(t *testing.T) {
+	entry := newServiceEntry(
+		"node-name-1", "node-address-1", "service-name", "v1.0.0",
+		[]*consul.HealthCheck{
+			newHealthCheck("node-name-1", "service-name", "passing"),
+		},
+	)
+	entry.Service.Tags = nil
+	entry.Service.Meta = map[string]string{"version": "v2.0.0", "methods": "Get", "zone": "a"}
+
+	rg := &mockRegistry{
+		status: 200,
+		body:   newServiceList([]*consul.ServiceEntry{entry}),
+		url:    "/v1/health/service/service-name",
+	}
+	cr, cl := newConsulTestRegistry(rg)
+	defer cl()
+
+	cr.queryOptions.Filter = "Service.Meta.zone == \"a\""
+	ctx := NewFilterContext(context.Background(), "Service.Meta.version == \"v2.0.0\"")
+
+	svc, err := cr.GetServiceContext(ctx, "service-name")
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+
+	if exp, act := `(Service.Meta.zone == "a") and (Service.Meta.version == "v2.0.0")`, rg.filter; exp != act {
+		t.Fatalf("Expected filter %s, got %s", exp, act)
+	}
+
+	if exp, act := 1, len(svc); exp != act {
+		t.Fatalf("Expected len of svc to be `%d`, got `%d`.", exp, act)
+	}
+	if svc[0].Version != "v2.0.0" || len(svc[0].Methods) != 1 || svc[0].Nodes[0].Metadata["zone"] != "a" {
+		t.Fatalf("Unexpected service %+v", svc[0])
+	}
+}
+
+func TestConsul_GetService_WithFailover(t *testing.T) {
+	newEntries := func(address, status string) []byte {
+		return newServiceList([]*consul.ServiceEntry{
+			newServiceEntry(
+				"node-name", address, "service-name", "v1.0.0",
+				[]*consul.HealthCheck{
+					newHealthCheck("node-name", "service-name", status),
+				},
+			),
+		})
+	}
+
+	rg := &mockRegistry{
+		status: 200,
+		body:   newEntries("local", "critical"),
+		bodies: map[string][]byte{
+			"dc2": newEntries("dc2", "passing"),
+			"dc3": newEntries("dc3", "critical"),
+		},
+		url: "/v1/health/service/service-name",
+	}
+	cr, cl := newConsulTestRegistry(rg)
+	defer cl()
+
+	testData := []struct {
+		dc       string
+		failover []string
+		exp      string
+	}{
+		// the local datacenter has no healthy nodes
+		{"", nil, ""},
+		{"", []string{"dc3", "dc2"}, "dc2"},
+		// the datacenter of the target
+		{"dc2", nil, "dc2"},
+		{"dc3", []string{"dc2"}, "dc2"},
+	}
+
+	for _, d := range testData {
+		cr.failover = d.failover
+
+		ctx := context.Background()
+		if len(d.dc) > 0 {
+			ctx = registry.NewNamespaceContext(ctx, d.dc)
+		}
+
+		svc, err := cr.GetServiceContext(ctx, "service-name")
+		if err != nil {
+			t.Fatal("Unexpected error", err)
+		}
+		if exp, act := 1, len(svc); exp != act {
+			t.Fatalf("Expected len of svc to be `%d`, got `%d`.", exp, act)
+		}
+
+		var act string
+		if len(svc[0].Nodes) > 0 {
+			act = svc[0].Nodes[0].Address
+		}
+		if act != d.exp {
+			t.Fatalf("Expected the node of %q for %q with failover %v, got %q", d.exp, d.dc, d.failover, act)
+		}
+	}
+
+	if exp, act := "consul://dc2/service-name", cr.NewTarget(&registry.Service{Name: "service-name"}, registry.Namespace("dc2")); exp != act {
+		t.Fatalf("Expected target %s, got %s", exp, act)
+	}
+}
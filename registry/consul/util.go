@@ -4,6 +4,9 @@ import (
 	"fmt"
 	"net"
 	"strings"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hb-go/grpc-contrib/registry"
 )
 
 // hostPort format addr and port suitable for dial
@@ -21,3 +24,81 @@ func hostPort(addr string, port interface{}) string {
 
 	return fmt.Sprintf("%s:%v", host, port)
 }
+
+// toServiceMap returns the services of the entries keyed by version,
+// the nodes with a critical check are skipped
+func toServiceMap(name string, entries []*api.ServiceEntry) map[string]*registry.Service {
+	serviceMap := map[string]*registry.Service{}
+
+	for _, s := range entries {
+		if len(name) > 0 && s.Service.Service != name {
+			continue
+		}
+
+		// version is now a meta
+		version, methods, md := decodeMeta(s.Service.Meta, s.Service.Tags)
+		// service ID is now the node id
+		id := s.Service.ID
+		// key is always the version
+		key := version
+
+		// address is service address
+		address := s.Service.Address
+
+		// use node address
+		if len(address) == 0 {
+			address = s.Node.Address
+		}
+
+		svc, ok := serviceMap[key]
+		if !ok {
+			svc = &registry.Service{
+				Methods: methods,
+				Name:    s.Service.Service,
+				Version: version,
+			}
+			serviceMap[key] = svc
+		}
+
+		var del bool
+
+		for _, check := range s.Checks {
+			// delete the node if the status is critical
+			if check.Status == "critical" {
+				del = true
+				break
+			}
+		}
+
+		// if delete then skip the node
+		if del {
+			continue
+		}
+
+		svc.Nodes = append(svc.Nodes, &registry.Node{
+			Id:       id,
+			Address:  hostPort(address, s.Service.Port),
+			Metadata: md,
+		})
+	}
+
+	return serviceMap
+}
+
+func toServices(serviceMap map[string]*registry.Service) []*registry.Service {
+	var services []*registry.Service
+	for _, service := range serviceMap {
+		services = append(services, service)
+	}
+	return services
+}
+
+// healthy reports whether a service has a healthy node
+func healthy(serviceMap map[string]*registry.Service) bool {
+	for _, s := range serviceMap {
+		if len(s.Nodes) > 0 {
+			return true
+		}
+	}
+	return false
+}
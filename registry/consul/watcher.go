@@ -1,290 +1,444 @@
 package consul
 
 import (
-	"fmt"
-	"log"
-	"os"
+	"context"
 	"sync"
+	"time"
 
 	"github.com/hashicorp/consul/api"
-	"github.com/hashicorp/consul/api/watch"
 	"github.com/hb-go/grpc-contrib/registry"
+	"google.golang.org/grpc/grpclog"
 )
 
+var (
+	// waitTime is the longest wait of a blocking query
+	waitTime = 5 * time.Minute
+	// retryInterval is the delay before a failed query is retried
+	retryInterval = time.Second
+)
+
+// consulWatcher watches the services with blocking queries.
+// The changes are coalesced into a snapshot per service, Next returns the
+// difference of the snapshot to the one returned before. So a slow consumer
+// doesn't stall the queries, it misses the intermediate states only.
 type consulWatcher struct {
-	r        *consulRegistry
-	wo       registry.WatchOptions
-	wp       *watch.Plan
-	watchers map[string]*watch.Plan
+	r   *consulRegistry
+	wo  registry.WatchOptions
+	ctx context.Context
+	// datacenters in the failover order, a service is watched in each
+	dcs []string
 
-	next chan *registry.Result
-	exit chan bool
+	exit   chan bool
+	cancel context.CancelFunc
+	// notify signals a changed service to Next
+	notify chan struct{}
 
 	sync.RWMutex
+	// the current snapshot of the services
 	services map[string][]*registry.Service
+	// the snapshot of the services returned by Next
+	delivered map[string][]*registry.Service
+	// index of the last change of a service, of the datacenter
+	// the snapshot is taken from
+	index map[string]uint64
+	// services changed since returned by Next, in order
+	dirty    []string
+	dirtySet map[string]bool
+	// results of the last snapshot not returned yet
+	pending []*registry.Result
+	// cancel funcs of the queries of the watched services
+	watchers map[string]context.CancelFunc
+	// generations of the prepared query lookups started and applied
+	lookups map[string]uint64
+	applied map[string]uint64
+
+	// serializes the updates of a service by the queries of the datacenters,
+	// it is taken before the lock of the services, never after
+	mu sync.Mutex
+	// service -> datacenter index -> last entries
+	entries map[string]map[int]*dcEntries
+}
+
+// dcEntries are the entries of a service in a datacenter at its index,
+// the indexes of the datacenters are unrelated
+type dcEntries struct {
+	index   uint64
+	entries []*api.ServiceEntry
 }
 
-func newConsulWatcher(cr *consulRegistry, opts ...registry.WatchOption) (registry.Watcher, error) {
+func newConsulWatcher(ctx context.Context, cr *consulRegistry, opts ...registry.WatchOption) (registry.Watcher, error) {
 	var wo registry.WatchOptions
 	for _, o := range opts {
 		o(&wo)
 	}
 
-	cw := &consulWatcher{
-		r:        cr,
-		wo:       wo,
-		exit:     make(chan bool),
-		next:     make(chan *registry.Result, 10),
-		watchers: make(map[string]*watch.Plan),
-		services: make(map[string][]*registry.Service),
-	}
+	// the queries are canceled by Stop or when the context is done
+	dcs := cr.datacenters(ctx)
+	ctx, cancel := context.WithCancel(ctx)
 
-	wp, err := watch.Parse(map[string]interface{}{"type": "services"})
-	if err != nil {
-		return nil, err
+	cw := newWatcher(cr, wo, dcs)
+	cw.ctx = ctx
+	cw.cancel = cancel
+
+	// only the requested service is queried, else the catalog for the services
+	if len(wo.Service) > 0 {
+		cw.watch(wo.Service)
+	} else {
+		go cw.watchServices()
 	}
 
-	wp.Handler = cw.handle
-	go wp.RunWithClientAndLogger(cr.Client(), log.New(os.Stderr, "", log.LstdFlags))
-	cw.wp = wp
+	// stop the watcher when the context is done
+	go func() {
+		select {
+		case <-ctx.Done():
+			cw.Stop()
+		case <-cw.exit:
+		}
+	}()
 
 	return cw, nil
 }
 
-func (cw *consulWatcher) serviceHandler(idx uint64, data interface{}) {
-	entries, ok := data.([]*api.ServiceEntry)
-	if !ok {
-		return
+func newWatcher(cr *consulRegistry, wo registry.WatchOptions, dcs []string) *consulWatcher {
+	return &consulWatcher{
+		r:         cr,
+		wo:        wo,
+		dcs:       dcs,
+		exit:      make(chan bool),
+		notify:    make(chan struct{}, 1),
+		services:  make(map[string][]*registry.Service),
+		delivered: make(map[string][]*registry.Service),
+		index:     make(map[string]uint64),
+		dirtySet:  make(map[string]bool),
+		watchers:  make(map[string]context.CancelFunc),
+		lookups:   make(map[string]uint64),
+		applied:   make(map[string]uint64),
+		entries:   make(map[string]map[int]*dcEntries),
 	}
+}
+
+// waitRetry waits for the retry interval, false if the context is done
+func waitRetry(ctx context.Context) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(retryInterval):
+		return true
+	}
+}
 
-	serviceMap := map[string]*registry.Service{}
-	serviceName := ""
-
-	for _, e := range entries {
-		serviceName = e.Service.Service
-		// version is now a tag
-		version, _ := decodeVersion(e.Service.Tags)
-		// service ID is now the node id
-		id := e.Service.ID
-		// key is always the version
-		key := version
-		// address is service address
-		address := e.Service.Address
-
-		// use node address
-		if len(address) == 0 {
-			address = e.Node.Address
+// watchServices watches the catalog for the services
+func (cw *consulWatcher) watchServices() {
+	var index uint64
+	for {
+		q := cw.r.queryOptions.WithContext(cw.ctx)
+		if len(cw.dcs[0]) > 0 {
+			q.Datacenter = cw.dcs[0]
 		}
+		q.WaitIndex = index
+		q.WaitTime = waitTime
 
-		svc, ok := serviceMap[key]
-		if !ok {
-			svc = &registry.Service{
-				Methods: decodeMethods(e.Service.Tags),
-				Name:    e.Service.Service,
-				Version: version,
+		services, meta, err := cw.r.Client().Catalog().Services(q)
+		if cw.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			grpclog.Warningf("grpc-contrib.registry: consul watch services error: %v", err)
+			if !waitRetry(cw.ctx) {
+				return
 			}
-			serviceMap[key] = svc
+			continue
+		}
+
+		// the wait timed out
+		if index > 0 && meta.LastIndex == index {
+			continue
+		}
+		// the index went backwards, e.g. the servers were restored
+		index = meta.LastIndex
+		if index < q.WaitIndex {
+			index = 0
 		}
 
-		var del bool
+		cw.handle(meta.LastIndex, services)
+	}
+}
 
-		for _, check := range e.Checks {
-			// delete the node if the status is critical
-			if check.Status == "critical" {
-				del = true
-				break
-			}
+// handle starts and stops the watches of the services of the catalog
+func (cw *consulWatcher) handle(idx uint64, services map[string][]string) {
+	for service := range services {
+		cw.RLock()
+		_, ok := cw.watchers[service]
+		cw.RUnlock()
+		if ok {
+			continue
 		}
 
-		// if delete then skip the node
-		if del {
+		cw.watch(service)
+
+		cw.Lock()
+		if _, ok := cw.services[service]; !ok {
+			cw.services[service] = nil
+			cw.index[service] = idx
+			cw.markDirty(service)
+		}
+		cw.Unlock()
+	}
+
+	var removed []string
+	cw.Lock()
+	for service, cancel := range cw.watchers {
+		if _, ok := services[service]; ok {
 			continue
 		}
 
-		svc.Nodes = append(svc.Nodes, &registry.Node{
-			Id:       id,
-			Address:  fmt.Sprintf("%s:%d", address, e.Service.Port),
-			Metadata: decodeMetadata(e.Service.Tags),
-		})
+		cancel()
+		delete(cw.watchers, service)
+		delete(cw.services, service)
+		delete(cw.lookups, service)
+		delete(cw.applied, service)
+		cw.index[service] = idx
+		cw.markDirty(service)
+		removed = append(removed, service)
 	}
+	cw.Unlock()
 
-	cw.RLock()
-	// make a copy
-	rservices := make(map[string][]*registry.Service)
-	for k, v := range cw.services {
-		rservices[k] = v
+	// the entries are cleared after, the lock of the entries is taken first
+	cw.mu.Lock()
+	for _, service := range removed {
+		delete(cw.entries, service)
 	}
-	cw.RUnlock()
+	cw.mu.Unlock()
+}
+
+// watch starts the queries of the service in each datacenter of the failover order
+func (cw *consulWatcher) watch(service string) {
+	ctx, cancel := context.WithCancel(cw.ctx)
 
-	var newServices []*registry.Service
+	cw.Lock()
+	cw.watchers[service] = cancel
+	cw.Unlock()
 
-	// serviceMap is the new set of services keyed by name+version
-	for _, newService := range serviceMap {
-		// append to the new set of cached services
-		newServices = append(newServices, newService)
+	for i, dc := range cw.dcs {
+		go cw.watchService(ctx, service, i, dc)
+	}
+}
 
-		// check if the service exists in the existing cache
-		oldServices, ok := rservices[serviceName]
-		if !ok {
-			// does not exist? then we're creating brand new entries
-			cw.next <- &registry.Result{Action: "create", Service: newService}
+// watchService watches the service in a datacenter with blocking health queries
+func (cw *consulWatcher) watchService(ctx context.Context, service string, i int, dc string) {
+	var index uint64
+	for {
+		entries, last, err := cw.r.healthEntries(ctx, service, dc, index)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			grpclog.Warningf("grpc-contrib.registry: consul watch %s in %q error: %v", service, dc, err)
+			if !waitRetry(ctx) {
+				return
+			}
 			continue
 		}
 
-		// service exists. ok let's figure out what to update and delete version wise
-		action := "create"
+		// the wait timed out
+		if index > 0 && last == index {
+			continue
+		}
+		// the index went backwards, e.g. the servers were restored
+		if last < index {
+			last = 0
+		}
+		index = last
 
-		for _, oldService := range oldServices {
-			// does this version exist?
-			// no? then default to create
-			if oldService.Version != newService.Version {
-				continue
-			}
+		cw.update(last, service, i, entries)
+	}
+}
 
-			// yes? then it's an update
-			action = "update"
-
-			var nodes []*registry.Node
-			// check the old nodes to see if they've been deleted
-			for _, oldNode := range oldService.Nodes {
-				var seen bool
-				for _, newNode := range newService.Nodes {
-					if newNode.Id == oldNode.Id {
-						seen = true
-						break
-					}
-				}
-				// does the old node exist in the new set of nodes
-				// no? then delete that shit
-				if !seen {
-					nodes = append(nodes, oldNode)
-				}
-			}
+// update updates the service with the entries of the first datacenter
+// which has healthy nodes, like GetService does.
+func (cw *consulWatcher) update(idx uint64, service string, dc int, entries []*api.ServiceEntry) {
+	if cw.r != nil && cw.r.preparedQuery {
+		cw.lookup(idx, service)
+		return
+	}
 
-			// it's an update rather than creation
-			if len(nodes) > 0 {
-				delService := registry.CopyService(oldService)
-				delService.Nodes = nodes
-				cw.next <- &registry.Result{Action: "delete", Service: delService}
-			}
-		}
+	// the lock of the entries is taken before the lock of the services,
+	// the updates of the datacenters are applied in order
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
 
-		cw.next <- &registry.Result{Action: action, Service: newService}
+	if cw.entries[service] == nil {
+		cw.entries[service] = make(map[int]*dcEntries)
 	}
+	cw.entries[service][dc] = &dcEntries{index: idx, entries: entries}
 
-	// Now check old versions that may not be in new services map
-	for _, old := range rservices[serviceName] {
-		// old version does not exist in new version map
-		// kill it with fire!
-		if _, ok := serviceMap[old.Version]; !ok {
-			cw.next <- &registry.Result{Action: "delete", Service: old}
+	// the snapshot is at the index of the datacenter it is taken from
+	var serviceMap map[string]*registry.Service
+	for i := range cw.dcs {
+		e, ok := cw.entries[service][i]
+		if !ok {
+			continue
+		}
+		m := toServiceMap(service, e.entries)
+		if serviceMap == nil || healthy(m) {
+			serviceMap = m
+			idx = e.index
+		}
+		if healthy(m) {
+			break
 		}
 	}
 
+	if !cw.set(idx, service, serviceMap, 0) {
+		delete(cw.entries, service)
+	}
+}
+
+// lookup updates the service by the prepared query, its failover is unknown
+// so it is executed again. The query is made without a lock, a result
+// older than the one applied is dropped.
+func (cw *consulWatcher) lookup(idx uint64, service string) {
 	cw.Lock()
-	cw.services[serviceName] = newServices
+	cw.lookups[service]++
+	gen := cw.lookups[service]
 	cw.Unlock()
-}
 
-func (cw *consulWatcher) handle(idx uint64, data interface{}) {
-	services, ok := data.(map[string][]string)
-	if !ok {
+	services, err := cw.r.lookup(cw.ctx, service, cw.dcs)
+	if err != nil {
+		grpclog.Warningf("grpc-contrib.registry: consul prepared query %s error: %v", service, err)
 		return
 	}
 
-	// add new watchers
-	for service, _ := range services {
-		// Filter on watch options
-		// wo.Service: Only watch services we care about
-		if len(cw.wo.Service) > 0 && service != cw.wo.Service {
-			continue
-		}
+	serviceMap := make(map[string]*registry.Service, len(services))
+	for _, s := range services {
+		serviceMap[s.Version] = s
+	}
+	cw.set(idx, service, serviceMap, gen)
+}
 
-		if _, ok := cw.watchers[service]; ok {
-			continue
+// set sets the current snapshot of the service, false if the service was
+// removed from the catalog meanwhile. A lookup result is set if it is newer
+// than the one set before.
+func (cw *consulWatcher) set(idx uint64, service string, serviceMap map[string]*registry.Service, gen uint64) bool {
+	cw.Lock()
+	defer cw.Unlock()
+
+	if len(cw.wo.Service) == 0 {
+		if _, ok := cw.watchers[service]; !ok {
+			return false
 		}
-		wp, err := watch.Parse(map[string]interface{}{
-			"type":    "service",
-			"service": service,
-		})
-		if err == nil {
-			wp.Handler = cw.serviceHandler
-			go wp.RunWithClientAndLogger(cw.r.Client(), log.New(os.Stderr, "", log.LstdFlags))
-			cw.watchers[service] = wp
-			cw.next <- &registry.Result{Action: "create", Service: &registry.Service{Name: service}}
+	}
+
+	if gen > 0 {
+		if gen <= cw.applied[service] {
+			return true
 		}
+		cw.applied[service] = gen
 	}
 
-	cw.RLock()
-	// make a copy
-	rservices := make(map[string][]*registry.Service)
-	for k, v := range cw.services {
-		rservices[k] = v
+	cw.services[service] = toServices(serviceMap)
+	cw.index[service] = idx
+	cw.markDirty(service)
+	return true
+}
+
+// markDirty queues the service for Next, the caller must hold the lock
+func (cw *consulWatcher) markDirty(service string) {
+	if !cw.dirtySet[service] {
+		cw.dirtySet[service] = true
+		cw.dirty = append(cw.dirty, service)
 	}
-	cw.RUnlock()
-
-	// remove unknown services from registry
-	// save the things we want to delete
-	deleted := make(map[string][]*registry.Service)
-
-	for service, _ := range rservices {
-		if _, ok := services[service]; !ok {
-			cw.Lock()
-			// save this before deleting
-			deleted[service] = cw.services[service]
-			delete(cw.services, service)
-			cw.Unlock()
-		}
+
+	select {
+	case cw.notify <- struct{}{}:
+	default:
 	}
+}
 
-	// remove unknown services from watchers
-	for service, w := range cw.watchers {
-		if _, ok := services[service]; !ok {
-			w.Stop()
-			delete(cw.watchers, service)
-			for _, oldService := range deleted[service] {
-				// send a delete for the service nodes that we're removing
-				cw.next <- &registry.Result{Action: "delete", Service: oldService}
-			}
+// snapshot returns the results which turn the snapshot of the service
+// returned before into the current one, the caller must hold the lock
+func (cw *consulWatcher) snapshot(service string) []*registry.Result {
+	cur, ok := cw.services[service]
+	prev, seen := cw.delivered[service]
+	idx := cw.index[service]
+
+	var results []*registry.Result
+
+	// the services of the catalog are created and deleted by name as well
+	listed := len(cw.wo.Service) == 0
+	if listed && ok && !seen {
+		results = append(results, newResult(idx, registry.Create, &registry.Service{Name: service}))
+	}
+
+	for _, r := range registry.Diff(prev, cur) {
+		r.Revision = idx
+		results = append(results, r)
+	}
+
+	if ok {
+		cw.delivered[service] = cur
+	} else {
+		delete(cw.delivered, service)
+		if listed && seen {
 			// sent the empty list as the last resort to indicate to delete the entire service
-			cw.next <- &registry.Result{Action: "delete", Service: &registry.Service{Name: service}}
+			results = append(results, newResult(idx, registry.Delete, &registry.Service{Name: service}))
 		}
 	}
+
+	return results
+}
+
+// newResult returns a result at the consul index
+func newResult(idx uint64, t registry.EventType, s *registry.Service) *registry.Result {
+	r := registry.NewResult(t, s)
+	r.Revision = idx
+	return r
 }
 
 func (cw *consulWatcher) Next() (*registry.Result, error) {
-	select {
-	case <-cw.exit:
-		return nil, registry.ErrWatcherStopped
-	case r, ok := <-cw.next:
-		if !ok {
+	for {
+		select {
+		case <-cw.exit:
 			return nil, registry.ErrWatcherStopped
+		default:
+		}
+
+		cw.Lock()
+		if len(cw.pending) > 0 {
+			r := cw.pending[0]
+			cw.pending = cw.pending[1:]
+			cw.Unlock()
+			return r, nil
+		}
+		if len(cw.dirty) > 0 {
+			service := cw.dirty[0]
+			cw.dirty = cw.dirty[1:]
+			delete(cw.dirtySet, service)
+			cw.pending = cw.snapshot(service)
+			cw.Unlock()
+			continue
+		}
+		cw.Unlock()
+
+		select {
+		case <-cw.exit:
+			return nil, registry.ErrWatcherStopped
+		case <-cw.notify:
 		}
-		return r, nil
 	}
-	// NOTE: This is a dead code path: e.g. it will never be reached
-	// as we return in all previous code paths never leading to this return
-	return nil, registry.ErrWatcherStopped
 }
 
 func (cw *consulWatcher) Stop() {
+	cw.Lock()
+	defer cw.Unlock()
+
 	select {
 	case <-cw.exit:
 		return
 	default:
 		close(cw.exit)
-		if cw.wp == nil {
-			return
-		}
-		cw.wp.Stop()
-
-		// drain results
-		for {
-			select {
-			case <-cw.next:
-			default:
-				return
-			}
+		if cw.cancel != nil {
+			cw.cancel()
 		}
 	}
 }
@@ -1,14 +1,16 @@
 package consul
 
 import (
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/consul/api"
 	"github.com/hb-go/grpc-contrib/registry"
 )
 
 func TestHealthyServiceHandler(t *testing.T) {
-	watcher := newWatcher()
+	watcher := newWatcher(nil, registry.WatchOptions{Service: "service-name"}, []string{""})
 	serviceEntry := newServiceEntry(
 		"node-name", "node-address", "service-name", "v1.0.0",
 		[]*api.HealthCheck{
@@ -16,7 +18,7 @@ func TestHealthyServiceHandler(t *testing.T) {
 		},
 	)
 
-	watcher.serviceHandler(1234, []*api.ServiceEntry{serviceEntry})
+	watcher.update(1234, "service-name", 0, []*api.ServiceEntry{serviceEntry})
 
 	if len(watcher.services["service-name"][0].Nodes) != 1 {
 		t.Errorf("Expected length of the service nodes to be 1")
@@ -24,7 +26,7 @@ func TestHealthyServiceHandler(t *testing.T) {
 }
 
 func TestUnhealthyServiceHandler(t *testing.T) {
-	watcher := newWatcher()
+	watcher := newWatcher(nil, registry.WatchOptions{Service: "service-name"}, []string{""})
 	serviceEntry := newServiceEntry(
 		"node-name", "node-address", "service-name", "v1.0.0",
 		[]*api.HealthCheck{
@@ -32,7 +34,7 @@ func TestUnhealthyServiceHandler(t *testing.T) {
 		},
 	)
 
-	watcher.serviceHandler(1234, []*api.ServiceEntry{serviceEntry})
+	watcher.update(1234, "service-name", 0, []*api.ServiceEntry{serviceEntry})
 
 	if len(watcher.services["service-name"][0].Nodes) != 0 {
 		t.Errorf("Expected length of the service nodes to be 0")
@@ -40,7 +42,7 @@ func TestUnhealthyServiceHandler(t *testing.T) {
 }
 
 func TestUnhealthyNodeServiceHandler(t *testing.T) {
-	watcher := newWatcher()
+	watcher := newWatcher(nil, registry.WatchOptions{Service: "service-name"}, []string{""})
 	serviceEntry := newServiceEntry(
 		"node-name", "node-address", "service-name", "v1.0.0",
 		[]*api.HealthCheck{
@@ -49,21 +51,13 @@ func TestUnhealthyNodeServiceHandler(t *testing.T) {
 		},
 	)
 
-	watcher.serviceHandler(1234, []*api.ServiceEntry{serviceEntry})
+	watcher.update(1234, "service-name", 0, []*api.ServiceEntry{serviceEntry})
 
 	if len(watcher.services["service-name"][0].Nodes) != 0 {
 		t.Errorf("Expected length of the service nodes to be 0")
 	}
 }
 
-func newWatcher() *consulWatcher {
-	return &consulWatcher{
-		exit:     make(chan bool),
-		next:     make(chan *registry.Result, 10),
-		services: make(map[string][]*registry.Service),
-	}
-}
-
 func newHealthCheck(node, name, status string) *api.HealthCheck {
 	return &api.HealthCheck{
 		Node:        node,
@@ -84,3 +78,155 @@ func newServiceEntry(node, address, name, version string, checks []*api.HealthCh
 		Checks: checks,
 	}
 }
+
+func TestFailoverServiceHandler(t *testing.T) {
+	watcher := newWatcher(nil, registry.WatchOptions{Service: "service-name"}, []string{""})
+	watcher.dcs = []string{"", "dc2"}
+
+	local := newServiceEntry(
+		"node-name", "node-address", "service-name", "v1.0.0",
+		[]*api.HealthCheck{
+			newHealthCheck("node-name", "service-name", "critical"),
+		},
+	)
+	dc2 := newServiceEntry(
+		"node-name-2", "node-address-2", "service-name", "v1.0.0",
+		[]*api.HealthCheck{
+			newHealthCheck("node-name-2", "service-name", "passing"),
+		},
+	)
+
+	watcher.update(1, "service-name", 0, []*api.ServiceEntry{local})
+	if len(watcher.services["service-name"][0].Nodes) != 0 {
+		t.Errorf("Expected length of the service nodes to be 0")
+	}
+
+	// the nodes of the next datacenter while the local ones are unhealthy
+	watcher.update(2, "service-name", 1, []*api.ServiceEntry{dc2})
+	if nodes := watcher.services["service-name"][0].Nodes; len(nodes) != 1 || nodes[0].Address != "node-address-2" {
+		t.Errorf("Expected the node of dc2, got %+v", nodes[0])
+	}
+
+	// back to the local datacenter once it is healthy
+	local.Checks[0].Status = "passing"
+	watcher.update(3, "service-name", 0, []*api.ServiceEntry{local})
+	if nodes := watcher.services["service-name"][0].Nodes; len(nodes) != 1 || nodes[0].Address != "node-address" {
+		t.Errorf("Expected the local node, got %+v", nodes[0])
+	}
+}
+
+func TestCoalesceServiceHandler(t *testing.T) {
+	watcher := newWatcher(nil, registry.WatchOptions{Service: "service-name"}, []string{""})
+
+	// the updates don't block without a consumer
+	for i := 0; i < 100; i++ {
+		status := "critical"
+		if i%2 == 1 {
+			status = "passing"
+		}
+		serviceEntry := newServiceEntry(
+			"node-name", "node-address", "service-name", "v1.0.0",
+			[]*api.HealthCheck{
+				newHealthCheck("node-name", "service-name", status),
+			},
+		)
+		watcher.update(uint64(i+1), "service-name", 0, []*api.ServiceEntry{serviceEntry})
+	}
+
+	// and are returned as the difference to the last snapshot
+	r, err := watcher.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp, act := registry.Create, r.Type; exp != act {
+		t.Fatalf("Expected %v, got %v", exp, act)
+	}
+	if exp, act := uint64(100), r.Revision; exp != act {
+		t.Fatalf("Expected revision %d, got %d", exp, act)
+	}
+	if len(r.Service.Nodes) != 1 {
+		t.Fatalf("Expected the passing node, got %+v", r.Service.Nodes)
+	}
+
+	watcher.Stop()
+	if _, err := watcher.Next(); err != registry.ErrWatcherStopped {
+		t.Fatalf("Expected %v, got %v", registry.ErrWatcherStopped, err)
+	}
+}
+
+func TestRemoveServiceWhileUpdate(t *testing.T) {
+	watcher := newWatcher(nil, registry.WatchOptions{}, []string{""})
+	serviceEntry := newServiceEntry(
+		"node-name", "node-address", "service-name", "v1.0.0",
+		[]*api.HealthCheck{
+			newHealthCheck("node-name", "service-name", "passing"),
+		},
+	)
+
+	// a service removed from the catalog while its query returns
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var wg sync.WaitGroup
+		for i := 0; i < 1000; i++ {
+			watcher.Lock()
+			watcher.watchers["service-name"] = func() {}
+			watcher.Unlock()
+
+			wg.Add(2)
+			go func(i int) {
+				defer wg.Done()
+				watcher.update(uint64(i+1), "service-name", 0, []*api.ServiceEntry{serviceEntry})
+			}(i)
+			go func(i int) {
+				defer wg.Done()
+				watcher.handle(uint64(i+1), map[string][]string{})
+			}(i)
+			wg.Wait()
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Expected no deadlock of update and handle")
+	}
+
+	watcher.Stop()
+}
+
+func TestFailoverServiceIndex(t *testing.T) {
+	watcher := newWatcher(nil, registry.WatchOptions{Service: "service-name"}, []string{"", "dc2"})
+
+	local := newServiceEntry(
+		"node-name", "node-address", "service-name", "v1.0.0",
+		[]*api.HealthCheck{
+			newHealthCheck("node-name", "service-name", "critical"),
+		},
+	)
+	dc2 := newServiceEntry(
+		"node-name-2", "node-address-2", "service-name", "v1.0.0",
+		[]*api.HealthCheck{
+			newHealthCheck("node-name-2", "service-name", "passing"),
+		},
+	)
+
+	// the indexes of the datacenters are unrelated, the snapshot is at
+	// the index of the datacenter it is taken from
+	watcher.update(100, "service-name", 0, []*api.ServiceEntry{local})
+	watcher.update(5, "service-name", 1, []*api.ServiceEntry{dc2})
+	if exp, act := uint64(5), watcher.index["service-name"]; exp != act {
+		t.Fatalf("Expected index %d, got %d", exp, act)
+	}
+
+	watcher.update(101, "service-name", 0, []*api.ServiceEntry{local})
+	if exp, act := uint64(5), watcher.index["service-name"]; exp != act {
+		t.Fatalf("Expected index %d, got %d", exp, act)
+	}
+
+	local.Checks[0].Status = "passing"
+	watcher.update(102, "service-name", 0, []*api.ServiceEntry{local})
+	if exp, act := uint64(102), watcher.index["service-name"]; exp != act {
+		t.Fatalf("Expected index %d, got %d", exp, act)
+	}
+}
@@ -0,0 +1,164 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrNamespaceUnsupported is returned by a registry adapted by WithContext
+// for a context with a namespace, the adapted calls can't be scoped to it
+var ErrNamespaceUnsupported = errors.New("registry doesn't support namespaces")
+
+// ContextRegistry is a registry whose calls take a context,
+// the deadline and cancellation of the context reach the backend calls.
+// The watcher returned by WatchContext is stopped when the context is done.
+type ContextRegistry interface {
+	Registry
+	RegisterContext(context.Context, *Service, ...RegisterOption) error
+	DeregisterContext(context.Context, *Service) error
+	GetServiceContext(context.Context, string) ([]*Service, error)
+	ListServicesContext(context.Context) ([]*Service, error)
+	WatchContext(context.Context, ...WatchOption) (Watcher, error)
+}
+
+// WithContext returns the registry as a ContextRegistry. A registry which
+// doesn't implement it is adapted, the context is checked before each call
+// and stops the watcher, but the calls themselves can't be cancelled.
+// The adapted calls fail with ErrNamespaceUnsupported for a namespace.
+func WithContext(r Registry) ContextRegistry {
+	if cr, ok := r.(ContextRegistry); ok {
+		return cr
+	}
+	return &contextRegistry{r}
+}
+
+type contextRegistry struct {
+	Registry
+}
+
+// check returns the error of the context, or of its namespace
+func (r *contextRegistry) check(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if ns, _ := NamespaceFromContext(ctx); len(ns) > 0 {
+		return ErrNamespaceUnsupported
+	}
+	return nil
+}
+
+func (r *contextRegistry) RegisterContext(ctx context.Context, s *Service, opts ...RegisterOption) error {
+	if err := r.check(ctx); err != nil {
+		return err
+	}
+	return r.Register(s, opts...)
+}
+
+func (r *contextRegistry) DeregisterContext(ctx context.Context, s *Service) error {
+	if err := r.check(ctx); err != nil {
+		return err
+	}
+	return r.Deregister(s)
+}
+
+func (r *contextRegistry) GetServiceContext(ctx context.Context, name string) ([]*Service, error) {
+	if err := r.check(ctx); err != nil {
+		return nil, err
+	}
+	return r.GetService(name)
+}
+
+func (r *contextRegistry) ListServicesContext(ctx context.Context) ([]*Service, error) {
+	if err := r.check(ctx); err != nil {
+		return nil, err
+	}
+	return r.ListServices()
+}
+
+func (r *contextRegistry) WatchContext(ctx context.Context, opts ...WatchOption) (Watcher, error) {
+	if err := r.check(ctx); err != nil {
+		return nil, err
+	}
+
+	w, err := r.Watch(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return newContextWatcher(ctx, w), nil
+}
+
+// contextWatcher stops the watcher when the context is done
+type contextWatcher struct {
+	Watcher
+	stop chan bool
+	once sync.Once
+}
+
+func newContextWatcher(ctx context.Context, w Watcher) Watcher {
+	if ctx.Done() == nil {
+		return w
+	}
+
+	cw := &contextWatcher{
+		Watcher: w,
+		stop:    make(chan bool),
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			w.Stop()
+		case <-cw.stop:
+		}
+	}()
+
+	return cw
+}
+
+func (cw *contextWatcher) Stop() {
+	cw.once.Do(func() {
+		close(cw.stop)
+	})
+	cw.Watcher.Stop()
+}
+
+type namespaceKey struct{}
+
+// NewNamespaceContext returns a context which scopes the calls
+// of a ContextRegistry to the namespace
+func NewNamespaceContext(ctx context.Context, ns string) context.Context {
+	return context.WithValue(ctx, namespaceKey{}, ns)
+}
+
+// NamespaceFromContext returns the namespace of the context
+func NamespaceFromContext(ctx context.Context) (string, bool) {
+	ns, ok := ctx.Value(namespaceKey{}).(string)
+	return ns, ok
+}
+
+// RegisterContext registers a service node with the context
+func RegisterContext(ctx context.Context, s *Service, opts ...RegisterOption) error {
+	return WithContext(DefaultRegistry).RegisterContext(ctx, s, opts...)
+}
+
+// DeregisterContext deregisters a service node with the context
+func DeregisterContext(ctx context.Context, s *Service) error {
+	return WithContext(DefaultRegistry).DeregisterContext(ctx, s)
+}
+
+// GetServiceContext retrieves a service with the context
+func GetServiceContext(ctx context.Context, name string) ([]*Service, error) {
+	return WithContext(DefaultRegistry).GetServiceContext(ctx, name)
+}
+
+// ListServicesContext lists the services with the context
+func ListServicesContext(ctx context.Context) ([]*Service, error) {
+	return WithContext(DefaultRegistry).ListServicesContext(ctx)
+}
+
+// WatchContext returns a watcher which is stopped when the context is done
+func WatchContext(ctx context.Context, opts ...WatchOption) (Watcher, error) {
+	return WithContext(DefaultRegistry).WatchContext(ctx, opts...)
+}
@@ -0,0 +1,89 @@
+package registry
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+var testService = &Service{
+	Name:    "bar",
+	Version: "default",
+	Nodes: []*Node{
+		{
+			Id:      "bar-1.0.0-123",
+			Address: "localhost:8888",
+		},
+	},
+}
+
+func TestContextRegistry(t *testing.T) {
+	r := WithContext(NewRegistry())
+	s := testService
+
+	if err := r.RegisterContext(context.Background(), s); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := r.RegisterContext(ctx, s); err != context.Canceled {
+		t.Fatalf("Expected %v, got %v", context.Canceled, err)
+	}
+	if _, err := r.GetServiceContext(ctx, s.Name); err != context.Canceled {
+		t.Fatalf("Expected %v, got %v", context.Canceled, err)
+	}
+
+	services, err := r.GetServiceContext(context.Background(), s.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp, act := 1, len(services); exp != act {
+		t.Fatalf("Expected %d versions, got %d", exp, act)
+	}
+
+	// the adapted calls can't be scoped to a namespace
+	nsCtx := NewNamespaceContext(context.Background(), "prod")
+	if _, err := r.GetServiceContext(nsCtx, s.Name); err != ErrNamespaceUnsupported {
+		t.Fatalf("Expected %v, got %v", ErrNamespaceUnsupported, err)
+	}
+	if _, err := r.WatchContext(nsCtx); err != ErrNamespaceUnsupported {
+		t.Fatalf("Expected %v, got %v", ErrNamespaceUnsupported, err)
+	}
+
+	// the mock registry implements the context registry
+	var m Registry = &MockRegistry{}
+	if _, ok := WithContext(m).(*MockRegistry); !ok {
+		t.Fatal("Expected the mock registry to be returned as is")
+	}
+}
+
+func TestContextWatcher(t *testing.T) {
+	r := WithContext(NewRegistry())
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	w, err := r.WatchContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := w.Next()
+		errs <- err
+	}()
+
+	cancel()
+
+	select {
+	case err := <-errs:
+		if err != ErrWatcherStopped {
+			t.Fatalf("Expected %v, got %v", ErrWatcherStopped, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the watcher to be stopped by the context")
+	}
+}
@@ -1,6 +1,14 @@
 package registry
 
-// TODO 开箱即用，memory
-func NewRegistry() Registry {
+// NewDefault creates the default registry, an application sets it, e.g. to
+// memory.NewRegistry for the in-process registry which works without any
+// discovery server. It is a mock registry until then, the registry package
+// can't import its implementations.
+var NewDefault = func(opts ...Option) Registry {
 	return &MockRegistry{}
 }
+
+// NewRegistry returns a new default registry
+func NewRegistry(opts ...Option) Registry {
+	return NewDefault(opts...)
+}
@@ -0,0 +1,249 @@
+// Package dns provides a service registry backed by DNS SRV and TXT records
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hb-go/grpc-contrib/registry"
+)
+
+const schema = "dns"
+const queryValSeq = "|"
+
+const (
+	srvService = "grpc"
+	srvProto   = "tcp"
+
+	// txtVersion is the TXT key of the service version,
+	// the other `key=value` records are node metadata.
+	// Every pair must be a separate TXT record, the strings
+	// of one record are joined by the resolver.
+	txtVersion = "version"
+)
+
+var (
+	// DefaultRefreshInterval is the interval the watchers resolve the records again
+	DefaultRefreshInterval = 30 * time.Second
+
+	// ErrReadOnly is returned by Register and Deregister
+	ErrReadOnly = errors.New("dns registry is read-only")
+)
+
+type dnsRegistry struct {
+	options  registry.Options
+	domain   string
+	interval time.Duration
+	resolver *net.Resolver
+}
+
+// NewRegistry returns a registry which resolves `_grpc._tcp.{service}` SRV records,
+// the version and metadata of a node are read from the TXT records of the SRV target.
+// The first of registry.Addrs is used as the DNS server address if set.
+func NewRegistry(opts ...registry.Option) registry.Registry {
+	d := &dnsRegistry{
+		options:  registry.Options{},
+		interval: DefaultRefreshInterval,
+		resolver: net.DefaultResolver,
+	}
+	configure(d, opts...)
+	return d
+}
+
+func configure(d *dnsRegistry, opts ...registry.Option) {
+	for _, o := range opts {
+		o(&d.options)
+	}
+
+	// the scheme of the targets and the resolver builder
+	if len(d.options.Scheme) == 0 {
+		d.options.Scheme = schema
+	}
+
+	if d.options.Timeout == 0 {
+		d.options.Timeout = 5 * time.Second
+	}
+
+	if d.options.Context != nil {
+		if domain, ok := d.options.Context.Value(domainKey{}).(string); ok {
+			d.domain = strings.Trim(domain, ".")
+		}
+		if t, ok := d.options.Context.Value(refreshIntervalKey{}).(time.Duration); ok {
+			d.interval = t
+		}
+	}
+
+	var addr string
+	for _, address := range d.options.Addrs {
+		if len(address) == 0 {
+			continue
+		}
+		host, port, err := net.SplitHostPort(address)
+		if ae, ok := err.(*net.AddrError); ok && ae.Err == "missing port in address" {
+			addr = net.JoinHostPort(address, "53")
+		} else if err == nil {
+			addr = net.JoinHostPort(host, port)
+		}
+		break
+	}
+
+	if len(addr) == 0 {
+		d.resolver = net.DefaultResolver
+		return
+	}
+
+	d.resolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+func (d *dnsRegistry) name(service string) string {
+	if len(d.domain) == 0 {
+		return service
+	}
+	return service + "." + d.domain
+}
+
+// parseTXT parses `key=value` strings, the version is returned separately
+func parseTXT(txts []string) (string, map[string]string) {
+	var version string
+	md := make(map[string]string)
+
+	for _, txt := range txts {
+		kv := strings.SplitN(txt, "=", 2)
+		if len(kv[0]) == 0 {
+			continue
+		}
+
+		var v string
+		if len(kv) == 2 {
+			v = kv[1]
+		}
+
+		if kv[0] == txtVersion {
+			version = v
+			continue
+		}
+		md[kv[0]] = v
+	}
+
+	return version, md
+}
+
+func isNotFound(err error) bool {
+	if de, ok := err.(*net.DNSError); ok {
+		return de.IsNotFound
+	}
+	return false
+}
+
+func (d *dnsRegistry) resolve(ctx context.Context, service string) ([]*registry.Service, error) {
+	_, srvs, err := d.resolver.LookupSRV(ctx, srvService, srvProto, d.name(service))
+	if err != nil {
+		if isNotFound(err) {
+			return nil, registry.ErrNotFound
+		}
+		return nil, err
+	}
+
+	serviceMap := map[string]*registry.Service{}
+
+	for _, srv := range srvs {
+		host := strings.TrimSuffix(srv.Target, ".")
+		address := net.JoinHostPort(host, strconv.Itoa(int(srv.Port)))
+
+		// missing TXT records only means no version and metadata
+		txts, err := d.resolver.LookupTXT(ctx, srv.Target)
+		if err != nil && !isNotFound(err) {
+			return nil, err
+		}
+		version, md := parseTXT(txts)
+
+		svc, ok := serviceMap[version]
+		if !ok {
+			svc = &registry.Service{
+				Name:    service,
+				Version: version,
+			}
+			serviceMap[version] = svc
+		}
+
+		svc.Nodes = append(svc.Nodes, &registry.Node{
+			Id:       address,
+			Address:  address,
+			Metadata: md,
+		})
+	}
+
+	if len(serviceMap) == 0 {
+		return nil, registry.ErrNotFound
+	}
+
+	services := make([]*registry.Service, 0, len(serviceMap))
+	for _, svc := range serviceMap {
+		sort.Slice(svc.Nodes, func(i, j int) bool { return svc.Nodes[i].Id < svc.Nodes[j].Id })
+		services = append(services, svc)
+	}
+
+	return services, nil
+}
+
+func (d *dnsRegistry) Init(opts ...registry.Option) error {
+	configure(d, opts...)
+	return nil
+}
+
+func (d *dnsRegistry) Options() registry.Options {
+	return d.options
+}
+
+// NewTarget return grpc.Dial target
+func (d *dnsRegistry) NewTarget(s *registry.Service, opts ...registry.Option) string {
+	options := registry.Options{}
+	for _, o := range opts {
+		o(&options)
+	}
+
+	if len(options.Versions) == 0 {
+		return d.options.Scheme + ":///" + s.Name
+	}
+
+	return d.options.Scheme + ":///" + s.Name + "?version=" + strings.Join(options.Versions, queryValSeq)
+}
+
+func (d *dnsRegistry) Register(*registry.Service, ...registry.RegisterOption) error {
+	return ErrReadOnly
+}
+
+func (d *dnsRegistry) Deregister(*registry.Service) error {
+	return ErrReadOnly
+}
+
+func (d *dnsRegistry) GetService(name string) ([]*registry.Service, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.options.Timeout)
+	defer cancel()
+
+	return d.resolve(ctx, name)
+}
+
+// ListServices is not supported, DNS has no way to enumerate the services
+func (d *dnsRegistry) ListServices() ([]*registry.Service, error) {
+	return nil, errors.New("dns registry can not list services")
+}
+
+func (d *dnsRegistry) Watch(opts ...registry.WatchOption) (registry.Watcher, error) {
+	return newDNSWatcher(d, opts...)
+}
+
+func (d *dnsRegistry) String() string {
+	return "dns"
+}
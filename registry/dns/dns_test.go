@@ -0,0 +1,158 @@
+package dns
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/hb-go/grpc-contrib/registry"
+)
+
+type mockZone struct {
+	sync.RWMutex
+	srv map[string][]*dns.SRV
+	txt map[string][]string
+}
+
+func (z *mockZone) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	z.RLock()
+	defer z.RUnlock()
+
+	m := new(dns.Msg)
+	m.SetReply(req)
+
+	q := req.Question[0]
+	hdr := dns.RR_Header{Name: q.Name, Class: dns.ClassINET, Ttl: 0}
+
+	switch q.Qtype {
+	case dns.TypeSRV:
+		for _, srv := range z.srv[q.Name] {
+			rr := *srv
+			hdr.Rrtype = dns.TypeSRV
+			rr.Hdr = hdr
+			m.Answer = append(m.Answer, &rr)
+		}
+	case dns.TypeTXT:
+		for _, txt := range z.txt[q.Name] {
+			hdr.Rrtype = dns.TypeTXT
+			m.Answer = append(m.Answer, &dns.TXT{Hdr: hdr, Txt: []string{txt}})
+		}
+	}
+
+	if len(m.Answer) == 0 {
+		m.Rcode = dns.RcodeNameError
+	}
+	w.WriteMsg(m)
+}
+
+func newMockServer(t *testing.T, z *mockZone) (string, func()) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &dns.Server{PacketConn: pc, Handler: z}
+	go server.ActivateAndServe()
+
+	return pc.LocalAddr().String(), func() {
+		server.Shutdown()
+	}
+}
+
+func newZone() *mockZone {
+	return &mockZone{
+		srv: map[string][]*dns.SRV{
+			"_grpc._tcp.foo.example.com.": {
+				{Target: "node-1.example.com.", Port: 8080},
+				{Target: "node-2.example.com.", Port: 8080},
+			},
+		},
+		txt: map[string][]string{
+			"node-1.example.com.": {"version=v1", "zone=a"},
+			"node-2.example.com.": {"version=v2", "zone=b"},
+		},
+	}
+}
+
+func TestDNSRegistry(t *testing.T) {
+	addr, cl := newMockServer(t, newZone())
+	defer cl()
+
+	r := NewRegistry(registry.Addrs(addr), Domain("example.com"))
+
+	services, err := r.GetService("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exp, act := 2, len(services); exp != act {
+		t.Fatalf("Expected %d versions, got %d", exp, act)
+	}
+
+	for _, s := range services {
+		if len(s.Nodes) != 1 {
+			t.Fatalf("Expected 1 node for version %s, got %d", s.Version, len(s.Nodes))
+		}
+
+		node := s.Nodes[0]
+		switch s.Version {
+		case "v1":
+			if node.Address != "node-1.example.com:8080" || node.Metadata["zone"] != "a" {
+				t.Fatalf("Unexpected node %+v for version %s", node, s.Version)
+			}
+		case "v2":
+			if node.Address != "node-2.example.com:8080" || node.Metadata["zone"] != "b" {
+				t.Fatalf("Unexpected node %+v for version %s", node, s.Version)
+			}
+		default:
+			t.Fatalf("Unexpected version %s", s.Version)
+		}
+	}
+
+	if _, err := r.GetService("bar"); err != registry.ErrNotFound {
+		t.Fatalf("Expected %v, got %v", registry.ErrNotFound, err)
+	}
+}
+
+func TestDNSWatcher(t *testing.T) {
+	z := newZone()
+	addr, cl := newMockServer(t, z)
+	defer cl()
+
+	r := NewRegistry(registry.Addrs(addr), Domain("example.com"), RefreshInterval(10*time.Millisecond))
+
+	w, err := r.Watch(registry.WatchService("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	z.Lock()
+	z.srv["_grpc._tcp.foo.example.com."] = []*dns.SRV{
+		{Target: "node-1.example.com.", Port: 8080},
+		{Target: "node-3.example.com.", Port: 8080},
+	}
+	z.txt["node-3.example.com."] = []string{"version=v1"}
+	z.Unlock()
+
+	expected := map[string]string{
+		"update": "v1",
+		"delete": "v2",
+	}
+
+	for len(expected) > 0 {
+		res, err := w.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		version, ok := expected[res.Action]
+		if !ok || version != res.Service.Version {
+			t.Fatalf("Unexpected %s event for %s", res.Action, res.Service.Version)
+		}
+		delete(expected, res.Action)
+	}
+}
@@ -0,0 +1,36 @@
+package dns
+
+import (
+	"context"
+	"time"
+
+	"github.com/hb-go/grpc-contrib/registry"
+)
+
+type domainKey struct{}
+
+type refreshIntervalKey struct{}
+
+// Domain sets the domain appended to the service name,
+// e.g. `_grpc._tcp.{service}.{domain}`
+func Domain(domain string) registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, domainKey{}, domain)
+	}
+}
+
+// RefreshInterval sets how often watchers resolve the records again
+func RefreshInterval(t time.Duration) registry.Option {
+	return func(o *registry.Options) {
+		if t <= time.Duration(0) {
+			return
+		}
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, refreshIntervalKey{}, t)
+	}
+}
@@ -0,0 +1,86 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/grpclog"
+
+	"github.com/hb-go/grpc-contrib/registry"
+)
+
+type dnsWatcher struct {
+	r  *dnsRegistry
+	wo registry.WatchOptions
+
+	ticker   *time.Ticker
+	exit     chan bool
+	once     sync.Once
+	services []*registry.Service
+	results  []*registry.Result
+}
+
+func newDNSWatcher(r *dnsRegistry, opts ...registry.WatchOption) (registry.Watcher, error) {
+	var wo registry.WatchOptions
+	for _, o := range opts {
+		o(&wo)
+	}
+
+	if len(wo.Service) == 0 {
+		return nil, errors.New("dns registry requires a service to watch")
+	}
+
+	dw := &dnsWatcher{
+		r:      r,
+		wo:     wo,
+		ticker: time.NewTicker(r.interval),
+		exit:   make(chan bool),
+	}
+
+	// the first resolution is the baseline, only changes are emitted
+	services, err := r.GetService(wo.Service)
+	if err != nil && err != registry.ErrNotFound {
+		dw.ticker.Stop()
+		return nil, err
+	}
+	dw.services = services
+
+	return dw, nil
+}
+
+func (dw *dnsWatcher) Next() (*registry.Result, error) {
+	for {
+		if len(dw.results) > 0 {
+			r := dw.results[0]
+			dw.results = dw.results[1:]
+			return r, nil
+		}
+
+		select {
+		case <-dw.exit:
+			return nil, registry.ErrWatcherStopped
+		case <-dw.ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), dw.r.options.Timeout)
+		services, err := dw.r.resolve(ctx, dw.wo.Service)
+		cancel()
+		if err != nil && err != registry.ErrNotFound {
+			// keep the last good resolution on temporary failures
+			grpclog.Warningf("grpc-contrib.registry: dns resolve error: %v", err)
+			continue
+		}
+
+		dw.results = registry.Diff(dw.services, services)
+		dw.services = services
+	}
+}
+
+func (dw *dnsWatcher) Stop() {
+	dw.once.Do(func() {
+		close(dw.exit)
+		dw.ticker.Stop()
+	})
+}
@@ -4,7 +4,6 @@ package etcd
 import (
 	"context"
 	"crypto/tls"
-	"encoding/json"
 	"errors"
 	"net"
 	"path"
@@ -13,37 +12,61 @@ import (
 	"sync"
 	"time"
 
-	hash "github.com/mitchellh/hashstructure"
 	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
 	"go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
 	"go.uber.org/zap"
+	"google.golang.org/grpc/grpclog"
 
 	"github.com/hb-go/grpc-contrib/registry"
 )
 
-const schema = "registry"
+const schema = "etcd"
 const watchLimit = 1.0
 const watchBurst = 3
 const queryValSeq = "|"
 
 var (
-	prefix = "/grpc/registry/"
+	// DefaultPrefix is the key prefix the services are stored under
+	DefaultPrefix = "/grpc/registry/"
+
+	// ErrNodeOwned is returned by Register and Deregister with CompareAndSwap
+	// if a node Id is owned by the lease of another registration
+	ErrNodeOwned = errors.New("etcd: node owned by another lease")
 )
 
 type etcdRegistry struct {
 	client  *clientv3.Client
 	options registry.Options
+	prefix  string
+	codec   registry.Codec
 
 	sync.RWMutex
 	register map[string]uint64
 	leases   map[string]clientv3.LeaseID
+	// ttls are the seconds of the ttl the nodes were registered with
+	ttls map[string]int64
+	// cas refuses to overwrite the nodes owned by another lease
+	cas bool
+
+	// session mode, the nodes share the lease of the session
+	sessionTTL time.Duration
+	sessionMu  sync.Mutex
+	session    *concurrency.Session
+	// nodes registered with the session, re-registered when the lease is lost
+	sessionNodes map[string]*registry.Service
 }
 
 func NewRegistry(opts ...registry.Option) registry.Registry {
 	e := &etcdRegistry{
 		options:  registry.Options{},
+		prefix:   DefaultPrefix,
+		codec:    registry.DefaultCodec,
 		register: make(map[string]uint64),
 		leases:   make(map[string]clientv3.LeaseID),
+		ttls:     make(map[string]int64),
+
+		sessionNodes: make(map[string]*registry.Service),
 	}
 	configure(e, opts...)
 	return e
@@ -58,10 +81,19 @@ func configure(e *etcdRegistry, opts ...registry.Option) error {
 		o(&e.options)
 	}
 
+	// the scheme of the targets and the resolver builder
+	if len(e.options.Scheme) == 0 {
+		e.options.Scheme = schema
+	}
+
 	if e.options.Timeout == 0 {
 		e.options.Timeout = 5 * time.Second
 	}
 
+	if e.options.Codec != nil {
+		e.codec = e.options.Codec
+	}
+
 	if e.options.Secure || e.options.TLSConfig != nil {
 		tlsConfig := e.options.TLSConfig
 		if tlsConfig == nil {
@@ -83,6 +115,18 @@ func configure(e *etcdRegistry, opts ...registry.Option) error {
 		if ok && cfg != nil {
 			config.LogConfig = cfg
 		}
+		if p, ok := e.options.Context.Value(prefixKey{}).(string); ok && len(p) > 0 {
+			e.prefix = strings.TrimSuffix(path.Join("/", p), "/") + "/"
+		}
+		if cas, ok := e.options.Context.Value(casKey{}).(bool); ok {
+			e.cas = cas
+		}
+		if ttl, ok := e.options.Context.Value(sessionKey{}).(time.Duration); ok {
+			e.sessionTTL = ttl
+			if e.sessionTTL < time.Second {
+				e.sessionTTL = defaultSessionTTL
+			}
+		}
 	}
 
 	var cAddrs []string
@@ -114,25 +158,49 @@ func configure(e *etcdRegistry, opts ...registry.Option) error {
 	return nil
 }
 
-func encode(s *registry.Service) string {
-	b, _ := json.Marshal(s)
-	return string(b)
+// decode decodes the node of the key, a failure is logged and the node skipped
+func decode(codec registry.Codec, key, ds []byte) *registry.Service {
+	s, err := codec.Unmarshal(ds)
+	if err != nil {
+		grpclog.Warningf("grpc-contrib.registry: etcd decode node %s error: %v", key, err)
+		return nil
+	}
+	return s
 }
 
-func decode(ds []byte) *registry.Service {
-	var s *registry.Service
-	json.Unmarshal(ds, &s)
-	return s
+// namespace returns the namespace of the call, the one of the context
+// or else the one of the registry
+func (e *etcdRegistry) namespace(ctx context.Context) string {
+	if ns, ok := registry.NamespaceFromContext(ctx); ok {
+		return ns
+	}
+	return e.options.Namespace
 }
 
-func nodePath(s, id string) string {
+// namespacePath returns the key prefix of the namespace,
+// the services of the default namespace are stored under the prefix.
+func (e *etcdRegistry) namespacePath(ns string) string {
+	if len(ns) == 0 {
+		return e.prefix
+	}
+	return path.Join(e.prefix, strings.Replace(ns, "/", "-", -1)) + "/"
+}
+
+func (e *etcdRegistry) nodePath(ns, s, id string) string {
 	service := strings.Replace(s, "/", "-", -1)
 	node := strings.Replace(id, "/", "-", -1)
-	return path.Join(prefix, service, node)
+	return path.Join(e.namespacePath(ns), service, node)
+}
+
+func (e *etcdRegistry) servicePath(ns, s string) string {
+	return path.Join(e.namespacePath(ns), strings.Replace(s, "/", "-", -1))
 }
 
-func servicePath(s string) string {
-	return path.Join(prefix, strings.Replace(s, "/", "-", -1))
+// isNodeKey reports whether the key is a node of the namespace,
+// the keys of the other namespaces below the default one are skipped.
+func isNodeKey(nsPath, key string) bool {
+	rel := strings.TrimPrefix(key, nsPath)
+	return len(rel) < len(key) && strings.Count(rel, "/") == 1
 }
 
 func (e *etcdRegistry) Init(opts ...registry.Option) error {
@@ -150,214 +218,174 @@ func (r *etcdRegistry) NewTarget(s *registry.Service, opts ...registry.Option) s
 		o(&options)
 	}
 
+	// the namespace is the authority of the target
+	ns := options.Namespace
+	if len(ns) == 0 {
+		ns = r.options.Namespace
+	}
+
 	if len(options.Versions) == 0 {
-		return schema + ":///" + s.Name
+		return r.options.Scheme + "://" + ns + "/" + s.Name
 	}
 
-	return schema + ":///" + s.Name + "?version=" + strings.Join(options.Versions, queryValSeq)
+	return r.options.Scheme + "://" + ns + "/" + s.Name + "?version=" + strings.Join(options.Versions, queryValSeq)
+}
+
+func (e *etcdRegistry) Deregister(s *registry.Service) error {
+	return e.DeregisterContext(context.Background(), s)
 }
 
-func (e *etcdRegistry) registerNode(s *registry.Service, node *registry.Node, opts ...registry.RegisterOption) error {
+func (e *etcdRegistry) DeregisterContext(ctx context.Context, s *registry.Service) error {
 	if len(s.Nodes) == 0 {
 		return errors.New("require at least one node")
 	}
 
-	// check existing lease cache
-	e.RLock()
-	leaseID, ok := e.leases[s.Name+node.Id]
-	e.RUnlock()
+	nodes, err := e.newNodes(e.namespace(ctx), s)
+	if err != nil {
+		return err
+	}
 
-	if !ok {
-		// missing lease, check if the key exists
-		ctx, cancel := context.WithTimeout(context.Background(), e.options.Timeout)
-		defer cancel()
+	ctx, cancel := context.WithTimeout(ctx, e.options.Timeout)
+	defer cancel()
 
-		// look for the existing key
-		rsp, err := e.client.Get(ctx, nodePath(s.Name, node.Id), clientv3.WithSerializable())
-		if err != nil {
-			return err
-		}
+	// if logger.V(logger.TraceLevel, logger.DefaultLogger) {
+	// 	logger.Tracef("Deregistering %s id %s", s.Name, node.Id)
+	// }
+	if err := e.deleteNodes(ctx, nodes); err != nil {
+		return err
+	}
 
-		// get the existing lease
-		for _, kv := range rsp.Kvs {
-			if kv.Lease > 0 {
-				leaseID = clientv3.LeaseID(kv.Lease)
+	for _, n := range nodes {
+		e.Lock()
+		// delete our hash of the service
+		delete(e.register, n.key)
+		// delete our lease of the service
+		delete(e.leases, n.key)
+		delete(e.ttls, n.key)
+		e.Unlock()
 
-				// decode the existing node
-				srv := decode(kv.Value)
-				if srv == nil || len(srv.Nodes) == 0 {
-					continue
-				}
+		e.sessionMu.Lock()
+		delete(e.sessionNodes, n.key)
+		e.sessionMu.Unlock()
+	}
 
-				// create hash of service; uint64
-				h, err := hash.Hash(srv.Nodes[0], nil)
-				if err != nil {
-					continue
-				}
+	return nil
+}
 
-				// save the info
-				e.Lock()
-				e.leases[s.Name+node.Id] = leaseID
-				e.register[s.Name+node.Id] = h
-				e.Unlock()
+func (e *etcdRegistry) Register(s *registry.Service, opts ...registry.RegisterOption) error {
+	return e.RegisterContext(context.Background(), s, opts...)
+}
 
-				break
-			}
-		}
+func (e *etcdRegistry) RegisterContext(ctx context.Context, s *registry.Service, opts ...registry.RegisterOption) error {
+	if len(s.Nodes) == 0 {
+		return errors.New("require at least one node")
 	}
 
-	var leaseNotFound bool
-
-	// renew the lease if it exists
-	if leaseID > 0 {
-		// if logger.V(logger.TraceLevel, logger.DefaultLogger) {
-		// 	logger.Tracef("Renewing existing lease for %s %d", s.Name, leaseID)
-		// }
-		if _, err := e.client.KeepAliveOnce(context.TODO(), leaseID); err != nil {
-			if err != rpctypes.ErrLeaseNotFound {
-				return err
-			}
-
-			// if logger.V(logger.TraceLevel, logger.DefaultLogger) {
-			// 	logger.Tracef("Lease not found for %s %d", s.Name, leaseID)
-			// }
-			// lease not found do register
-			leaseNotFound = true
-		}
+	var options registry.RegisterOptions
+	for _, o := range opts {
+		o(&options)
 	}
 
-	// create hash of service; uint64
-	h, err := hash.Hash(node, nil)
+	nodes, err := e.newNodes(e.namespace(ctx), s)
 	if err != nil {
 		return err
 	}
 
-	// get existing hash for the service node
-	e.Lock()
-	v, ok := e.register[s.Name+node.Id]
-	e.Unlock()
-
-	// the service is unchanged, skip registering
-	if ok && v == h && !leaseNotFound {
-		// if logger.V(logger.TraceLevel, logger.DefaultLogger) {
-		// 	logger.Tracef("Service %s node %s unchanged skipping registration", s.Name, node.Id)
-		// }
-		return nil
+	if e.sessionTTL > 0 {
+		return e.registerSession(ctx, nodes)
 	}
 
-	service := &registry.Service{
-		Name:     s.Name,
-		Version:  s.Version,
-		Metadata: s.Metadata,
-		Methods:  s.Methods,
-		Nodes:    []*registry.Node{node},
-	}
+	ctx, cancel := context.WithTimeout(ctx, e.options.Timeout)
+	defer cancel()
 
-	var options registry.RegisterOptions
-	for _, o := range opts {
-		o(&options)
+	// adopt the leases of the nodes registered before, e.g. before a restart
+	if err := e.adopt(ctx, nodes); err != nil {
+		return err
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), e.options.Timeout)
-	defer cancel()
+	ttl := int64(options.TTL.Seconds())
 
-	var lgr *clientv3.LeaseGrantResponse
-	if options.TTL.Seconds() > 0 {
-		// get a lease used to expire keys since we have a ttl
-		lgr, err = e.client.Grant(ctx, int64(options.TTL.Seconds()))
-		if err != nil {
+	// renew the lease if the nodes share one
+	leaseID, shared := e.sharedLease(nodes)
+	var keep bool
+	if shared && leaseID > 0 {
+		rsp, err := e.client.KeepAliveOnce(ctx, leaseID)
+		if err != nil && err != rpctypes.ErrLeaseNotFound {
 			return err
 		}
+
+		// the lease is kept for the same ttl, else the nodes are put again,
+		// a lease not found do register
+		keep = err == nil && ttl > 0 && e.ttlOf(nodes[0].key, rsp.TTL) == ttl
 	}
 
-	// if logger.V(logger.TraceLevel, logger.DefaultLogger) {
-	// 	logger.Tracef("Registering %s id %s with lease %v and leaseID %v and ttl %v", service.Name, node.Id, lgr, lgr.ID, options.TTL)
-	// }
-	// create an entry for the node
-	if lgr != nil {
-		_, err = e.client.Put(ctx, nodePath(service.Name, node.Id), encode(service), clientv3.WithLease(lgr.ID))
-	} else {
-		_, err = e.client.Put(ctx, nodePath(service.Name, node.Id), encode(service))
+	// the nodes are unchanged with the lease of the ttl or without a ttl
+	// and a lease, skip registering
+	if shared && (keep || (ttl <= 0 && leaseID == clientv3.NoLease)) && e.unchanged(nodes) {
+		return nil
 	}
-	if err != nil {
+
+	lease := clientv3.NoLease
+	if ttl > 0 {
+		if keep {
+			lease = leaseID
+		} else {
+			// get a lease used to expire keys since we have a ttl
+			lgr, err := e.client.Grant(ctx, int64(options.TTL.Seconds()))
+			if err != nil {
+				return err
+			}
+			lease = lgr.ID
+		}
+	}
+
+	if err := e.putNodes(ctx, nodes, lease); err != nil {
 		return err
 	}
 
 	e.Lock()
-	// save our hash of the service
-	e.register[s.Name+node.Id] = h
-	// save our leaseID of the service
-	if lgr != nil {
-		e.leases[s.Name+node.Id] = lgr.ID
+	for _, n := range nodes {
+		e.ttls[n.key] = ttl
 	}
 	e.Unlock()
 
 	return nil
 }
 
-func (e *etcdRegistry) Deregister(s *registry.Service) error {
-	if len(s.Nodes) == 0 {
-		return errors.New("require at least one node")
-	}
-
-	for _, node := range s.Nodes {
-		e.Lock()
-		// delete our hash of the service
-		delete(e.register, s.Name+node.Id)
-		// delete our lease of the service
-		delete(e.leases, s.Name+node.Id)
-		e.Unlock()
-
-		ctx, cancel := context.WithTimeout(context.Background(), e.options.Timeout)
-		defer cancel()
+// ttlOf returns the ttl the node was registered with, the granted ttl
+// of its lease if it was adopted
+func (e *etcdRegistry) ttlOf(key string, granted int64) int64 {
+	e.RLock()
+	defer e.RUnlock()
 
-		// if logger.V(logger.TraceLevel, logger.DefaultLogger) {
-		// 	logger.Tracef("Deregistering %s id %s", s.Name, node.Id)
-		// }
-		_, err := e.client.Delete(ctx, nodePath(s.Name, node.Id))
-		if err != nil {
-			return err
-		}
+	if ttl, ok := e.ttls[key]; ok {
+		return ttl
 	}
-
-	return nil
+	return granted
 }
 
-func (e *etcdRegistry) Register(s *registry.Service, opts ...registry.RegisterOption) error {
-	if len(s.Nodes) == 0 {
-		return errors.New("require at least one node")
-	}
-
-	var gerr error
-
-	// register each node individually
-	for _, node := range s.Nodes {
-		err := e.registerNode(s, node, opts...)
-		if err != nil {
-			gerr = err
-		}
-	}
-
-	return gerr
+func (e *etcdRegistry) GetService(name string) ([]*registry.Service, error) {
+	return e.GetServiceContext(context.Background(), name)
 }
 
-func (e *etcdRegistry) GetService(name string) ([]*registry.Service, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), e.options.Timeout)
+func (e *etcdRegistry) GetServiceContext(ctx context.Context, name string) ([]*registry.Service, error) {
+	ctx, cancel := context.WithTimeout(ctx, e.options.Timeout)
 	defer cancel()
 
-	rsp, err := e.client.Get(ctx, servicePath(name)+"/", clientv3.WithPrefix(), clientv3.WithSerializable())
+	nsPath := e.namespacePath(e.namespace(ctx))
+
+	rsp, err := e.client.Get(ctx, e.servicePath(e.namespace(ctx), name)+"/", clientv3.WithPrefix(), clientv3.WithSerializable())
 	if err != nil {
 		return nil, err
 	}
 
-	if len(rsp.Kvs) == 0 {
-		return nil, registry.ErrNotFound
-	}
-
 	serviceMap := map[string]*registry.Service{}
 
 	for _, n := range rsp.Kvs {
-		if sn := decode(n.Value); sn != nil {
+		if !isNodeKey(nsPath, string(n.Key)) {
+			continue
+		}
+		if sn := decode(e.codec, n.Key, n.Value); sn != nil {
 			s, ok := serviceMap[sn.Version]
 			if !ok {
 				s = &registry.Service{
@@ -373,6 +401,10 @@ func (e *etcdRegistry) GetService(name string) ([]*registry.Service, error) {
 		}
 	}
 
+	if len(serviceMap) == 0 {
+		return nil, registry.ErrNotFound
+	}
+
 	services := make([]*registry.Service, 0, len(serviceMap))
 	for _, service := range serviceMap {
 		services = append(services, service)
@@ -382,12 +414,18 @@ func (e *etcdRegistry) GetService(name string) ([]*registry.Service, error) {
 }
 
 func (e *etcdRegistry) ListServices() ([]*registry.Service, error) {
+	return e.ListServicesContext(context.Background())
+}
+
+func (e *etcdRegistry) ListServicesContext(ctx context.Context) ([]*registry.Service, error) {
 	versions := make(map[string]*registry.Service)
 
-	ctx, cancel := context.WithTimeout(context.Background(), e.options.Timeout)
+	ctx, cancel := context.WithTimeout(ctx, e.options.Timeout)
 	defer cancel()
 
-	rsp, err := e.client.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithSerializable())
+	nsPath := e.namespacePath(e.namespace(ctx))
+
+	rsp, err := e.client.Get(ctx, nsPath, clientv3.WithPrefix(), clientv3.WithSerializable())
 	if err != nil {
 		return nil, err
 	}
@@ -397,7 +435,10 @@ func (e *etcdRegistry) ListServices() ([]*registry.Service, error) {
 	}
 
 	for _, n := range rsp.Kvs {
-		sn := decode(n.Value)
+		if !isNodeKey(nsPath, string(n.Key)) {
+			continue
+		}
+		sn := decode(e.codec, n.Key, n.Value)
 		if sn == nil {
 			continue
 		}
@@ -422,7 +463,11 @@ func (e *etcdRegistry) ListServices() ([]*registry.Service, error) {
 }
 
 func (e *etcdRegistry) Watch(opts ...registry.WatchOption) (registry.Watcher, error) {
-	return newEtcdWatcher(e, e.options.Timeout, opts...)
+	return e.WatchContext(context.Background(), opts...)
+}
+
+func (e *etcdRegistry) WatchContext(ctx context.Context, opts ...registry.WatchOption) (registry.Watcher, error) {
+	return newEtcdWatcher(ctx, e, e.options.Timeout, opts...)
 }
 
 func (e *etcdRegistry) String() string {
@@ -0,0 +1,78 @@
+package etcd
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hb-go/grpc-contrib/registry"
+)
+
+func TestIsNodeKey(t *testing.T) {
+	r := &etcdRegistry{prefix: DefaultPrefix}
+
+	testData := []struct {
+		ns  string
+		key string
+		exp bool
+	}{
+		{"", r.nodePath("", "foo", "node-1"), true},
+		{"", r.nodePath("prod", "foo", "node-1"), false},
+		{"prod", r.nodePath("prod", "foo", "node-1"), true},
+		{"prod", r.nodePath("", "foo", "node-1"), false},
+		{"prod", r.nodePath("test", "foo", "node-1"), false},
+	}
+
+	for _, d := range testData {
+		if act := isNodeKey(r.namespacePath(d.ns), d.key); act != d.exp {
+			t.Fatalf("Expected %v for %s in namespace %q, got %v", d.exp, d.key, d.ns, act)
+		}
+	}
+}
+
+func TestNamespace(t *testing.T) {
+	addr := etcdAddr(t)
+
+	// the records written with the protobuf codec are read with the default one
+	prod := NewRegistry(registry.Addrs(addr), Prefix("/grpc/test"), registry.Namespace("prod"), registry.WithCodec(registry.ProtoCodec))
+	def := NewRegistry(registry.Addrs(addr), Prefix("/grpc/test"))
+
+	service := &registry.Service{
+		Name:    "ns",
+		Version: "1.0.0",
+		Nodes:   []*registry.Node{{Id: "node-1", Address: "127.0.0.1:8080"}},
+	}
+
+	if err := prod.Register(service); err != nil {
+		t.Fatal(err)
+	}
+	defer prod.Deregister(service)
+
+	if _, err := def.GetService(service.Name); err != registry.ErrNotFound {
+		t.Fatalf("Expected %v in the default namespace, got %v", registry.ErrNotFound, err)
+	}
+	if services, err := def.ListServices(); err != nil || len(services) != 0 {
+		t.Fatalf("Expected no services in the default namespace, got %v %v", services, err)
+	}
+
+	services, err := prod.GetService(service.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp, act := 1, len(services); exp != act {
+		t.Fatalf("Expected %d services, got %d", exp, act)
+	}
+
+	// the namespace of the context overrides the one of the registry
+	ctx := registry.NewNamespaceContext(context.Background(), "prod")
+	services, err = registry.WithContext(def).GetServiceContext(ctx, service.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp, act := 1, len(services); exp != act {
+		t.Fatalf("Expected %d services, got %d", exp, act)
+	}
+
+	if exp, act := "etcd://prod/ns", prod.NewTarget(service); exp != act {
+		t.Fatalf("Expected target %s, got %s", exp, act)
+	}
+}
@@ -2,6 +2,7 @@ package etcd
 
 import (
 	"context"
+	"time"
 
 	"github.com/hb-go/grpc-contrib/registry"
 	"go.uber.org/zap"
@@ -11,6 +12,12 @@ type authKey struct{}
 
 type logConfigKey struct{}
 
+type sessionKey struct{}
+
+type prefixKey struct{}
+
+type casKey struct{}
+
 type authCreds struct {
 	Username string
 	Password string
@@ -35,3 +42,37 @@ func LogConfig(config *zap.Config) registry.Option {
 		o.Context = context.WithValue(o.Context, logConfigKey{}, config)
 	}
 }
+
+// Session registers all the nodes of the process with one lease kept alive
+// by a stream, the nodes expire when the process dies and are re-registered
+// when the lease is lost. The RegisterTTL option is ignored.
+func Session(ttl time.Duration) registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, sessionKey{}, ttl)
+	}
+}
+
+// Prefix is the key prefix the services are stored under, DefaultPrefix by default
+func Prefix(p string) registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, prefixKey{}, p)
+	}
+}
+
+// CompareAndSwap refuses to register or deregister a node Id which is owned by
+// the lease of another registration, e.g. a duplicate Id of another process.
+// Such calls fail with ErrNodeOwned instead of taking the node over.
+func CompareAndSwap() registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, casKey{}, true)
+	}
+}
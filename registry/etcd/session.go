@@ -0,0 +1,127 @@
+package etcd
+
+import (
+	"context"
+	"time"
+
+	"go.etcd.io/etcd/client/v3/concurrency"
+	"google.golang.org/grpc/grpclog"
+)
+
+// defaultSessionTTL is the lease TTL of the session if the Session option is below a second
+var defaultSessionTTL = 10 * time.Second
+
+// getSession returns the session, a new one is created if there is none
+// or its lease is lost. The lease is granted with the context, the session
+// keeps it alive until the client is closed. The caller must hold sessionMu.
+func (e *etcdRegistry) getSession(ctx context.Context) (*concurrency.Session, error) {
+	if e.session != nil {
+		select {
+		case <-e.session.Done():
+		default:
+			return e.session, nil
+		}
+	}
+
+	lgr, err := e.client.Grant(ctx, int64(e.sessionTTL.Seconds()))
+	if err != nil {
+		return nil, err
+	}
+
+	sess, err := concurrency.NewSession(e.client,
+		concurrency.WithTTL(int(lgr.TTL)),
+		concurrency.WithLease(lgr.ID),
+		concurrency.WithContext(e.client.Ctx()),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	e.session = sess
+	go e.keepSession(sess)
+
+	return sess, nil
+}
+
+// keepSession re-registers the nodes with a new session once the lease
+// of the session is lost, e.g. it expired during a partition.
+func (e *etcdRegistry) keepSession(sess *concurrency.Session) {
+	<-sess.Done()
+
+	for {
+		// the client is closed
+		if e.client.Ctx().Err() != nil {
+			return
+		}
+
+		err := e.reregister(sess)
+		if err == nil {
+			return
+		}
+		grpclog.Warningf("grpc-contrib.registry: etcd session re-register error: %v", err)
+
+		select {
+		case <-e.client.Ctx().Done():
+			return
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+// reregister puts the nodes of the lost session with a new session
+func (e *etcdRegistry) reregister(lost *concurrency.Session) error {
+	e.sessionMu.Lock()
+	defer e.sessionMu.Unlock()
+
+	if len(e.sessionNodes) == 0 {
+		return nil
+	}
+
+	grpclog.Warningf("grpc-contrib.registry: etcd session lease %x lost, re-register %d nodes", lost.Lease(), len(e.sessionNodes))
+
+	ctx, cancel := context.WithTimeout(context.Background(), e.options.Timeout)
+	defer cancel()
+
+	sess, err := e.getSession(ctx)
+	if err != nil {
+		return err
+	}
+
+	nodes := make([]*etcdNode, 0, len(e.sessionNodes))
+	for key, service := range e.sessionNodes {
+		n, err := e.newNode(key, service)
+		if err != nil {
+			return err
+		}
+		nodes = append(nodes, n)
+	}
+
+	return e.putNodes(ctx, nodes, sess.Lease())
+}
+
+// registerSession registers the nodes with the lease of the session,
+// it is skipped if they are unchanged and already put with this lease.
+func (e *etcdRegistry) registerSession(ctx context.Context, nodes []*etcdNode) error {
+	e.sessionMu.Lock()
+	defer e.sessionMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, e.options.Timeout)
+	defer cancel()
+
+	sess, err := e.getSession(ctx)
+	if err != nil {
+		return err
+	}
+
+	if lease, ok := e.sharedLease(nodes); !ok || lease != sess.Lease() || !e.unchanged(nodes) {
+		if err := e.putNodes(ctx, nodes, sess.Lease()); err != nil {
+			return err
+		}
+	}
+
+	for _, n := range nodes {
+		e.sessionNodes[n.key] = n.service
+	}
+
+	return nil
+}
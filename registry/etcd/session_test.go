@@ -0,0 +1,131 @@
+package etcd
+
+import (
+	"context"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/client/v3"
+
+	"github.com/hb-go/grpc-contrib/registry"
+)
+
+// etcdAddr is the test server, e.g. `docker run -p 2379:2379 quay.io/coreos/etcd`
+func etcdAddr(t *testing.T) string {
+	addr := os.Getenv("ETCD_ADDR")
+	if len(addr) == 0 {
+		addr = "127.0.0.1:2379"
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Skipf("etcd is not available at %s: %v", addr, err)
+	}
+	conn.Close()
+
+	return addr
+}
+
+func TestSession(t *testing.T) {
+	retryInterval = 100 * time.Millisecond
+	defer func() {
+		retryInterval = time.Second
+	}()
+
+	r := NewRegistry(registry.Addrs(etcdAddr(t)), Session(2*time.Second)).(*etcdRegistry)
+
+	service := &registry.Service{
+		Name:    "session",
+		Version: "1.0.0",
+		Nodes: []*registry.Node{
+			{Id: "node-1", Address: "127.0.0.1:8080"},
+			{Id: "node-2", Address: "127.0.0.1:8081"},
+		},
+	}
+
+	if err := r.Register(service); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Deregister(service)
+
+	lease := func() []clientv3.LeaseID {
+		rsp, err := r.client.Get(context.TODO(), r.servicePath("", service.Name)+"/", clientv3.WithPrefix())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var leases []clientv3.LeaseID
+		for _, kv := range rsp.Kvs {
+			leases = append(leases, clientv3.LeaseID(kv.Lease))
+		}
+		return leases
+	}
+
+	leases := lease()
+	if len(leases) != 2 || leases[0] == 0 || leases[0] != leases[1] {
+		t.Fatalf("Expected 2 nodes sharing a lease, got %v", leases)
+	}
+
+	// kept alive past the TTL
+	time.Sleep(3 * time.Second)
+	if act := lease(); len(act) != 2 || act[0] != leases[0] {
+		t.Fatalf("Expected the lease %x to be kept alive, got %v", leases[0], act)
+	}
+
+	// the lease is lost, the nodes are re-registered with a new one
+	if _, err := r.client.Revoke(context.TODO(), leases[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		act := lease()
+		if len(act) == 2 && act[0] != leases[0] && act[0] == act[1] {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the nodes to be re-registered, got %v", act)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if err := r.Deregister(service); err != nil {
+		t.Fatal(err)
+	}
+	if act := lease(); len(act) != 0 {
+		t.Fatalf("Expected the nodes to be deregistered, got %v", act)
+	}
+}
+
+func TestSessionContext(t *testing.T) {
+	r := NewRegistry(registry.Addrs(etcdAddr(t)), Session(2*time.Second)).(*etcdRegistry)
+
+	service := &registry.Service{
+		Name:    "session-ctx",
+		Version: "1.0.0",
+		Nodes:   []*registry.Node{{Id: "node-1", Address: "127.0.0.1:8080"}},
+	}
+
+	// the lease of the session is granted with the context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := r.RegisterContext(ctx, service); err == nil {
+		t.Fatal("Expected the cancelled context to fail the session")
+	}
+
+	// the session outlives the context of the call
+	ctx, cancel = context.WithCancel(context.Background())
+	if err := r.RegisterContext(ctx, service); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Deregister(service)
+	cancel()
+
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case <-r.session.Done():
+		t.Fatal("Expected the session to be kept alive")
+	default:
+	}
+}
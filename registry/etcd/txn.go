@@ -0,0 +1,269 @@
+package etcd
+
+import (
+	"context"
+	"fmt"
+
+	hash "github.com/mitchellh/hashstructure"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/client/v3"
+
+	"github.com/hb-go/grpc-contrib/registry"
+)
+
+// etcdNode is a node of a registration, stored as a service of the single node
+type etcdNode struct {
+	key     string
+	service *registry.Service
+	val     string
+	hash    uint64
+}
+
+func (e *etcdRegistry) newNode(key string, service *registry.Service) (*etcdNode, error) {
+	// create hash of service; uint64
+	h, err := hash.Hash(service.Nodes[0], nil)
+	if err != nil {
+		return nil, err
+	}
+
+	val, err := e.codec.Marshal(service)
+	if err != nil {
+		return nil, err
+	}
+
+	return &etcdNode{key: key, service: service, val: string(val), hash: h}, nil
+}
+
+// newNodes splits the service into its nodes
+func (e *etcdRegistry) newNodes(ns string, s *registry.Service) ([]*etcdNode, error) {
+	nodes := make([]*etcdNode, 0, len(s.Nodes))
+	for _, node := range s.Nodes {
+		service := &registry.Service{
+			Name:     s.Name,
+			Version:  s.Version,
+			Metadata: s.Metadata,
+			Methods:  s.Methods,
+			Nodes:    []*registry.Node{node},
+		}
+
+		n, err := e.newNode(e.nodePath(ns, s.Name, node.Id), service)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
+
+// sharedLease returns the lease the nodes were put with,
+// false if a node is not registered or they have different leases
+func (e *etcdRegistry) sharedLease(nodes []*etcdNode) (clientv3.LeaseID, bool) {
+	e.RLock()
+	defer e.RUnlock()
+
+	var lease clientv3.LeaseID
+	for i, n := range nodes {
+		if _, ok := e.register[n.key]; !ok {
+			return clientv3.NoLease, false
+		}
+		if i > 0 && e.leases[n.key] != lease {
+			return clientv3.NoLease, false
+		}
+		lease = e.leases[n.key]
+	}
+	return lease, true
+}
+
+// unchanged reports whether the nodes are registered as they are
+func (e *etcdRegistry) unchanged(nodes []*etcdNode) bool {
+	e.RLock()
+	defer e.RUnlock()
+
+	for _, n := range nodes {
+		if h, ok := e.register[n.key]; !ok || h != n.hash {
+			return false
+		}
+	}
+	return true
+}
+
+// getNodes gets the keys of the nodes in one transaction, nil if a node has no key
+func (e *etcdRegistry) getNodes(ctx context.Context, nodes []*etcdNode) ([]*mvccpb.KeyValue, error) {
+	gets := make([]clientv3.Op, 0, len(nodes))
+	for _, n := range nodes {
+		gets = append(gets, clientv3.OpGet(n.key))
+	}
+
+	rsp, err := e.client.Txn(ctx).Then(gets...).Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	kvs := make([]*mvccpb.KeyValue, len(nodes))
+	for i, r := range rsp.Responses {
+		if rr := r.GetResponseRange(); len(rr.Kvs) > 0 {
+			kvs[i] = rr.Kvs[0]
+		}
+	}
+	return kvs, nil
+}
+
+// sameNode reports whether the key holds the node, e.g. put by
+// this process before a restart
+func (e *etcdRegistry) sameNode(n *etcdNode, kv *mvccpb.KeyValue) bool {
+	s := decode(e.codec, kv.Key, kv.Value)
+	if s == nil || len(s.Nodes) == 0 {
+		return false
+	}
+
+	h, err := hash.Hash(s.Nodes[0], nil)
+	return err == nil && h == n.hash
+}
+
+// adopt adopts the leases of the keys of the nodes which hold the nodes
+// already but are unknown to the registry, e.g. after a restart. So the
+// leases are renewed instead of granting new ones.
+func (e *etcdRegistry) adopt(ctx context.Context, nodes []*etcdNode) error {
+	var missing []*etcdNode
+	e.RLock()
+	for _, n := range nodes {
+		if _, ok := e.register[n.key]; !ok {
+			missing = append(missing, n)
+		}
+	}
+	e.RUnlock()
+
+	if len(missing) == 0 {
+		return nil
+	}
+
+	kvs, err := e.getNodes(ctx, missing)
+	if err != nil {
+		return err
+	}
+
+	e.Lock()
+	defer e.Unlock()
+	for i, kv := range kvs {
+		if kv == nil || !e.sameNode(missing[i], kv) {
+			continue
+		}
+
+		// save the info
+		e.register[missing[i].key] = missing[i].hash
+		if kv.Lease != 0 {
+			e.leases[missing[i].key] = clientv3.LeaseID(kv.Lease)
+		} else {
+			delete(e.leases, missing[i].key)
+		}
+	}
+	return nil
+}
+
+// owns reports whether the key was put by the registry, with its lease or without one
+func (e *etcdRegistry) owns(key string, lease clientv3.LeaseID) bool {
+	e.RLock()
+	defer e.RUnlock()
+
+	if lease == clientv3.NoLease {
+		_, ok := e.register[key]
+		return ok
+	}
+
+	for _, l := range e.leases {
+		if l == lease {
+			return true
+		}
+	}
+	return false
+}
+
+// compareOwned returns the comparisons which hold while no node
+// is owned by another registration. A node is owned by the registry if
+// it was put by the registry or the key holds the node as it is.
+func (e *etcdRegistry) compareOwned(ctx context.Context, nodes []*etcdNode) ([]clientv3.Cmp, error) {
+	kvs, err := e.getNodes(ctx, nodes)
+	if err != nil {
+		return nil, err
+	}
+
+	cmps := make([]clientv3.Cmp, 0, len(nodes))
+	for i, kv := range kvs {
+		key := nodes[i].key
+		if kv == nil {
+			cmps = append(cmps, clientv3.Compare(clientv3.CreateRevision(key), "=", 0))
+			continue
+		}
+
+		lease := clientv3.LeaseID(kv.Lease)
+		if !e.owns(key, lease) && !e.sameNode(nodes[i], kv) {
+			return nil, fmt.Errorf("%w: %s lease %x", ErrNodeOwned, key, lease)
+		}
+		cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(key), "=", kv.ModRevision))
+	}
+
+	return cmps, nil
+}
+
+// commit commits the operations on the nodes in one transaction,
+// with CompareAndSwap only if no node is owned by another lease
+func (e *etcdRegistry) commit(ctx context.Context, nodes []*etcdNode, ops []clientv3.Op) error {
+	txn := e.client.Txn(ctx)
+	if e.cas {
+		cmps, err := e.compareOwned(ctx, nodes)
+		if err != nil {
+			return err
+		}
+		txn = txn.If(cmps...)
+	}
+
+	rsp, err := txn.Then(ops...).Commit()
+	if err != nil {
+		return err
+	}
+	if !rsp.Succeeded {
+		return fmt.Errorf("%w: the nodes were modified concurrently", ErrNodeOwned)
+	}
+
+	return nil
+}
+
+// putNodes puts the nodes with the lease in one transaction
+func (e *etcdRegistry) putNodes(ctx context.Context, nodes []*etcdNode, lease clientv3.LeaseID) error {
+	ops := make([]clientv3.Op, 0, len(nodes))
+	for _, n := range nodes {
+		if lease != clientv3.NoLease {
+			ops = append(ops, clientv3.OpPut(n.key, n.val, clientv3.WithLease(lease)))
+		} else {
+			ops = append(ops, clientv3.OpPut(n.key, n.val))
+		}
+	}
+
+	if err := e.commit(ctx, nodes, ops); err != nil {
+		return err
+	}
+
+	e.Lock()
+	for _, n := range nodes {
+		// save our hash and leaseID of the service
+		e.register[n.key] = n.hash
+		if lease != clientv3.NoLease {
+			e.leases[n.key] = lease
+		} else {
+			delete(e.leases, n.key)
+		}
+	}
+	e.Unlock()
+
+	return nil
+}
+
+// deleteNodes deletes the nodes in one transaction
+func (e *etcdRegistry) deleteNodes(ctx context.Context, nodes []*etcdNode) error {
+	ops := make([]clientv3.Op, 0, len(nodes))
+	for _, n := range nodes {
+		ops = append(ops, clientv3.OpDelete(n.key))
+	}
+
+	return e.commit(ctx, nodes, ops)
+}
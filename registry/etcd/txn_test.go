@@ -0,0 +1,222 @@
+package etcd
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/client/v3"
+
+	"github.com/hb-go/grpc-contrib/registry"
+)
+
+func TestRegisterTxn(t *testing.T) {
+	r := NewRegistry(registry.Addrs(etcdAddr(t))).(*etcdRegistry)
+
+	service := &registry.Service{
+		Name:    "txn",
+		Version: "1.0.0",
+		Nodes: []*registry.Node{
+			{Id: "node-1", Address: "127.0.0.1:8080"},
+			{Id: "node-2", Address: "127.0.0.1:8081"},
+		},
+	}
+
+	if err := r.Register(service, registry.RegisterTTL(10*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Deregister(service)
+
+	rsp, err := r.client.Get(context.TODO(), r.servicePath("", service.Name)+"/", clientv3.WithPrefix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rsp.Kvs) != 2 || rsp.Kvs[0].Lease == 0 || rsp.Kvs[0].Lease != rsp.Kvs[1].Lease {
+		t.Fatalf("Expected 2 nodes sharing a lease, got %v", rsp.Kvs)
+	}
+	// the nodes are put in one revision
+	if rsp.Kvs[0].ModRevision != rsp.Kvs[1].ModRevision {
+		t.Fatalf("Expected the nodes to be put in one transaction, got revisions %d and %d", rsp.Kvs[0].ModRevision, rsp.Kvs[1].ModRevision)
+	}
+
+	// unchanged nodes keep the lease
+	if err := r.Register(service, registry.RegisterTTL(10*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if exp, act := clientv3.LeaseID(rsp.Kvs[0].Lease), r.leases[string(rsp.Kvs[1].Key)]; exp != act {
+		t.Fatalf("Expected lease %x, got %x", exp, act)
+	}
+
+	if err := r.Deregister(service); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.GetService(service.Name); err != registry.ErrNotFound {
+		t.Fatalf("Expected %v, got %v", registry.ErrNotFound, err)
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	addr := etcdAddr(t)
+
+	owner := NewRegistry(registry.Addrs(addr))
+	dup := NewRegistry(registry.Addrs(addr), CompareAndSwap())
+
+	service := &registry.Service{
+		Name:    "cas",
+		Version: "1.0.0",
+		Nodes:   []*registry.Node{{Id: "node-1", Address: "127.0.0.1:8080"}},
+	}
+	other := &registry.Service{
+		Name:    "cas",
+		Version: "1.0.0",
+		Nodes: []*registry.Node{
+			{Id: "node-2", Address: "127.0.0.1:8082"},
+			{Id: "node-1", Address: "127.0.0.1:8081"},
+		},
+	}
+
+	if err := owner.Register(service, registry.RegisterTTL(10*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	defer owner.Deregister(service)
+
+	// the duplicate Id is refused, none of the nodes is registered
+	if err := dup.Register(other, registry.RegisterTTL(10*time.Second)); !errors.Is(err, ErrNodeOwned) {
+		t.Fatalf("Expected %v, got %v", ErrNodeOwned, err)
+	}
+	if err := dup.Deregister(other); !errors.Is(err, ErrNodeOwned) {
+		t.Fatalf("Expected %v, got %v", ErrNodeOwned, err)
+	}
+
+	services, err := owner.GetService(service.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 1 || len(services[0].Nodes) != 1 || services[0].Nodes[0].Address != "127.0.0.1:8080" {
+		t.Fatalf("Expected the node of the owner only, got %+v", services)
+	}
+
+	// the node is free once the owner deregistered it
+	if err := owner.Deregister(service); err != nil {
+		t.Fatal(err)
+	}
+	if err := dup.Register(other, registry.RegisterTTL(10*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	defer dup.Deregister(other)
+
+	// and the own nodes are updated
+	other.Nodes[0].Address = "127.0.0.1:8083"
+	if err := dup.Register(other, registry.RegisterTTL(10*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if err := dup.Deregister(other); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRegisterAdoptLease(t *testing.T) {
+	r := NewRegistry(registry.Addrs(etcdAddr(t)), CompareAndSwap()).(*etcdRegistry)
+
+	service := &registry.Service{
+		Name:    "adopt",
+		Version: "1.0.0",
+		Nodes:   []*registry.Node{{Id: "node-1", Address: "127.0.0.1:8080"}},
+	}
+	key := r.nodePath("", service.Name, "node-1")
+
+	if err := r.Register(service, registry.RegisterTTL(10*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Deregister(service)
+	lease := r.leases[key]
+
+	// the process restarted, the lease of its node is adopted
+	r.leases = make(map[string]clientv3.LeaseID)
+	r.register = make(map[string]uint64)
+	if err := r.Register(service, registry.RegisterTTL(10*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if exp, act := lease, r.leases[key]; exp != act {
+		t.Fatalf("Expected lease %x, got %x", exp, act)
+	}
+
+	// the nodes put without a lease are owned as well
+	if err := r.Register(service); err != nil {
+		t.Fatal(err)
+	}
+	r.leases = make(map[string]clientv3.LeaseID)
+	r.register = make(map[string]uint64)
+	if err := r.Register(service); err != nil {
+		t.Fatal(err)
+	}
+
+	r.leases = make(map[string]clientv3.LeaseID)
+	r.register = make(map[string]uint64)
+	if err := r.Deregister(service); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.GetService(service.Name); err != registry.ErrNotFound {
+		t.Fatalf("Expected %v, got %v", registry.ErrNotFound, err)
+	}
+}
+
+func TestRegisterLeaseTTL(t *testing.T) {
+	r := NewRegistry(registry.Addrs(etcdAddr(t))).(*etcdRegistry)
+
+	service := &registry.Service{
+		Name:    "lease-ttl",
+		Version: "1.0.0",
+		Nodes:   []*registry.Node{{Id: "node-1", Address: "127.0.0.1:8080"}},
+	}
+	key := r.nodePath("", service.Name, "node-1")
+	defer r.Deregister(service)
+
+	lease := func() clientv3.LeaseID {
+		rsp, err := r.client.Get(context.TODO(), key)
+		if err != nil || len(rsp.Kvs) == 0 {
+			t.Fatalf("Expected the node, got %v", err)
+		}
+		return clientv3.LeaseID(rsp.Kvs[0].Lease)
+	}
+
+	// the node put without a lease is adopted after a restart
+	if err := r.Register(service); err != nil {
+		t.Fatal(err)
+	}
+	r.leases = make(map[string]clientv3.LeaseID)
+	r.register = make(map[string]uint64)
+	r.ttls = make(map[string]int64)
+
+	// a ttl puts the unchanged node with a lease
+	if err := r.Register(service, registry.RegisterTTL(10*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	first := lease()
+	if first == clientv3.NoLease {
+		t.Fatal("Expected the node to be put with a lease")
+	}
+
+	// the same ttl keeps the lease, another one grants a new one
+	if err := r.Register(service, registry.RegisterTTL(10*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if exp, act := first, lease(); exp != act {
+		t.Fatalf("Expected lease %x, got %x", exp, act)
+	}
+	if err := r.Register(service, registry.RegisterTTL(20*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if act := lease(); act == first || act == clientv3.NoLease {
+		t.Fatalf("Expected a new lease, got %x", act)
+	}
+
+	// no ttl puts the node without a lease
+	if err := r.Register(service); err != nil {
+		t.Fatal(err)
+	}
+	if exp, act := clientv3.NoLease, lease(); exp != act {
+		t.Fatalf("Expected no lease, got %x", act)
+	}
+}
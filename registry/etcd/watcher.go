@@ -2,91 +2,269 @@ package etcd
 
 import (
 	"context"
-	"errors"
 	"time"
 
+	"go.etcd.io/etcd/api/v3/mvccpb"
 	"go.etcd.io/etcd/client/v3"
+	"google.golang.org/grpc/grpclog"
 
 	"github.com/hb-go/grpc-contrib/registry"
 )
 
+// retryInterval is the delay before the watch is re-established after an error
+var retryInterval = time.Second
+
+// watchNode is a node key seen by the watcher
+type watchNode struct {
+	modRevision int64
+	service     *registry.Service
+}
+
 type etcdWatcher struct {
-	stop    chan bool
-	w       clientv3.WatchChan
-	client  *clientv3.Client
-	timeout time.Duration
+	client    *clientv3.Client
+	codec     registry.Codec
+	timeout   time.Duration
+	watchPath string
+	// key prefix of the namespace, the keys of other namespaces are skipped
+	nsPath string
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	w           clientv3.WatchChan
+	watchCancel context.CancelFunc
+
+	// revision of the last change seen, the watch resumes after it
+	rev int64
+	// node key -> node, used to diff the state after a compaction
+	nodes map[string]*watchNode
+	// results of the last batch not returned yet
+	pending []*registry.Result
 }
 
-func newEtcdWatcher(r *etcdRegistry, timeout time.Duration, opts ...registry.WatchOption) (registry.Watcher, error) {
+func newEtcdWatcher(ctx context.Context, r *etcdRegistry, timeout time.Duration, opts ...registry.WatchOption) (registry.Watcher, error) {
 	var wo registry.WatchOptions
 	for _, o := range opts {
 		o(&wo)
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	stop := make(chan bool, 1)
+	ns := r.namespace(ctx)
+	nsPath := r.namespacePath(ns)
+
+	watchPath := nsPath
+	if len(wo.Service) > 0 {
+		watchPath = r.servicePath(ns, wo.Service) + "/"
+	}
+
+	// the watch is canceled by Stop or when the context is done
+	ctx, cancel := context.WithCancel(ctx)
 
-	go func() {
-		<-stop
+	ew := &etcdWatcher{
+		client:    r.client,
+		codec:     r.codec,
+		timeout:   timeout,
+		watchPath: watchPath,
+		nsPath:    nsPath,
+		ctx:       ctx,
+		cancel:    cancel,
+		nodes:     make(map[string]*watchNode),
+	}
+
+	// the current state is the baseline, the watch starts after its revision
+	if _, err := ew.resync(); err != nil {
 		cancel()
-	}()
+		return nil, err
+	}
 
-	watchPath := prefix
-	if len(wo.Service) > 0 {
-		watchPath = servicePath(wo.Service) + "/"
+	ew.watch()
+
+	return ew, nil
+}
+
+// watch (re-)establishes the watch after the last revision seen
+func (ew *etcdWatcher) watch() {
+	if ew.watchCancel != nil {
+		ew.watchCancel()
+	}
+
+	ctx, cancel := context.WithCancel(ew.ctx)
+	ew.watchCancel = cancel
+	ew.w = ew.client.Watch(ctx, ew.watchPath,
+		clientv3.WithPrefix(),
+		clientv3.WithPrevKV(),
+		clientv3.WithRev(ew.rev+1),
+	)
+}
+
+// resync reads the current state and returns the changes since the nodes seen
+func (ew *etcdWatcher) resync() ([]*registry.Result, error) {
+	ctx, cancel := context.WithTimeout(ew.ctx, ew.timeout)
+	defer cancel()
+
+	rsp, err := ew.client.Get(ctx, ew.watchPath, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := make(map[string]*watchNode, len(rsp.Kvs))
+	for _, kv := range rsp.Kvs {
+		if !isNodeKey(ew.nsPath, string(kv.Key)) {
+			continue
+		}
+		if s := decode(ew.codec, kv.Key, kv.Value); s != nil {
+			nodes[string(kv.Key)] = &watchNode{modRevision: kv.ModRevision, service: s}
+		}
+	}
+
+	results := diffNodes(ew.nodes, nodes, uint64(rsp.Header.Revision))
+
+	ew.nodes = nodes
+	ew.rev = rsp.Header.Revision
+
+	return results, nil
+}
+
+// diffNodes returns the results which turn the old nodes into the new ones
+func diffNodes(old, new map[string]*watchNode, rev uint64) []*registry.Result {
+	var results []*registry.Result
+
+	for key, n := range new {
+		o, ok := old[key]
+		switch {
+		case !ok:
+			results = append(results, newResult(registry.Create, n.service, rev))
+		case o.modRevision != n.modRevision:
+			results = append(results, newResult(registry.Update, n.service, rev))
+		}
+	}
+
+	for key, o := range old {
+		if _, ok := new[key]; !ok {
+			results = append(results, newResult(registry.Delete, o.service, rev))
+		}
 	}
 
-	return &etcdWatcher{
-		stop:    stop,
-		w:       r.client.Watch(ctx, watchPath, clientv3.WithPrefix(), clientv3.WithPrevKV()),
-		client:  r.client,
-		timeout: timeout,
-	}, nil
+	return results
+}
+
+// newResult returns a result at the etcd revision
+func newResult(t registry.EventType, s *registry.Service, rev uint64) *registry.Result {
+	r := registry.NewResult(t, s)
+	r.Revision = rev
+	return r
+}
+
+// handle buffers the result of an event of the batch
+func (ew *etcdWatcher) handle(ev *clientv3.Event) {
+	key := string(ev.Kv.Key)
+	ew.rev = ev.Kv.ModRevision
+
+	if !isNodeKey(ew.nsPath, key) {
+		return
+	}
+
+	switch ev.Type {
+	case mvccpb.PUT:
+		service := decode(ew.codec, ev.Kv.Key, ev.Kv.Value)
+		if service == nil {
+			return
+		}
+
+		action := registry.Update
+		if _, ok := ew.nodes[key]; !ok || ev.IsCreate() {
+			action = registry.Create
+		}
+
+		ew.nodes[key] = &watchNode{modRevision: ev.Kv.ModRevision, service: service}
+		ew.pending = append(ew.pending, newResult(action, service, uint64(ev.Kv.ModRevision)))
+	case mvccpb.DELETE:
+		// get service from prevKv, or the node seen if it was compacted
+		var service *registry.Service
+		if ev.PrevKv != nil {
+			service = decode(ew.codec, ev.PrevKv.Key, ev.PrevKv.Value)
+		}
+		if n, ok := ew.nodes[key]; ok {
+			if service == nil {
+				service = n.service
+			}
+			delete(ew.nodes, key)
+		}
+		if service == nil {
+			return
+		}
+
+		ew.pending = append(ew.pending, newResult(registry.Delete, service, uint64(ev.Kv.ModRevision)))
+	}
+}
+
+// wait waits for the retry interval, false if the watcher is stopped
+func (ew *etcdWatcher) wait() bool {
+	select {
+	case <-ew.ctx.Done():
+		return false
+	case <-time.After(retryInterval):
+		return true
+	}
 }
 
 func (ew *etcdWatcher) Next() (*registry.Result, error) {
-	for wresp := range ew.w {
-		if wresp.Err() != nil {
-			return nil, wresp.Err()
+	for {
+		if len(ew.pending) > 0 {
+			r := ew.pending[0]
+			ew.pending = ew.pending[1:]
+			return r, nil
 		}
-		if wresp.Canceled {
-			return nil, errors.New("could not get next")
+
+		var wresp clientv3.WatchResponse
+		var ok bool
+
+		select {
+		case <-ew.ctx.Done():
+			return nil, registry.ErrWatcherStopped
+		case wresp, ok = <-ew.w:
+		}
+
+		if ew.ctx.Err() != nil {
+			return nil, registry.ErrWatcherStopped
 		}
-		for _, ev := range wresp.Events {
-			service := decode(ev.Kv.Value)
-			var action string
-
-			switch ev.Type {
-			case clientv3.EventTypePut:
-				if ev.IsCreate() {
-					action = "create"
-				} else if ev.IsModify() {
-					action = "update"
+
+		switch {
+		case ok && wresp.CompactRevision > 0:
+			// the revision was compacted, the changes in between are lost
+			grpclog.Warningf("grpc-contrib.registry: etcd watch revision %d compacted, resync", ew.rev)
+
+			results, err := ew.resync()
+			for err != nil {
+				grpclog.Warningf("grpc-contrib.registry: etcd resync error: %v", err)
+				if !ew.wait() {
+					return nil, registry.ErrWatcherStopped
 				}
-			case clientv3.EventTypeDelete:
-				action = "delete"
+				results, err = ew.resync()
+			}
 
-				// get service from prevKv
-				service = decode(ev.PrevKv.Value)
+			ew.pending = append(ew.pending, results...)
+			ew.watch()
+		case !ok || wresp.Canceled || wresp.Err() != nil:
+			if ok {
+				grpclog.Warningf("grpc-contrib.registry: etcd watch error: %v", wresp.Err())
+			}
+			if !ew.wait() {
+				return nil, registry.ErrWatcherStopped
 			}
 
-			if service == nil {
-				continue
+			// resume after the last revision seen
+			ew.watch()
+		default:
+			for _, ev := range wresp.Events {
+				ew.handle(ev)
+			}
+			if len(wresp.Events) == 0 && wresp.IsProgressNotify() {
+				ew.rev = wresp.Header.Revision
 			}
-			return &registry.Result{
-				Action:  action,
-				Service: service,
-			}, nil
 		}
 	}
-	return nil, errors.New("could not get next")
 }
 
 func (ew *etcdWatcher) Stop() {
-	select {
-	case <-ew.stop:
-		return
-	default:
-		close(ew.stop)
-	}
+	ew.cancel()
 }
@@ -5,9 +5,109 @@ import (
 	"testing"
 	"time"
 
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/client/v3"
+
 	"github.com/hb-go/grpc-contrib/registry"
 )
 
+func newTestNode(id string) *registry.Service {
+	return &registry.Service{
+		Name:    "test1",
+		Version: "1.0.1",
+		Nodes:   []*registry.Node{{Id: id, Address: "127.0.0.1:8080"}},
+	}
+}
+
+func TestWatcherBatch(t *testing.T) {
+	r := &etcdRegistry{prefix: DefaultPrefix}
+	ew := &etcdWatcher{codec: registry.JSONCodec, nsPath: r.namespacePath(""), nodes: make(map[string]*watchNode)}
+
+	kv := func(id string, create, mod int64) *mvccpb.KeyValue {
+		val, err := registry.JSONCodec.Marshal(newTestNode(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &mvccpb.KeyValue{
+			Key:            []byte(r.nodePath("", "test1", id)),
+			Value:          val,
+			CreateRevision: create,
+			ModRevision:    mod,
+		}
+	}
+
+	// one batch of events
+	events := []*clientv3.Event{
+		{Type: mvccpb.PUT, Kv: kv("node-1", 2, 2)},
+		{Type: mvccpb.PUT, Kv: kv("node-2", 3, 3)},
+		{Type: mvccpb.PUT, Kv: kv("node-1", 2, 4)},
+		{Type: mvccpb.DELETE, Kv: &mvccpb.KeyValue{Key: []byte(r.nodePath("", "test1", "node-2")), ModRevision: 5}},
+	}
+	for _, ev := range events {
+		ew.handle(ev)
+	}
+
+	exp := []struct {
+		action registry.EventType
+		id     string
+		rev    uint64
+	}{
+		{registry.Create, "node-1", 2},
+		{registry.Create, "node-2", 3},
+		{registry.Update, "node-1", 4},
+		// the node seen is deleted without the prevKv
+		{registry.Delete, "node-2", 5},
+	}
+
+	if len(ew.pending) != len(exp) {
+		t.Fatalf("Expected %d results, got %d", len(exp), len(ew.pending))
+	}
+	for i, e := range exp {
+		res := ew.pending[i]
+		if res.Type != e.action || res.Service.Nodes[0].Id != e.id || res.Revision != e.rev {
+			t.Fatalf("Expected %v %s at %d, got %v %s at %d", e.action, e.id, e.rev, res.Type, res.Service.Nodes[0].Id, res.Revision)
+		}
+	}
+	if exp, act := int64(5), ew.rev; exp != act {
+		t.Fatalf("Expected revision %d, got %d", exp, act)
+	}
+}
+
+func TestDiffNodes(t *testing.T) {
+	old := map[string]*watchNode{
+		"node-1": {modRevision: 2, service: newTestNode("node-1")},
+		"node-2": {modRevision: 3, service: newTestNode("node-2")},
+		"node-3": {modRevision: 4, service: newTestNode("node-3")},
+	}
+	new := map[string]*watchNode{
+		"node-1": {modRevision: 2, service: newTestNode("node-1")},
+		"node-2": {modRevision: 6, service: newTestNode("node-2")},
+		"node-4": {modRevision: 7, service: newTestNode("node-4")},
+	}
+
+	actions := make(map[string]registry.EventType)
+	for _, res := range diffNodes(old, new, 10) {
+		if res.Revision != 10 {
+			t.Fatalf("Expected revision 10, got %d", res.Revision)
+		}
+		actions[res.Service.Nodes[0].Id] = res.Type
+	}
+
+	exp := map[string]registry.EventType{
+		"node-2": registry.Update,
+		"node-3": registry.Delete,
+		"node-4": registry.Create,
+	}
+	if len(actions) != len(exp) {
+		t.Fatalf("Expected %d results, got %d", len(exp), len(actions))
+	}
+	for id, action := range exp {
+		if actions[id] != action {
+			t.Fatalf("Expected %v for %s, got %v", action, id, actions[id])
+		}
+	}
+}
+
 func TestWatcher(t *testing.T) {
 	if travis := os.Getenv("TRAVIS"); travis == "true" {
 		t.Skip()
@@ -0,0 +1,236 @@
+// Package file provides a static service registry backed by a JSON or YAML file
+package file
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"sigs.k8s.io/yaml"
+
+	"github.com/hb-go/grpc-contrib/registry"
+)
+
+const schema = "file"
+const queryValSeq = "|"
+
+var (
+	// DefaultPollInterval is the interval the watchers check the file for changes
+	DefaultPollInterval = 5 * time.Second
+
+	// ErrReadOnly is returned by Register and Deregister
+	ErrReadOnly = errors.New("file registry is read-only")
+)
+
+type fileRegistry struct {
+	options  registry.Options
+	path     string
+	interval time.Duration
+
+	sync.RWMutex
+	// sum is the hash of the content the services are decoded from
+	sum      [sha256.Size]byte
+	services []*registry.Service
+}
+
+// NewRegistry returns a registry which loads []*registry.Service from
+// the file set by the Path option, the file is reloaded when it changes.
+func NewRegistry(opts ...registry.Option) registry.Registry {
+	f := &fileRegistry{
+		options:  registry.Options{},
+		interval: DefaultPollInterval,
+	}
+	configure(f, opts...)
+	return f
+}
+
+func configure(f *fileRegistry, opts ...registry.Option) {
+	for _, o := range opts {
+		o(&f.options)
+	}
+
+	// the scheme of the targets and the resolver builder
+	if len(f.options.Scheme) == 0 {
+		f.options.Scheme = schema
+	}
+
+	if f.options.Context != nil {
+		if p, ok := f.options.Context.Value(pathKey{}).(string); ok {
+			f.path = p
+		}
+		if t, ok := f.options.Context.Value(pollIntervalKey{}).(time.Duration); ok {
+			f.interval = t
+		}
+	}
+
+	// fallback to the first address
+	if len(f.path) == 0 && len(f.options.Addrs) > 0 {
+		f.path = f.options.Addrs[0]
+	}
+
+	// force a reload
+	f.Lock()
+	f.sum = [sha256.Size]byte{}
+	f.services = nil
+	f.Unlock()
+}
+
+// decode parses the file content, services with the same
+// name and version are merged into one.
+func decode(path string, b []byte) ([]*registry.Service, error) {
+	var services []*registry.Service
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(b, &services); err != nil {
+			return nil, err
+		}
+	case ".json":
+		if err := json.Unmarshal(b, &services); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported file format: %s", path)
+	}
+
+	// the entries of a version of a service are merged
+	type version struct {
+		name    string
+		version string
+	}
+
+	versions := make(map[version]*registry.Service)
+	merged := make([]*registry.Service, 0, len(services))
+	for _, s := range services {
+		if s == nil || len(s.Name) == 0 {
+			continue
+		}
+
+		key := version{name: s.Name, version: s.Version}
+		v, ok := versions[key]
+		if !ok {
+			versions[key] = s
+			merged = append(merged, s)
+			continue
+		}
+		v.Nodes = append(v.Nodes, s.Nodes...)
+	}
+
+	return merged, nil
+}
+
+// load returns the current snapshot of the file, the file is only parsed
+// again if its content changed. The content is compared by a hash, the
+// modification time and size miss a rewrite of the same size within the
+// resolution of the time.
+func (f *fileRegistry) load() ([]*registry.Service, error) {
+	if len(f.path) == 0 {
+		return nil, errors.New("file path is not set")
+	}
+
+	b, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(b)
+
+	f.RLock()
+	if f.services != nil && sum == f.sum {
+		services := f.services
+		f.RUnlock()
+		return services, nil
+	}
+	f.RUnlock()
+
+	services, err := decode(f.path, b)
+	if err != nil {
+		return nil, err
+	}
+
+	f.Lock()
+	f.sum = sum
+	f.services = services
+	f.Unlock()
+
+	return services, nil
+}
+
+func (f *fileRegistry) Init(opts ...registry.Option) error {
+	configure(f, opts...)
+	return nil
+}
+
+func (f *fileRegistry) Options() registry.Options {
+	return f.options
+}
+
+// NewTarget return grpc.Dial target
+func (f *fileRegistry) NewTarget(s *registry.Service, opts ...registry.Option) string {
+	options := registry.Options{}
+	for _, o := range opts {
+		o(&options)
+	}
+
+	if len(options.Versions) == 0 {
+		return f.options.Scheme + ":///" + s.Name
+	}
+
+	return f.options.Scheme + ":///" + s.Name + "?version=" + strings.Join(options.Versions, queryValSeq)
+}
+
+func (f *fileRegistry) Register(*registry.Service, ...registry.RegisterOption) error {
+	return ErrReadOnly
+}
+
+func (f *fileRegistry) Deregister(*registry.Service) error {
+	return ErrReadOnly
+}
+
+func (f *fileRegistry) GetService(name string) ([]*registry.Service, error) {
+	services, err := f.load()
+	if err != nil {
+		return nil, err
+	}
+
+	var rsp []*registry.Service
+	for _, s := range services {
+		if s.Name == name {
+			rsp = append(rsp, registry.CopyService(s))
+		}
+	}
+
+	if len(rsp) == 0 {
+		return nil, registry.ErrNotFound
+	}
+
+	return rsp, nil
+}
+
+func (f *fileRegistry) ListServices() ([]*registry.Service, error) {
+	services, err := f.load()
+	if err != nil {
+		return nil, err
+	}
+
+	rsp := registry.Copy(services)
+
+	// sort the services
+	sort.Slice(rsp, func(i, j int) bool { return rsp[i].Name < rsp[j].Name })
+
+	return rsp, nil
+}
+
+func (f *fileRegistry) Watch(opts ...registry.WatchOption) (registry.Watcher, error) {
+	return newFileWatcher(f, opts...)
+}
+
+func (f *fileRegistry) String() string {
+	return "file"
+}
@@ -0,0 +1,161 @@
+package file
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hb-go/grpc-contrib/registry"
+)
+
+const testYAML = `
+- name: foo
+  version: v1
+  nodes:
+    - id: foo-1
+      address: 127.0.0.1:8080
+- name: foo
+  version: v2
+  nodes:
+    - id: foo-2
+      address: 127.0.0.1:8081
+      metadata:
+        zone: a
+`
+
+const testJSON = `[
+  {"name": "foo", "version": "v1", "nodes": [
+    {"id": "foo-1", "address": "127.0.0.1:8080"},
+    {"id": "foo-3", "address": "127.0.0.1:8082"}
+  ]}
+]`
+
+func writeFile(t *testing.T, path, data string, mod time.Time) {
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, mod, mod); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "services.yaml")
+	writeFile(t, path, testYAML, time.Now().Add(-time.Minute))
+
+	r := NewRegistry(Path(path))
+
+	services, err := r.GetService("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp, act := 2, len(services); exp != act {
+		t.Fatalf("Expected %d versions, got %d", exp, act)
+	}
+
+	if _, err := r.GetService("bar"); err != registry.ErrNotFound {
+		t.Fatalf("Expected %v, got %v", registry.ErrNotFound, err)
+	}
+
+	if err := r.Register(services[0]); err != ErrReadOnly {
+		t.Fatalf("Expected %v, got %v", ErrReadOnly, err)
+	}
+
+	// a rewrite of the same size and time is reloaded by its content
+	mod := time.Now().Add(-time.Minute)
+	writeFile(t, path, testYAML, mod)
+	if _, err := r.GetService("foo"); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, path, strings.Replace(testYAML, "127.0.0.1:8080", "127.0.0.1:9090", 1), mod)
+
+	services, err = r.GetService("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range services {
+		if s.Version == "v1" {
+			if exp, act := "127.0.0.1:9090", s.Nodes[0].Address; exp != act {
+				t.Fatalf("Expected %s, got %s", exp, act)
+			}
+		}
+	}
+}
+
+func TestFileWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "services.json")
+	writeFile(t, path, `[{"name": "foo", "version": "v1", "nodes": [{"id": "foo-1", "address": "127.0.0.1:8080"}]},
+{"name": "foo", "version": "v2", "nodes": [{"id": "foo-2", "address": "127.0.0.1:8081"}]}]`, time.Now().Add(-time.Minute))
+
+	r := NewRegistry(Path(path), PollInterval(10*time.Millisecond))
+
+	w, err := r.Watch(registry.WatchService("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	writeFile(t, path, testJSON, time.Now())
+
+	expected := map[string]string{
+		"update": "v1",
+		"delete": "v2",
+	}
+
+	for len(expected) > 0 {
+		res, err := w.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		version, ok := expected[res.Action]
+		if !ok {
+			t.Fatalf("Unexpected %s event for %s", res.Action, res.Service.Version)
+		}
+		if version != res.Service.Version {
+			t.Fatalf("Expected %s event for %s, got %s", res.Action, version, res.Service.Version)
+		}
+
+		if res.Action == "update" && len(res.Service.Nodes) != 2 {
+			t.Fatalf("Expected 2 nodes, got %d", len(res.Service.Nodes))
+		}
+		delete(expected, res.Action)
+	}
+}
+
+func TestDecodeMerge(t *testing.T) {
+	services, err := decode("services.json", []byte(`[
+  {"name": "a", "version": "1.0", "nodes": [{"id": "a-1", "address": "127.0.0.1:8080"}]},
+  {"name": "a1", "version": ".0", "nodes": [{"id": "a1-1", "address": "127.0.0.1:8081"}]},
+  {"name": "a", "version": "1.0", "nodes": [{"id": "a-2", "address": "127.0.0.1:8082"}]}
+]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the same name and version are merged, the names don't collide
+	if exp, act := 2, len(services); exp != act {
+		t.Fatalf("Expected %d services, got %d", exp, act)
+	}
+	if exp, act := 2, len(services[0].Nodes); exp != act {
+		t.Fatalf("Expected %d nodes of a, got %d", exp, act)
+	}
+	if exp, act := "a1", services[1].Name; exp != act {
+		t.Fatalf("Expected %s, got %s", exp, act)
+	}
+}
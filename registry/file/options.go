@@ -0,0 +1,36 @@
+package file
+
+import (
+	"context"
+	"time"
+
+	"github.com/hb-go/grpc-contrib/registry"
+)
+
+type pathKey struct{}
+
+type pollIntervalKey struct{}
+
+// Path sets the JSON or YAML file to load services from,
+// the format is picked by the file extension.
+func Path(path string) registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, pathKey{}, path)
+	}
+}
+
+// PollInterval sets how often watchers check the file for changes
+func PollInterval(t time.Duration) registry.Option {
+	return func(o *registry.Options) {
+		if t <= time.Duration(0) {
+			return
+		}
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, pollIntervalKey{}, t)
+	}
+}
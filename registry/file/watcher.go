@@ -0,0 +1,91 @@
+package file
+
+import (
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/grpclog"
+
+	"github.com/hb-go/grpc-contrib/registry"
+)
+
+type fileWatcher struct {
+	r  *fileRegistry
+	wo registry.WatchOptions
+
+	ticker   *time.Ticker
+	exit     chan bool
+	once     sync.Once
+	services []*registry.Service
+	results  []*registry.Result
+}
+
+func newFileWatcher(r *fileRegistry, opts ...registry.WatchOption) (registry.Watcher, error) {
+	var wo registry.WatchOptions
+	for _, o := range opts {
+		o(&wo)
+	}
+
+	fw := &fileWatcher{
+		r:      r,
+		wo:     wo,
+		ticker: time.NewTicker(r.interval),
+		exit:   make(chan bool),
+	}
+
+	// the first snapshot is the baseline, only changes are emitted
+	services, err := r.load()
+	if err != nil {
+		fw.ticker.Stop()
+		return nil, err
+	}
+	fw.services = fw.filter(services)
+
+	return fw, nil
+}
+
+// filter returns a copy of the services the watcher cares about
+func (fw *fileWatcher) filter(services []*registry.Service) []*registry.Service {
+	var rsp []*registry.Service
+	for _, s := range services {
+		if len(fw.wo.Service) > 0 && s.Name != fw.wo.Service {
+			continue
+		}
+		rsp = append(rsp, registry.CopyService(s))
+	}
+	return rsp
+}
+
+func (fw *fileWatcher) Next() (*registry.Result, error) {
+	for {
+		if len(fw.results) > 0 {
+			r := fw.results[0]
+			fw.results = fw.results[1:]
+			return r, nil
+		}
+
+		select {
+		case <-fw.exit:
+			return nil, registry.ErrWatcherStopped
+		case <-fw.ticker.C:
+		}
+
+		services, err := fw.r.load()
+		if err != nil {
+			// keep the last good snapshot, the file may be half written
+			grpclog.Warningf("grpc-contrib.registry: file reload error: %v", err)
+			continue
+		}
+
+		services = fw.filter(services)
+		fw.results = registry.Diff(fw.services, services)
+		fw.services = services
+	}
+}
+
+func (fw *fileWatcher) Stop() {
+	fw.once.Do(func() {
+		close(fw.exit)
+		fw.ticker.Stop()
+	})
+}
@@ -0,0 +1,361 @@
+// Package kubernetes provides a service registry backed by kubernetes EndpointSlices
+package kubernetes
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"github.com/hb-go/grpc-contrib/registry"
+)
+
+const schema = "k8s"
+const queryValSeq = "|"
+
+const (
+	// DefaultVersionLabel is the pod label used as the service version
+	DefaultVersionLabel = "version"
+	// DefaultNamespace is the namespace used if not set
+	DefaultNamespace = "default"
+
+	// zoneKey is the node metadata key of the endpoint zone
+	zoneKey = "zone"
+	// nodeNameKey is the node metadata key of the kubernetes node of the endpoint
+	nodeNameKey = "nodeName"
+)
+
+var (
+	// ErrReadOnly is returned by Register and Deregister
+	ErrReadOnly = errors.New("kubernetes registry is read-only")
+)
+
+type k8sRegistry struct {
+	options registry.Options
+
+	client       kubernetes.Interface
+	namespace    string
+	versionLabel string
+	portName     string
+
+	// err is the error of creating the in-cluster client
+	err error
+}
+
+// NewRegistry returns a registry which builds services from the EndpointSlices
+// of the kubernetes Services, the version and metadata of a node are read from
+// the pod labels. Registration is managed by kubernetes, Register and Deregister
+// return ErrReadOnly.
+func NewRegistry(opts ...registry.Option) registry.Registry {
+	k := &k8sRegistry{
+		options:      registry.Options{},
+		namespace:    DefaultNamespace,
+		versionLabel: DefaultVersionLabel,
+	}
+	configure(k, opts...)
+	return k
+}
+
+func configure(k *k8sRegistry, opts ...registry.Option) {
+	for _, o := range opts {
+		o(&k.options)
+	}
+
+	// the scheme of the targets and the resolver builder
+	if len(k.options.Scheme) == 0 {
+		k.options.Scheme = schema
+	}
+
+	if k.options.Timeout == 0 {
+		k.options.Timeout = 5 * time.Second
+	}
+
+	if k.options.Context != nil {
+		if c, ok := k.options.Context.Value(clientKey{}).(kubernetes.Interface); ok {
+			k.client = c
+		}
+		if ns, ok := k.options.Context.Value(namespaceKey{}).(string); ok && len(ns) > 0 {
+			k.namespace = ns
+		}
+		if l, ok := k.options.Context.Value(versionLabelKey{}).(string); ok && len(l) > 0 {
+			k.versionLabel = l
+		}
+		if p, ok := k.options.Context.Value(portNameKey{}).(string); ok {
+			k.portName = p
+		}
+	}
+
+	if k.client != nil {
+		k.err = nil
+		return
+	}
+
+	// fallback to the in-cluster client
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		k.err = err
+		return
+	}
+	k.client, k.err = kubernetes.NewForConfig(config)
+}
+
+// serviceName converts the service name to a kubernetes Service name
+func serviceName(name string) string {
+	name = strings.ToLower(name)
+	name = strings.Replace(name, ".", "-", -1)
+	name = strings.Replace(name, "_", "-", -1)
+	return name
+}
+
+func (k *k8sRegistry) port(slice *discoveryv1.EndpointSlice) (int32, bool) {
+	var port *discoveryv1.EndpointPort
+	for i, p := range slice.Ports {
+		if p.Port == nil {
+			continue
+		}
+		if port == nil {
+			port = &slice.Ports[i]
+		}
+		if len(k.portName) > 0 && p.Name != nil && *p.Name == k.portName {
+			port = &slice.Ports[i]
+			break
+		}
+	}
+
+	if port == nil {
+		return 0, false
+	}
+	return *port.Port, true
+}
+
+// pods lists the pods of a kubernetes Service by its selector in one call,
+// a Service without a selector has no pods.
+func (k *k8sRegistry) pods(ctx context.Context, name string) (map[string]*corev1.Pod, error) {
+	svc, err := k.client.CoreV1().Services(k.namespace).Get(ctx, serviceName(name), metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if len(svc.Spec.Selector) == 0 {
+		return nil, nil
+	}
+
+	rsp, err := k.client.CoreV1().Pods(k.namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(svc.Spec.Selector).String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	pods := make(map[string]*corev1.Pod, len(rsp.Items))
+	for i := range rsp.Items {
+		pods[rsp.Items[i].Name] = &rsp.Items[i]
+	}
+	return pods, nil
+}
+
+// services converts the EndpointSlices of a kubernetes Service to registry services
+func (k *k8sRegistry) services(ctx context.Context, name string, slices []discoveryv1.EndpointSlice) ([]*registry.Service, error) {
+	serviceMap := map[string]*registry.Service{}
+
+	// the pods are listed once for the labels of the endpoints
+	var pods map[string]*corev1.Pod
+	var listed bool
+
+	for i := range slices {
+		slice := &slices[i]
+
+		port, ok := k.port(slice)
+		if !ok {
+			continue
+		}
+
+		for _, ep := range slice.Endpoints {
+			// only route to ready endpoints
+			if ep.Conditions.Ready != nil && !*ep.Conditions.Ready {
+				continue
+			}
+			if len(ep.Addresses) == 0 {
+				continue
+			}
+
+			address := net.JoinHostPort(ep.Addresses[0], strconv.Itoa(int(port)))
+			id := address
+			md := make(map[string]string)
+			var version string
+
+			if ref := ep.TargetRef; ref != nil && ref.Kind == "Pod" {
+				id = ref.Name
+
+				if !listed {
+					var err error
+					if pods, err = k.pods(ctx, name); err != nil {
+						return nil, err
+					}
+					listed = true
+				}
+
+				if pod, ok := pods[ref.Name]; ok {
+					for lk, lv := range pod.Labels {
+						md[lk] = lv
+					}
+					version = pod.Labels[k.versionLabel]
+				}
+			}
+
+			if ep.Zone != nil {
+				md[zoneKey] = *ep.Zone
+			}
+			if ep.NodeName != nil {
+				md[nodeNameKey] = *ep.NodeName
+			}
+
+			svc, ok := serviceMap[version]
+			if !ok {
+				svc = &registry.Service{
+					Name:    name,
+					Version: version,
+				}
+				serviceMap[version] = svc
+			}
+
+			svc.Nodes = append(svc.Nodes, &registry.Node{
+				Id:       id,
+				Address:  address,
+				Metadata: md,
+			})
+		}
+	}
+
+	services := make([]*registry.Service, 0, len(serviceMap))
+	for _, svc := range serviceMap {
+		sort.Slice(svc.Nodes, func(i, j int) bool { return svc.Nodes[i].Id < svc.Nodes[j].Id })
+		services = append(services, svc)
+	}
+
+	return services, nil
+}
+
+func (k *k8sRegistry) getService(ctx context.Context, name string) ([]*registry.Service, error) {
+	if k.err != nil {
+		return nil, k.err
+	}
+
+	rsp, err := k.client.DiscoveryV1().EndpointSlices(k.namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: discoveryv1.LabelServiceName + "=" + serviceName(name),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return k.services(ctx, name, rsp.Items)
+}
+
+func (k *k8sRegistry) Init(opts ...registry.Option) error {
+	configure(k, opts...)
+	return k.err
+}
+
+func (k *k8sRegistry) Options() registry.Options {
+	return k.options
+}
+
+// NewTarget return grpc.Dial target
+func (k *k8sRegistry) NewTarget(s *registry.Service, opts ...registry.Option) string {
+	options := registry.Options{}
+	for _, o := range opts {
+		o(&options)
+	}
+
+	if len(options.Versions) == 0 {
+		return k.options.Scheme + ":///" + s.Name
+	}
+
+	return k.options.Scheme + ":///" + s.Name + "?version=" + strings.Join(options.Versions, queryValSeq)
+}
+
+// Register isn't supported, the endpoints are managed by kubernetes
+func (k *k8sRegistry) Register(*registry.Service, ...registry.RegisterOption) error {
+	return ErrReadOnly
+}
+
+// Deregister isn't supported, the endpoints are managed by kubernetes
+func (k *k8sRegistry) Deregister(*registry.Service) error {
+	return ErrReadOnly
+}
+
+func (k *k8sRegistry) GetService(name string) ([]*registry.Service, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), k.options.Timeout)
+	defer cancel()
+
+	services, err := k.getService(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(services) == 0 {
+		return nil, registry.ErrNotFound
+	}
+
+	return services, nil
+}
+
+func (k *k8sRegistry) ListServices() ([]*registry.Service, error) {
+	if k.err != nil {
+		return nil, k.err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), k.options.Timeout)
+	defer cancel()
+
+	rsp, err := k.client.DiscoveryV1().EndpointSlices(k.namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: discoveryv1.LabelServiceName,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sliceMap := map[string][]discoveryv1.EndpointSlice{}
+	for _, slice := range rsp.Items {
+		name := slice.Labels[discoveryv1.LabelServiceName]
+		sliceMap[name] = append(sliceMap[name], slice)
+	}
+
+	var services []*registry.Service
+	for name, slices := range sliceMap {
+		svcs, err := k.services(ctx, name, slices)
+		if err != nil {
+			return nil, err
+		}
+		services = append(services, svcs...)
+	}
+
+	// sort the services
+	sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+
+	return services, nil
+}
+
+func (k *k8sRegistry) Watch(opts ...registry.WatchOption) (registry.Watcher, error) {
+	if k.err != nil {
+		return nil, k.err
+	}
+	return newK8sWatcher(k, opts...)
+}
+
+func (k *k8sRegistry) String() string {
+	return "kubernetes"
+}
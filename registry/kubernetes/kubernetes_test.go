@@ -0,0 +1,196 @@
+package kubernetes
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/hb-go/grpc-contrib/registry"
+)
+
+func newPod(name, version string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: DefaultNamespace,
+			Labels: map[string]string{
+				"app":     "foo",
+				"version": version,
+			},
+		},
+	}
+}
+
+func newService() *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: DefaultNamespace},
+		Spec:       corev1.ServiceSpec{Selector: map[string]string{"app": "foo"}},
+	}
+}
+
+func newEndpoint(pod, ip, zone string, ready bool) discoveryv1.Endpoint {
+	return discoveryv1.Endpoint{
+		Addresses:  []string{ip},
+		Conditions: discoveryv1.EndpointConditions{Ready: &ready},
+		TargetRef:  &corev1.ObjectReference{Kind: "Pod", Name: pod, Namespace: DefaultNamespace},
+		Zone:       &zone,
+	}
+}
+
+func newEndpointSlice(endpoints ...discoveryv1.Endpoint) *discoveryv1.EndpointSlice {
+	name := "grpc"
+	port := int32(8080)
+
+	return &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "foo-abc",
+			Namespace: DefaultNamespace,
+			Labels: map[string]string{
+				discoveryv1.LabelServiceName: "foo",
+			},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Endpoints:   endpoints,
+		Ports:       []discoveryv1.EndpointPort{{Name: &name, Port: &port}},
+	}
+}
+
+func TestKubernetesRegistry(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		newService(),
+		newPod("foo-1", "v1"),
+		newPod("foo-2", "v2"),
+		newPod("foo-3", "v2"),
+		newEndpointSlice(
+			newEndpoint("foo-1", "10.0.0.1", "zone-a", true),
+			newEndpoint("foo-2", "10.0.0.2", "zone-b", true),
+			newEndpoint("foo-3", "10.0.0.3", "zone-b", false),
+		),
+	)
+
+	r := NewRegistry(Client(client), PortName("grpc"))
+
+	services, err := r.GetService("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exp, act := 2, len(services); exp != act {
+		t.Fatalf("Expected %d versions, got %d", exp, act)
+	}
+
+	for _, s := range services {
+		if len(s.Nodes) != 1 {
+			t.Fatalf("Expected 1 ready node for version %s, got %d", s.Version, len(s.Nodes))
+		}
+
+		node := s.Nodes[0]
+		switch s.Version {
+		case "v1":
+			if node.Id != "foo-1" || node.Address != "10.0.0.1:8080" || node.Metadata["zone"] != "zone-a" {
+				t.Fatalf("Unexpected node %+v for version %s", node, s.Version)
+			}
+		case "v2":
+			if node.Id != "foo-2" || node.Address != "10.0.0.2:8080" || node.Metadata["app"] != "foo" {
+				t.Fatalf("Unexpected node %+v for version %s", node, s.Version)
+			}
+		default:
+			t.Fatalf("Unexpected version %s", s.Version)
+		}
+	}
+
+	if _, err := r.GetService("bar"); err != registry.ErrNotFound {
+		t.Fatalf("Expected %v, got %v", registry.ErrNotFound, err)
+	}
+
+	// the pods are listed once, not read one by one
+	var gets, lists int
+	for _, a := range client.Actions() {
+		if a.GetResource().Resource != "pods" {
+			continue
+		}
+		switch a.GetVerb() {
+		case "get":
+			gets++
+		case "list":
+			lists++
+		}
+	}
+	if gets != 0 || lists != 1 {
+		t.Fatalf("Expected 1 list of the pods, got %d gets and %d lists", gets, lists)
+	}
+
+	if err := r.Register(services[0]); err != ErrReadOnly {
+		t.Fatalf("Expected %v, got %v", ErrReadOnly, err)
+	}
+}
+
+func TestKubernetesWatcher(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		newService(),
+		newPod("foo-1", "v1"),
+		newPod("foo-2", "v1"),
+		newEndpointSlice(
+			newEndpoint("foo-1", "10.0.0.1", "zone-a", true),
+			newEndpoint("foo-2", "10.0.0.2", "zone-a", false),
+		),
+	)
+
+	// the fake clientset drops the events before the watch is started
+	var once sync.Once
+	watchStarted := make(chan struct{})
+	client.PrependWatchReactor("*", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		w, err := client.Tracker().Watch(action.GetResource(), action.GetNamespace())
+		once.Do(func() { close(watchStarted) })
+		return true, w, err
+	})
+
+	r := NewRegistry(Client(client))
+
+	w, err := r.Watch(registry.WatchService("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	<-watchStarted
+
+	// foo-2 becomes ready
+	slice := newEndpointSlice(
+		newEndpoint("foo-1", "10.0.0.1", "zone-a", true),
+		newEndpoint("foo-2", "10.0.0.2", "zone-a", true),
+	)
+	if _, err := client.DiscoveryV1().EndpointSlices(DefaultNamespace).Update(context.TODO(), slice, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := w.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Action != "update" || len(res.Service.Nodes) != 2 {
+		t.Fatalf("Expected update event with 2 nodes, got %s with %d", res.Action, len(res.Service.Nodes))
+	}
+
+	// all slices are removed
+	if err := client.DiscoveryV1().EndpointSlices(DefaultNamespace).Delete(context.TODO(), slice.Name, metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err = w.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Action != "delete" || res.Service.Name != "foo" {
+		t.Fatalf("Expected delete event of foo, got %s of %s", res.Action, res.Service.Name)
+	}
+}
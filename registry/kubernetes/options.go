@@ -0,0 +1,58 @@
+package kubernetes
+
+import (
+	"context"
+
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/hb-go/grpc-contrib/registry"
+)
+
+type clientKey struct{}
+
+type namespaceKey struct{}
+
+type versionLabelKey struct{}
+
+type portNameKey struct{}
+
+// Client sets the kubernetes clientset, the in-cluster config is used if not set
+func Client(c kubernetes.Interface) registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, clientKey{}, c)
+	}
+}
+
+// Namespace sets the kubernetes namespace of the services
+func Namespace(ns string) registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, namespaceKey{}, ns)
+	}
+}
+
+// VersionLabel sets the pod label used as the service version
+func VersionLabel(label string) registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, versionLabelKey{}, label)
+	}
+}
+
+// PortName sets the name of the EndpointSlice port to use,
+// the first port is used if no port matches.
+func PortName(name string) registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, portNameKey{}, name)
+	}
+}
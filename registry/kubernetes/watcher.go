@@ -0,0 +1,221 @@
+package kubernetes
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc/grpclog"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+
+	"github.com/hb-go/grpc-contrib/registry"
+)
+
+// rewatchInterval is the delay before the watch is re-established after a failure
+var rewatchInterval = time.Second
+
+type k8sWatcher struct {
+	r  *k8sRegistry
+	wo registry.WatchOptions
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	next   chan *registry.Result
+
+	// kubernetes Service name -> services
+	services map[string][]*registry.Service
+}
+
+func newK8sWatcher(r *k8sRegistry, opts ...registry.WatchOption) (registry.Watcher, error) {
+	var wo registry.WatchOptions
+	for _, o := range opts {
+		o(&wo)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	kw := &k8sWatcher{
+		r:        r,
+		wo:       wo,
+		ctx:      ctx,
+		cancel:   cancel,
+		next:     make(chan *registry.Result),
+		services: make(map[string][]*registry.Service),
+	}
+
+	// the current state is the baseline, only changes are emitted
+	version, err := kw.sync(false)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	go kw.run(version)
+
+	return kw, nil
+}
+
+func (kw *k8sWatcher) selector() string {
+	if len(kw.wo.Service) > 0 {
+		return discoveryv1.LabelServiceName + "=" + serviceName(kw.wo.Service)
+	}
+	return discoveryv1.LabelServiceName
+}
+
+// name returns the registry service name of a kubernetes Service
+func (kw *k8sWatcher) name(svc string) string {
+	if len(kw.wo.Service) > 0 {
+		return kw.wo.Service
+	}
+	return svc
+}
+
+// sync lists all the EndpointSlices and diffs them against the known services,
+// it returns the resource version to watch from.
+func (kw *k8sWatcher) sync(emit bool) (string, error) {
+	rsp, err := kw.r.client.DiscoveryV1().EndpointSlices(kw.r.namespace).List(kw.ctx, metav1.ListOptions{
+		LabelSelector: kw.selector(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	sliceMap := map[string][]discoveryv1.EndpointSlice{}
+	for _, slice := range rsp.Items {
+		name := slice.Labels[discoveryv1.LabelServiceName]
+		sliceMap[name] = append(sliceMap[name], slice)
+	}
+
+	// services removed while not watching
+	for name := range kw.services {
+		if _, ok := sliceMap[name]; !ok {
+			sliceMap[name] = nil
+		}
+	}
+
+	for name, slices := range sliceMap {
+		services, err := kw.r.services(kw.ctx, kw.name(name), slices)
+		if err != nil {
+			return "", err
+		}
+		if !emit {
+			kw.services[name] = services
+			continue
+		}
+		if !kw.update(name, services) {
+			return "", kw.ctx.Err()
+		}
+	}
+
+	return rsp.ResourceVersion, nil
+}
+
+// update diffs the services of a kubernetes Service and sends the results,
+// it returns false if the watcher is stopped.
+func (kw *k8sWatcher) update(name string, services []*registry.Service) bool {
+	results := registry.Diff(kw.services[name], services)
+	if len(services) == 0 {
+		delete(kw.services, name)
+	} else {
+		kw.services[name] = services
+	}
+
+	for _, r := range results {
+		select {
+		case <-kw.ctx.Done():
+			return false
+		case kw.next <- r:
+		}
+	}
+	return true
+}
+
+func (kw *k8sWatcher) run(version string) {
+	for {
+		if err := kw.watch(version); err != nil && kw.ctx.Err() == nil {
+			grpclog.Warningf("grpc-contrib.registry: kubernetes watch error: %v", err)
+		}
+
+		for {
+			select {
+			case <-kw.ctx.Done():
+				return
+			case <-time.After(rewatchInterval):
+			}
+
+			// resync the changes missed while not watching
+			v, err := kw.sync(true)
+			if err == nil {
+				version = v
+				break
+			}
+			if kw.ctx.Err() != nil {
+				return
+			}
+			grpclog.Warningf("grpc-contrib.registry: kubernetes resync error: %v", err)
+		}
+	}
+}
+
+func (kw *k8sWatcher) watch(version string) error {
+	w, err := kw.r.client.DiscoveryV1().EndpointSlices(kw.r.namespace).Watch(kw.ctx, metav1.ListOptions{
+		LabelSelector:   kw.selector(),
+		ResourceVersion: version,
+	})
+	if err != nil {
+		return err
+	}
+	defer w.Stop()
+
+	for {
+		select {
+		case <-kw.ctx.Done():
+			return nil
+		case ev, ok := <-w.ResultChan():
+			if !ok {
+				return nil
+			}
+
+			if ev.Type == watch.Error {
+				return apierrors.FromObject(ev.Object)
+			}
+
+			slice, ok := ev.Object.(*discoveryv1.EndpointSlice)
+			if !ok {
+				continue
+			}
+
+			// rebuild the whole kubernetes Service, it may have more slices
+			name := slice.Labels[discoveryv1.LabelServiceName]
+			rsp, err := kw.r.client.DiscoveryV1().EndpointSlices(kw.r.namespace).List(kw.ctx, metav1.ListOptions{
+				LabelSelector: discoveryv1.LabelServiceName + "=" + name,
+			})
+			if err != nil {
+				return err
+			}
+
+			services, err := kw.r.services(kw.ctx, kw.name(name), rsp.Items)
+			if err != nil {
+				return err
+			}
+
+			if !kw.update(name, services) {
+				return nil
+			}
+		}
+	}
+}
+
+func (kw *k8sWatcher) Next() (*registry.Result, error) {
+	select {
+	case <-kw.ctx.Done():
+		return nil, registry.ErrWatcherStopped
+	case r := <-kw.next:
+		return r, nil
+	}
+}
+
+func (kw *k8sWatcher) Stop() {
+	kw.cancel()
+}
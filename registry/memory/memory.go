@@ -0,0 +1,401 @@
+// Package memory provides an in-process registry. It isn't the default
+// registry on import, an application chooses it explicitly:
+//
+//	registry.NewDefault = memory.NewRegistry
+//	registry.DefaultRegistry = memory.NewRegistry()
+package memory
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hb-go/grpc-contrib/registry"
+)
+
+const schema = "memory"
+const queryValSeq = "|"
+
+var (
+	// memory registry ttl prune interval
+	ttlPruneTime = time.Second
+)
+
+type memRecord struct {
+	Name     string
+	Version  string
+	Metadata map[string]string
+	Methods  []*registry.Method
+	Nodes    map[string]*memNode
+}
+
+type memNode struct {
+	*registry.Node
+	TTL      time.Duration
+	LastSeen time.Time
+}
+
+type memoryRegistry struct {
+	options registry.Options
+
+	sync.RWMutex
+	// service name -> version -> record
+	records  map[string]map[string]*memRecord
+	watchers map[string]*memoryWatcher
+
+	// pruning is true while ttlPrune runs, it exits when no node has a ttl
+	pruning bool
+	index   uint64
+}
+
+// NewRegistry returns a new in-process registry, the nodes are kept
+// in memory and watchers are notified on every change.
+func NewRegistry(opts ...registry.Option) registry.Registry {
+	m := &memoryRegistry{
+		records:  make(map[string]map[string]*memRecord),
+		watchers: make(map[string]*memoryWatcher),
+	}
+	m.Init(opts...)
+	return m
+}
+
+func serviceToRecord(s *registry.Service, ttl time.Duration) *memRecord {
+	metadata := make(map[string]string, len(s.Metadata))
+	for k, v := range s.Metadata {
+		metadata[k] = v
+	}
+
+	nodes := make(map[string]*memNode, len(s.Nodes))
+	for _, n := range s.Nodes {
+		nodes[n.Id] = &memNode{
+			Node:     copyNode(n),
+			TTL:      ttl,
+			LastSeen: time.Now(),
+		}
+	}
+
+	return &memRecord{
+		Name:     s.Name,
+		Version:  s.Version,
+		Metadata: metadata,
+		Methods:  registry.CopyService(s).Methods,
+		Nodes:    nodes,
+	}
+}
+
+func recordToService(r *memRecord) *registry.Service {
+	metadata := make(map[string]string, len(r.Metadata))
+	for k, v := range r.Metadata {
+		metadata[k] = v
+	}
+
+	nodes := make([]*registry.Node, 0, len(r.Nodes))
+	for _, n := range r.Nodes {
+		nodes = append(nodes, copyNode(n.Node))
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Id < nodes[j].Id })
+
+	s := registry.CopyService(&registry.Service{
+		Name:     r.Name,
+		Version:  r.Version,
+		Metadata: metadata,
+		Methods:  r.Methods,
+	})
+	s.Nodes = nodes
+
+	return s
+}
+
+func copyNode(n *registry.Node) *registry.Node {
+	metadata := make(map[string]string, len(n.Metadata))
+	for k, v := range n.Metadata {
+		metadata[k] = v
+	}
+
+	return &registry.Node{
+		Id:       n.Id,
+		Address:  n.Address,
+		Metadata: metadata,
+	}
+}
+
+// ttlPrune removes the nodes which have not been seen within their ttl
+func (m *memoryRegistry) ttlPrune(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		var results []*registry.Result
+		var ttls bool
+
+		m.Lock()
+		for name, versions := range m.records {
+			for version, record := range versions {
+				var expired []*registry.Node
+				for id, n := range record.Nodes {
+					if n.TTL > 0 && time.Since(n.LastSeen) > n.TTL {
+						expired = append(expired, n.Node)
+						delete(record.Nodes, id)
+						continue
+					}
+					if n.TTL > 0 {
+						ttls = true
+					}
+				}
+
+				if len(expired) == 0 {
+					continue
+				}
+
+				s := recordToService(record)
+				s.Nodes = expired
+				results = append(results, registry.NewResult(registry.Delete, s))
+
+				if len(record.Nodes) == 0 {
+					delete(versions, version)
+				}
+			}
+
+			if len(versions) == 0 {
+				delete(m.records, name)
+			}
+		}
+		// stop with the last node which has a ttl, Register starts it again
+		if !ttls {
+			m.pruning = false
+		}
+		for _, r := range results {
+			m.sendEvent(r)
+		}
+		m.Unlock()
+
+		if !ttls {
+			return
+		}
+	}
+}
+
+// sendEvent queues the result to the watchers, it is called with the lock
+// held so the watchers see the changes in the order they are made.
+// The push never blocks.
+func (m *memoryRegistry) sendEvent(r *registry.Result) {
+	for _, w := range m.watchers {
+		w.push(r)
+	}
+}
+
+func (m *memoryRegistry) Init(opts ...registry.Option) error {
+	m.Lock()
+	defer m.Unlock()
+
+	for _, o := range opts {
+		o(&m.options)
+	}
+
+	// the scheme of the targets and the resolver builder
+	if len(m.options.Scheme) == 0 {
+		m.options.Scheme = schema
+	}
+	return nil
+}
+
+func (m *memoryRegistry) Options() registry.Options {
+	return m.options
+}
+
+// NewTarget return grpc.Dial target
+func (m *memoryRegistry) NewTarget(s *registry.Service, opts ...registry.Option) string {
+	options := registry.Options{}
+	for _, o := range opts {
+		o(&options)
+	}
+
+	if len(options.Versions) == 0 {
+		return m.options.Scheme + ":///" + s.Name
+	}
+
+	return m.options.Scheme + ":///" + s.Name + "?version=" + strings.Join(options.Versions, queryValSeq)
+}
+
+func (m *memoryRegistry) Register(s *registry.Service, opts ...registry.RegisterOption) error {
+	if len(s.Nodes) == 0 {
+		return errors.New("require at least one node")
+	}
+
+	var options registry.RegisterOptions
+	for _, o := range opts {
+		o(&options)
+	}
+
+	m.Lock()
+	if options.TTL > 0 && !m.pruning {
+		m.pruning = true
+		go m.ttlPrune(ttlPruneTime)
+	}
+
+	versions, ok := m.records[s.Name]
+	if !ok {
+		versions = make(map[string]*memRecord)
+		m.records[s.Name] = versions
+	}
+
+	record, ok := versions[s.Version]
+	if !ok {
+		record = serviceToRecord(s, options.TTL)
+		versions[s.Version] = record
+		m.sendEvent(registry.NewResult(registry.Create, recordToService(record)))
+		m.Unlock()
+		return nil
+	}
+
+	// the latest registration wins for service level fields
+	update := serviceToRecord(s, options.TTL)
+	changed := !equalMetadata(record.Metadata, update.Metadata)
+	record.Metadata = update.Metadata
+	record.Methods = update.Methods
+
+	for _, n := range s.Nodes {
+		cur, ok := record.Nodes[n.Id]
+		if ok && cur.Address == n.Address && equalMetadata(cur.Metadata, n.Metadata) {
+			// refresh the node
+			cur.TTL = options.TTL
+			cur.LastSeen = time.Now()
+			continue
+		}
+
+		record.Nodes[n.Id] = &memNode{
+			Node:     copyNode(n),
+			TTL:      options.TTL,
+			LastSeen: time.Now(),
+		}
+		changed = true
+	}
+
+	if changed {
+		m.sendEvent(registry.NewResult(registry.Update, recordToService(record)))
+	}
+	m.Unlock()
+
+	return nil
+}
+
+func (m *memoryRegistry) Deregister(s *registry.Service) error {
+	if len(s.Nodes) == 0 {
+		return errors.New("require at least one node")
+	}
+
+	m.Lock()
+	versions, ok := m.records[s.Name]
+	if !ok {
+		m.Unlock()
+		return nil
+	}
+
+	record, ok := versions[s.Version]
+	if !ok {
+		m.Unlock()
+		return nil
+	}
+
+	var deleted []*registry.Node
+	for _, n := range s.Nodes {
+		if cur, ok := record.Nodes[n.Id]; ok {
+			deleted = append(deleted, cur.Node)
+			delete(record.Nodes, n.Id)
+		}
+	}
+
+	if len(deleted) > 0 {
+		service := recordToService(record)
+		service.Nodes = deleted
+		m.sendEvent(registry.NewResult(registry.Delete, service))
+	}
+
+	if len(record.Nodes) == 0 {
+		delete(versions, s.Version)
+	}
+	if len(versions) == 0 {
+		delete(m.records, s.Name)
+	}
+	m.Unlock()
+
+	return nil
+}
+
+func (m *memoryRegistry) GetService(name string) ([]*registry.Service, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	versions, ok := m.records[name]
+	if !ok || len(versions) == 0 {
+		return nil, registry.ErrNotFound
+	}
+
+	services := make([]*registry.Service, 0, len(versions))
+	for _, record := range versions {
+		services = append(services, recordToService(record))
+	}
+
+	return services, nil
+}
+
+func (m *memoryRegistry) ListServices() ([]*registry.Service, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	var services []*registry.Service
+	for _, versions := range m.records {
+		for _, record := range versions {
+			services = append(services, recordToService(record))
+		}
+	}
+
+	// sort the services
+	sort.Slice(services, func(i, j int) bool {
+		if services[i].Name == services[j].Name {
+			return services[i].Version < services[j].Version
+		}
+		return services[i].Name < services[j].Name
+	})
+
+	return services, nil
+}
+
+func (m *memoryRegistry) Watch(opts ...registry.WatchOption) (registry.Watcher, error) {
+	var wo registry.WatchOptions
+	for _, o := range opts {
+		o(&wo)
+	}
+
+	m.Lock()
+	m.index++
+	id := strconv.FormatUint(m.index, 10)
+	w := newWatcher(id, wo, func() {
+		m.Lock()
+		delete(m.watchers, id)
+		m.Unlock()
+	})
+	m.watchers[id] = w
+	m.Unlock()
+
+	return w, nil
+}
+
+func (m *memoryRegistry) String() string {
+	return "memory"
+}
+
+func equalMetadata(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
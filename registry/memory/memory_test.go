@@ -0,0 +1,284 @@
+package memory
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hb-go/grpc-contrib/registry"
+)
+
+var memoryTestData = []*registry.Service{
+	{
+		Name:    "foo",
+		Version: "1.0.0",
+		Nodes: []*registry.Node{
+			{
+				Id:      "foo-1.0.0-123",
+				Address: "localhost:9999",
+			},
+			{
+				Id:      "foo-1.0.0-321",
+				Address: "localhost:9999",
+			},
+		},
+	},
+	{
+		Name:    "foo",
+		Version: "1.0.1",
+		Nodes: []*registry.Node{
+			{
+				Id:      "foo-1.0.1-321",
+				Address: "localhost:6666",
+			},
+		},
+	},
+	{
+		Name:    "bar",
+		Version: "default",
+		Nodes: []*registry.Node{
+			{
+				Id:      "bar-1.0.0-123",
+				Address: "localhost:8888",
+			},
+		},
+	},
+}
+
+func TestMemoryRegistry(t *testing.T) {
+	m := NewRegistry()
+
+	for _, s := range memoryTestData {
+		if err := m.Register(s); err != nil {
+			t.Fatalf("Register error: %v", err)
+		}
+	}
+
+	services, err := m.GetService("foo")
+	if err != nil {
+		t.Fatalf("GetService error: %v", err)
+	}
+	if exp, act := 2, len(services); exp != act {
+		t.Fatalf("Expected %d versions, got %d", exp, act)
+	}
+
+	for _, s := range services {
+		if s.Version == "1.0.0" && len(s.Nodes) != 2 {
+			t.Fatalf("Expected 2 nodes for version %s, got %d", s.Version, len(s.Nodes))
+		}
+	}
+
+	services, err = m.ListServices()
+	if err != nil {
+		t.Fatalf("ListServices error: %v", err)
+	}
+	if exp, act := 3, len(services); exp != act {
+		t.Fatalf("Expected %d services, got %d", exp, act)
+	}
+
+	for _, s := range memoryTestData {
+		if err := m.Deregister(s); err != nil {
+			t.Fatalf("Deregister error: %v", err)
+		}
+	}
+
+	if _, err := m.GetService("foo"); err != registry.ErrNotFound {
+		t.Fatalf("Expected %v, got %v", registry.ErrNotFound, err)
+	}
+}
+
+func TestMemoryRegistryWatch(t *testing.T) {
+	m := NewRegistry()
+
+	w, err := m.Watch(registry.WatchService("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	go func() {
+		for _, s := range memoryTestData {
+			m.Register(s)
+		}
+		m.Deregister(memoryTestData[0])
+	}()
+
+	for _, exp := range []string{"create", "create", "delete"} {
+		res, err := w.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res.Service.Name != "foo" {
+			t.Fatalf("Expected service foo, got %s", res.Service.Name)
+		}
+
+		if res.Action != exp {
+			t.Fatalf("Expected %s event, got %s", exp, res.Action)
+		}
+	}
+}
+
+func TestMemoryRegistryTTL(t *testing.T) {
+	ttlPruneTime = 10 * time.Millisecond
+	defer func() {
+		ttlPruneTime = time.Second
+	}()
+
+	m := NewRegistry()
+
+	w, err := m.Watch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	go m.Register(memoryTestData[2], registry.RegisterTTL(50*time.Millisecond))
+
+	for _, exp := range []string{"create", "delete"} {
+		res, err := w.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res.Action != exp {
+			t.Fatalf("Expected %s event, got %s", exp, res.Action)
+		}
+	}
+
+	if _, err := m.GetService("bar"); err != registry.ErrNotFound {
+		t.Fatalf("Expected %v, got %v", registry.ErrNotFound, err)
+	}
+}
+
+func TestMemoryRegistryWatchSlow(t *testing.T) {
+	m := NewRegistry()
+
+	w, err := m.Watch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	// the events are queued until the watcher reads them
+	for _, s := range memoryTestData {
+		if err := m.Register(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, s := range memoryTestData {
+		if err := m.Deregister(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	for _, exp := range []string{"create", "create", "create", "delete", "delete", "delete"} {
+		res, err := w.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res.Action != exp {
+			t.Fatalf("Expected %s event, got %s", exp, res.Action)
+		}
+	}
+
+	w.Stop()
+	if _, err := w.Next(); err != registry.ErrWatcherStopped {
+		t.Fatalf("Expected %v, got %v", registry.ErrWatcherStopped, err)
+	}
+
+	// the stopped watcher is removed by the next event
+	m.Register(memoryTestData[2])
+	mr := m.(*memoryRegistry)
+	mr.RLock()
+	n := len(mr.watchers)
+	mr.RUnlock()
+	if exp, act := 0, n; exp != act {
+		t.Fatalf("Expected %d watchers, got %d", exp, act)
+	}
+}
+
+func TestMemoryRegistryPruneStop(t *testing.T) {
+	ttlPruneTime = 10 * time.Millisecond
+	defer func() {
+		ttlPruneTime = time.Second
+	}()
+
+	m := NewRegistry().(*memoryRegistry)
+	pruning := func() bool {
+		m.RLock()
+		defer m.RUnlock()
+		return m.pruning
+	}
+
+	if err := m.Register(memoryTestData[2], registry.RegisterTTL(20*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if !pruning() {
+		t.Fatalf("Expected the prune to run")
+	}
+
+	// the prune exits with the last node which has a ttl
+	deadline := time.Now().Add(5 * time.Second)
+	for pruning() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the prune to stop")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// and starts again with the next one
+	if err := m.Register(memoryTestData[2], registry.RegisterTTL(20*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if !pruning() {
+		t.Fatalf("Expected the prune to run")
+	}
+}
+
+func TestMemoryRegistryWatchOrder(t *testing.T) {
+	m := NewRegistry()
+	s := memoryTestData[2]
+
+	for i := 0; i < 100; i++ {
+		w, err := m.Watch()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the watcher sees the last change of a concurrent register and deregister last
+		done := make(chan bool)
+		go func() {
+			m.Register(s)
+			done <- true
+		}()
+		go func() {
+			m.Deregister(s)
+			done <- true
+		}()
+		<-done
+		<-done
+
+		var last string
+		mw := w.(*memoryWatcher)
+		mw.mu.Lock()
+		if len(mw.queue) > 0 {
+			last = mw.queue[len(mw.queue)-1].Action
+		}
+		mw.mu.Unlock()
+
+		_, err = m.GetService(s.Name)
+		if exp, act := err == nil, last == "create"; exp != act {
+			t.Fatalf("Expected the last event create `%v`, got `%s`", exp, last)
+		}
+
+		w.Stop()
+		m.Deregister(s)
+	}
+
+	// a stopped watcher is removed from the registry
+	if exp, act := 0, len(m.(*memoryRegistry).watchers); exp != act {
+		t.Fatalf("Expected %d watchers, got %d", exp, act)
+	}
+}
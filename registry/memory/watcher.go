@@ -0,0 +1,96 @@
+package memory
+
+import (
+	"sync"
+
+	"github.com/hb-go/grpc-contrib/registry"
+)
+
+// memoryWatcher queues the results until Next returns them,
+// so a slow consumer never loses an event and never blocks the registry.
+type memoryWatcher struct {
+	id   string
+	wo   registry.WatchOptions
+	exit chan bool
+	// stop removes the watcher from the registry
+	stop func()
+
+	mu    sync.Mutex
+	queue []*registry.Result
+	// notify signals a queued result to Next
+	notify chan struct{}
+}
+
+func newWatcher(id string, wo registry.WatchOptions, stop func()) *memoryWatcher {
+	return &memoryWatcher{
+		id:     id,
+		wo:     wo,
+		exit:   make(chan bool),
+		stop:   stop,
+		notify: make(chan struct{}, 1),
+	}
+}
+
+// push queues the result, a stopped watcher drops it
+func (m *memoryWatcher) push(r *registry.Result) {
+	if len(m.wo.Service) > 0 && m.wo.Service != r.Service.Name {
+		return
+	}
+
+	m.mu.Lock()
+	select {
+	case <-m.exit:
+		m.mu.Unlock()
+		return
+	default:
+	}
+	m.queue = append(m.queue, r)
+	m.mu.Unlock()
+
+	select {
+	case m.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (m *memoryWatcher) Next() (*registry.Result, error) {
+	for {
+		select {
+		case <-m.exit:
+			return nil, registry.ErrWatcherStopped
+		default:
+		}
+
+		m.mu.Lock()
+		if len(m.queue) > 0 {
+			r := m.queue[0]
+			m.queue[0] = nil
+			m.queue = m.queue[1:]
+			m.mu.Unlock()
+			return r, nil
+		}
+		m.mu.Unlock()
+
+		select {
+		case <-m.notify:
+		case <-m.exit:
+			return nil, registry.ErrWatcherStopped
+		}
+	}
+}
+
+func (m *memoryWatcher) Stop() {
+	m.mu.Lock()
+	select {
+	case <-m.exit:
+		m.mu.Unlock()
+		return
+	default:
+		close(m.exit)
+		m.queue = nil
+	}
+	m.mu.Unlock()
+
+	// outside of the lock, the registry holds its lock while pushing
+	m.stop()
+}
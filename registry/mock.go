@@ -1,5 +1,7 @@
 package registry
 
+import "context"
+
 type MockRegistry struct {
 }
 
@@ -33,6 +35,26 @@ func (*MockRegistry) Watch(...WatchOption) (Watcher, error) {
 	return &mockWatcher{}, nil
 }
 
+func (*MockRegistry) RegisterContext(context.Context, *Service, ...RegisterOption) error {
+	return nil
+}
+
+func (*MockRegistry) DeregisterContext(context.Context, *Service) error {
+	return nil
+}
+
+func (*MockRegistry) GetServiceContext(context.Context, string) ([]*Service, error) {
+	return []*Service{}, nil
+}
+
+func (*MockRegistry) ListServicesContext(context.Context) ([]*Service, error) {
+	return []*Service{}, nil
+}
+
+func (*MockRegistry) WatchContext(context.Context, ...WatchOption) (Watcher, error) {
+	return &mockWatcher{}, nil
+}
+
 func (*MockRegistry) String() string {
 	return "mock"
 }
@@ -0,0 +1,325 @@
+// Package multi provides a registry which aggregates multiple registries
+package multi
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc/grpclog"
+
+	"github.com/hb-go/grpc-contrib/registry"
+)
+
+const schema = "multi"
+const queryValSeq = "|"
+
+type multiRegistry struct {
+	options registry.Options
+
+	sync.RWMutex
+	registries []registry.Registry
+	readMode   ReadMode
+	writeMode  WriteMode
+}
+
+// NewRegistry returns a registry which aggregates the registries set by
+// the Registries option, e.g. etcd and consul during a migration.
+// Writes fan out by the Write option, reads are merged by the Read option
+// and a failed registry only degrades the result.
+func NewRegistry(opts ...registry.Option) registry.Registry {
+	m := &multiRegistry{
+		options: registry.Options{},
+	}
+	configure(m, opts...)
+	return m
+}
+
+func configure(m *multiRegistry, opts ...registry.Option) {
+	m.Lock()
+	defer m.Unlock()
+
+	for _, o := range opts {
+		o(&m.options)
+	}
+
+	// the scheme of the targets and the resolver builder
+	if len(m.options.Scheme) == 0 {
+		m.options.Scheme = schema
+	}
+
+	if m.options.Context != nil {
+		if rs, ok := m.options.Context.Value(registriesKey{}).([]registry.Registry); ok {
+			m.registries = rs
+		}
+		if r, ok := m.options.Context.Value(readModeKey{}).(ReadMode); ok {
+			m.readMode = r
+		}
+		if w, ok := m.options.Context.Value(writeModeKey{}).(WriteMode); ok {
+			m.writeMode = w
+		}
+	}
+}
+
+func (m *multiRegistry) getRegistries() []registry.Registry {
+	m.RLock()
+	defer m.RUnlock()
+	return m.registries
+}
+
+// multiError joins the errors of the registries
+func multiError(rs []registry.Registry, errs []error) error {
+	var msgs []string
+	for i, err := range errs {
+		if err != nil {
+			msgs = append(msgs, rs[i].String()+": "+err.Error())
+		}
+	}
+
+	if len(msgs) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(msgs, "; "))
+}
+
+// merge merges the services read from the registries in priority order
+func merge(mode ReadMode, reads [][]*registry.Service) []*registry.Service {
+	var services []*registry.Service
+	serviceMap := map[string]*registry.Service{}
+	nodeMap := map[string]map[string]bool{}
+	// service name -> index of the registry it is read from
+	owner := map[string]int{}
+
+	for i, read := range reads {
+		for _, s := range read {
+			if mode == ReadPriority {
+				if o, ok := owner[s.Name]; ok && o != i {
+					continue
+				}
+				owner[s.Name] = i
+			}
+
+			key := s.Name + "/" + s.Version
+			svc, ok := serviceMap[key]
+			if !ok {
+				svc = registry.CopyService(s)
+				svc.Nodes = nil
+				serviceMap[key] = svc
+				nodeMap[key] = map[string]bool{}
+				services = append(services, svc)
+			}
+
+			// de-duplicate by node id, the first registry wins
+			for _, n := range s.Nodes {
+				if nodeMap[key][n.Id] {
+					continue
+				}
+				nodeMap[key][n.Id] = true
+				node := *n
+				svc.Nodes = append(svc.Nodes, &node)
+			}
+		}
+	}
+
+	return services
+}
+
+func (m *multiRegistry) Init(opts ...registry.Option) error {
+	configure(m, opts...)
+	return nil
+}
+
+func (m *multiRegistry) Options() registry.Options {
+	return m.options
+}
+
+// NewTarget return grpc.Dial target
+func (m *multiRegistry) NewTarget(s *registry.Service, opts ...registry.Option) string {
+	options := registry.Options{}
+	for _, o := range opts {
+		o(&options)
+	}
+
+	if len(options.Versions) == 0 {
+		return m.options.Scheme + ":///" + s.Name
+	}
+
+	return m.options.Scheme + ":///" + s.Name + "?version=" + strings.Join(options.Versions, queryValSeq)
+}
+
+// each calls fn on the registries to write to, concurrently
+func (m *multiRegistry) each(fn func(registry.ContextRegistry) error) error {
+	rs := m.getRegistries()
+	if len(rs) == 0 {
+		return errors.New("no registries")
+	}
+
+	m.RLock()
+	mode := m.writeMode
+	m.RUnlock()
+
+	if mode == WritePrimary {
+		return fn(registry.WithContext(rs[0]))
+	}
+
+	errs := make([]error, len(rs))
+
+	var wg sync.WaitGroup
+	for i, r := range rs {
+		wg.Add(1)
+		go func(i int, r registry.Registry) {
+			defer wg.Done()
+			errs[i] = fn(registry.WithContext(r))
+		}(i, r)
+	}
+	wg.Wait()
+
+	err := multiError(rs, errs)
+	if err == nil {
+		return nil
+	}
+
+	if mode == WriteAny {
+		for _, e := range errs {
+			if e == nil {
+				// degraded, but registered somewhere
+				grpclog.Warningf("grpc-contrib.registry: multi write error: %v", err)
+				return nil
+			}
+		}
+	}
+
+	return err
+}
+
+func (m *multiRegistry) Register(s *registry.Service, opts ...registry.RegisterOption) error {
+	return m.RegisterContext(context.Background(), s, opts...)
+}
+
+// RegisterContext registers the service with the context, the namespace
+// of the context reaches each registry
+func (m *multiRegistry) RegisterContext(ctx context.Context, s *registry.Service, opts ...registry.RegisterOption) error {
+	return m.each(func(r registry.ContextRegistry) error {
+		return r.RegisterContext(ctx, s, opts...)
+	})
+}
+
+func (m *multiRegistry) Deregister(s *registry.Service) error {
+	return m.DeregisterContext(context.Background(), s)
+}
+
+func (m *multiRegistry) DeregisterContext(ctx context.Context, s *registry.Service) error {
+	return m.each(func(r registry.ContextRegistry) error {
+		return r.DeregisterContext(ctx, s)
+	})
+}
+
+// read calls fn on all the registries concurrently and merges the results,
+// it fails only if all the registries fail.
+func (m *multiRegistry) read(fn func(registry.ContextRegistry) ([]*registry.Service, error)) ([]*registry.Service, error) {
+	rs := m.getRegistries()
+	if len(rs) == 0 {
+		return nil, errors.New("no registries")
+	}
+
+	m.RLock()
+	mode := m.readMode
+	m.RUnlock()
+
+	reads := make([][]*registry.Service, len(rs))
+	errs := make([]error, len(rs))
+
+	var wg sync.WaitGroup
+	for i, r := range rs {
+		wg.Add(1)
+		go func(i int, r registry.Registry) {
+			defer wg.Done()
+			reads[i], errs[i] = fn(registry.WithContext(r))
+		}(i, r)
+	}
+	wg.Wait()
+
+	// not found is an answer, only the failed registries are skipped
+	var ok bool
+	for i, err := range errs {
+		switch err {
+		case nil, registry.ErrNotFound:
+			ok = true
+			errs[i] = nil
+		default:
+			grpclog.Warningf("grpc-contrib.registry: multi read %s error: %v", rs[i].String(), err)
+		}
+	}
+
+	if !ok {
+		return nil, multiError(rs, errs)
+	}
+
+	return merge(mode, reads), nil
+}
+
+func (m *multiRegistry) GetService(name string) ([]*registry.Service, error) {
+	return m.GetServiceContext(context.Background(), name)
+}
+
+func (m *multiRegistry) GetServiceContext(ctx context.Context, name string) ([]*registry.Service, error) {
+	services, err := m.read(func(r registry.ContextRegistry) ([]*registry.Service, error) {
+		return r.GetServiceContext(ctx, name)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(services) == 0 {
+		return nil, registry.ErrNotFound
+	}
+
+	return services, nil
+}
+
+// ListServices lists the names of the services of the registries
+func (m *multiRegistry) ListServices() ([]*registry.Service, error) {
+	return m.ListServicesContext(context.Background())
+}
+
+func (m *multiRegistry) ListServicesContext(ctx context.Context) ([]*registry.Service, error) {
+	reads, err := m.read(func(r registry.ContextRegistry) ([]*registry.Service, error) {
+		return r.ListServicesContext(ctx)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// the registries list a service with or without its versions,
+	// a service is listed once by name
+	seen := make(map[string]bool, len(reads))
+	var services []*registry.Service
+	for _, s := range reads {
+		if seen[s.Name] {
+			continue
+		}
+		seen[s.Name] = true
+		services = append(services, &registry.Service{Name: s.Name})
+	}
+
+	// sort the services
+	sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+
+	return services, nil
+}
+
+func (m *multiRegistry) Watch(opts ...registry.WatchOption) (registry.Watcher, error) {
+	return m.WatchContext(context.Background(), opts...)
+}
+
+// WatchContext watches the registries with the context, the watcher
+// is stopped when the context is done
+func (m *multiRegistry) WatchContext(ctx context.Context, opts ...registry.WatchOption) (registry.Watcher, error) {
+	return newMultiWatcher(ctx, m, opts...)
+}
+
+func (m *multiRegistry) String() string {
+	return "multi"
+}
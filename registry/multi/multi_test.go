@@ -0,0 +1,280 @@
+package multi
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/hb-go/grpc-contrib/registry"
+	"github.com/hb-go/grpc-contrib/registry/memory"
+)
+
+// failRegistry is a registry which is down
+type failRegistry struct {
+	registry.Registry
+}
+
+var errDown = errors.New("registry is down")
+
+func (failRegistry) Register(*registry.Service, ...registry.RegisterOption) error { return errDown }
+func (failRegistry) Deregister(*registry.Service) error                           { return errDown }
+func (failRegistry) GetService(string) ([]*registry.Service, error)               { return nil, errDown }
+func (failRegistry) ListServices() ([]*registry.Service, error)                   { return nil, errDown }
+func (failRegistry) Watch(...registry.WatchOption) (registry.Watcher, error)      { return nil, errDown }
+func (failRegistry) String() string                                               { return "fail" }
+
+// nsRegistry records the namespaces of the calls
+type nsRegistry struct {
+	registry.Registry
+	namespaces chan string
+}
+
+func (r *nsRegistry) record(ctx context.Context) {
+	ns, _ := registry.NamespaceFromContext(ctx)
+	r.namespaces <- ns
+}
+
+func (r *nsRegistry) RegisterContext(ctx context.Context, s *registry.Service, opts ...registry.RegisterOption) error {
+	r.record(ctx)
+	return r.Register(s, opts...)
+}
+
+func (r *nsRegistry) DeregisterContext(ctx context.Context, s *registry.Service) error {
+	r.record(ctx)
+	return r.Deregister(s)
+}
+
+func (r *nsRegistry) GetServiceContext(ctx context.Context, name string) ([]*registry.Service, error) {
+	r.record(ctx)
+	return r.GetService(name)
+}
+
+func (r *nsRegistry) ListServicesContext(ctx context.Context) ([]*registry.Service, error) {
+	r.record(ctx)
+	return r.ListServices()
+}
+
+func (r *nsRegistry) WatchContext(ctx context.Context, opts ...registry.WatchOption) (registry.Watcher, error) {
+	r.record(ctx)
+	return r.Watch(opts...)
+}
+
+func newService(version string, ids ...string) *registry.Service {
+	s := &registry.Service{
+		Name:    "foo",
+		Version: version,
+	}
+	for _, id := range ids {
+		s.Nodes = append(s.Nodes, &registry.Node{Id: id, Address: id + ":8080"})
+	}
+	return s
+}
+
+func nodeCount(services []*registry.Service) int {
+	var n int
+	for _, s := range services {
+		n += len(s.Nodes)
+	}
+	return n
+}
+
+func TestMultiRead(t *testing.T) {
+	r1 := memory.NewRegistry()
+	r2 := memory.NewRegistry()
+
+	if err := r1.Register(newService("v1", "node-1", "node-2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := r2.Register(newService("v1", "node-2", "node-3")); err != nil {
+		t.Fatal(err)
+	}
+	if err := r2.Register(newService("v2", "node-4")); err != nil {
+		t.Fatal(err)
+	}
+
+	testData := []struct {
+		mode    ReadMode
+		version int
+		node    int
+	}{
+		{ReadUnion, 2, 4},
+		{ReadPriority, 1, 2},
+	}
+
+	for _, d := range testData {
+		m := NewRegistry(Registries(r1, r2, failRegistry{}), Read(d.mode))
+
+		services, err := m.GetService("foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exp, act := d.version, len(services); exp != act {
+			t.Fatalf("Expected len of svc to be `%d`, got `%d`.", exp, act)
+		}
+		if exp, act := d.node, nodeCount(services); exp != act {
+			t.Fatalf("Expected len of nodes to be `%d`, got `%d`.", exp, act)
+		}
+
+		if _, err := m.GetService("bar"); err != registry.ErrNotFound {
+			t.Fatalf("Expected %v, got %v", registry.ErrNotFound, err)
+		}
+	}
+
+	m := NewRegistry(Registries(failRegistry{}))
+	if _, err := m.GetService("foo"); err == nil {
+		t.Fatal("Expected error when all registries fail")
+	}
+}
+
+func TestMultiContext(t *testing.T) {
+	r1 := &nsRegistry{memory.NewRegistry(), make(chan string, 10)}
+	r2 := &nsRegistry{memory.NewRegistry(), make(chan string, 10)}
+	m := NewRegistry(Registries(r1, r2)).(registry.ContextRegistry)
+
+	ctx := registry.NewNamespaceContext(context.Background(), "prod")
+	if err := m.RegisterContext(ctx, newService("v1", "node-1")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.GetServiceContext(ctx, "foo"); err != nil {
+		t.Fatal(err)
+	}
+
+	// each registry is written and read in the namespace
+	for _, r := range []*nsRegistry{r1, r2} {
+		for i := 0; i < 2; i++ {
+			if exp, act := "prod", <-r.namespaces; exp != act {
+				t.Fatalf("Expected namespace `%s`, got `%s`.", exp, act)
+			}
+		}
+	}
+
+	// a registry without namespaces refuses them
+	m = NewRegistry(Registries(memory.NewRegistry())).(registry.ContextRegistry)
+	if _, err := m.GetServiceContext(ctx, "foo"); err == nil {
+		t.Fatal("Expected error for a namespace of a registry without namespaces")
+	}
+}
+
+// nameRegistry lists the services without their versions, like consul
+type nameRegistry struct {
+	registry.Registry
+}
+
+func (nameRegistry) ListServices() ([]*registry.Service, error) {
+	return []*registry.Service{{Name: "foo"}, {Name: "bar"}}, nil
+}
+
+func TestMultiListServices(t *testing.T) {
+	r1 := memory.NewRegistry()
+	if err := r1.Register(newService("v1", "node-1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := r1.Register(newService("v2", "node-2")); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewRegistry(Registries(r1, nameRegistry{memory.NewRegistry()}))
+	services, err := m.ListServices()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// each service is listed once
+	var names []string
+	for _, s := range services {
+		names = append(names, s.Name)
+	}
+	if exp, act := []string{"bar", "foo"}, names; !reflect.DeepEqual(exp, act) {
+		t.Fatalf("Expected services %v, got %v", exp, act)
+	}
+}
+
+func TestMultiWrite(t *testing.T) {
+	testData := []struct {
+		mode WriteMode
+		err  bool
+		r2   bool
+	}{
+		{WriteAll, true, true},
+		{WriteAny, false, true},
+		{WritePrimary, false, false},
+	}
+
+	for _, d := range testData {
+		r1 := memory.NewRegistry()
+		r2 := memory.NewRegistry()
+
+		m := NewRegistry(Registries(r1, r2, failRegistry{}), Write(d.mode))
+		if d.mode == WritePrimary {
+			m = NewRegistry(Registries(r1, r2), Write(d.mode))
+		}
+
+		err := m.Register(newService("v1", "node-1"))
+		if exp, act := d.err, err != nil; exp != act {
+			t.Fatalf("Expected error `%v` for write mode %d, got `%v`.", exp, d.mode, err)
+		}
+
+		if _, err := r1.GetService("foo"); err != nil {
+			t.Fatalf("Expected service in the primary registry, got %v", err)
+		}
+		_, err = r2.GetService("foo")
+		if exp, act := d.r2, err == nil; exp != act {
+			t.Fatalf("Expected service in the second registry `%v` for write mode %d, got `%v`.", exp, d.mode, act)
+		}
+	}
+}
+
+func TestMultiWatcher(t *testing.T) {
+	r1 := memory.NewRegistry()
+	r2 := memory.NewRegistry()
+
+	m := NewRegistry(Registries(r1, r2))
+
+	w, err := m.Watch(registry.WatchService("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	if err := r1.Register(newService("v1", "node-1")); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := w.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Action != "create" || len(res.Service.Nodes) != 1 {
+		t.Fatalf("Expected create event with 1 node, got %s with %d", res.Action, len(res.Service.Nodes))
+	}
+
+	// node-1 is registered twice, node-2 is new
+	if err := r2.Register(newService("v1", "node-1", "node-2")); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err = w.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Action != "update" || len(res.Service.Nodes) != 2 {
+		t.Fatalf("Expected update event with 2 nodes, got %s with %d", res.Action, len(res.Service.Nodes))
+	}
+
+	// node-1 is still in r2
+	if err := r1.Deregister(newService("v1", "node-1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := r2.Deregister(newService("v1", "node-1", "node-2")); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err = w.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Action != "delete" {
+		t.Fatalf("Expected delete event, got %s", res.Action)
+	}
+}
@@ -0,0 +1,65 @@
+package multi
+
+import (
+	"context"
+
+	"github.com/hb-go/grpc-contrib/registry"
+)
+
+// ReadMode is how the reads of the registries are merged
+type ReadMode int
+
+const (
+	// ReadUnion merges the services of all the registries
+	ReadUnion ReadMode = iota
+	// ReadPriority uses the first registry in order which has the service
+	ReadPriority
+)
+
+// WriteMode is how Register and Deregister fan out to the registries
+type WriteMode int
+
+const (
+	// WriteAll writes to all the registries and fails if any of them fails
+	WriteAll WriteMode = iota
+	// WriteAny writes to all the registries and fails only if all of them fail
+	WriteAny
+	// WritePrimary only writes to the first registry
+	WritePrimary
+)
+
+type registriesKey struct{}
+
+type readModeKey struct{}
+
+type writeModeKey struct{}
+
+// Registries sets the registries to aggregate, in priority order
+func Registries(rs ...registry.Registry) registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, registriesKey{}, rs)
+	}
+}
+
+// Read sets how the reads are merged, defaults to ReadUnion
+func Read(m ReadMode) registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, readModeKey{}, m)
+	}
+}
+
+// Write sets how the writes fan out, defaults to WriteAll
+func Write(m WriteMode) registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, writeModeKey{}, m)
+	}
+}
@@ -0,0 +1,212 @@
+package multi
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/grpclog"
+
+	"github.com/hb-go/grpc-contrib/registry"
+)
+
+// retryInterval is the delay before a failed watcher of a registry is re-created
+var retryInterval = time.Second
+
+type multiWatcher struct {
+	m   *multiRegistry
+	wo  registry.WatchOptions
+	ctx context.Context
+
+	exit   chan bool
+	once   sync.Once
+	events chan *registry.Result
+	next   chan *registry.Result
+	wg     sync.WaitGroup
+
+	// service name -> merged services, only accessed by the run loop
+	services map[string][]*registry.Service
+}
+
+func newMultiWatcher(ctx context.Context, m *multiRegistry, opts ...registry.WatchOption) (registry.Watcher, error) {
+	var wo registry.WatchOptions
+	for _, o := range opts {
+		o(&wo)
+	}
+
+	mw := &multiWatcher{
+		m:        m,
+		wo:       wo,
+		ctx:      ctx,
+		exit:     make(chan bool),
+		events:   make(chan *registry.Result),
+		next:     make(chan *registry.Result),
+		services: make(map[string][]*registry.Service),
+	}
+
+	// the current state of the watched service is the baseline
+	if len(wo.Service) > 0 {
+		services, err := m.GetServiceContext(ctx, wo.Service)
+		if err != nil && err != registry.ErrNotFound {
+			return nil, err
+		}
+		mw.services[wo.Service] = services
+	}
+
+	// watch synchronously so no change after Watch returns is missed,
+	// a registry failing here is retried in the background
+	for _, r := range m.getRegistries() {
+		w, err := registry.WithContext(r).WatchContext(ctx, opts...)
+		if err != nil {
+			grpclog.Warningf("grpc-contrib.registry: multi watch %s error: %v", r.String(), err)
+			w = nil
+		}
+
+		mw.wg.Add(1)
+		go mw.watch(r, w, opts...)
+	}
+
+	go mw.run()
+
+	// stop the watcher when the context is done
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				mw.Stop()
+			case <-mw.exit:
+			}
+		}()
+	}
+
+	return mw, nil
+}
+
+// watch forwards the results of a registry to the run loop,
+// the watcher is re-created when it fails.
+func (mw *multiWatcher) watch(r registry.Registry, w registry.Watcher, opts ...registry.WatchOption) {
+	defer mw.wg.Done()
+
+	for {
+		if w != nil {
+			err := mw.forward(w)
+			select {
+			case <-mw.exit:
+				return
+			default:
+			}
+			grpclog.Warningf("grpc-contrib.registry: multi watch %s error: %v", r.String(), err)
+		}
+
+		select {
+		case <-mw.exit:
+			return
+		case <-time.After(retryInterval):
+		}
+
+		var err error
+		if w, err = registry.WithContext(r).WatchContext(mw.ctx, opts...); err != nil {
+			grpclog.Warningf("grpc-contrib.registry: multi watch %s error: %v", r.String(), err)
+			w = nil
+		}
+	}
+}
+
+func (mw *multiWatcher) forward(w registry.Watcher) error {
+	done := make(chan bool)
+	defer close(done)
+
+	// unblock Next when the multi watcher is stopped
+	go func() {
+		select {
+		case <-mw.exit:
+		case <-done:
+		}
+		w.Stop()
+	}()
+
+	for {
+		res, err := w.Next()
+		if err != nil {
+			return err
+		}
+		if res == nil || res.Service == nil {
+			continue
+		}
+
+		select {
+		case <-mw.exit:
+			return registry.ErrWatcherStopped
+		case mw.events <- res:
+		}
+	}
+}
+
+// handle re-reads the merged service the result belongs to
+// and sends the changes since the last read.
+func (mw *multiWatcher) handle(res *registry.Result) {
+	name := res.Service.Name
+	if len(mw.wo.Service) > 0 && name != mw.wo.Service {
+		return
+	}
+
+	services, err := mw.m.GetServiceContext(mw.ctx, name)
+	if err != nil && err != registry.ErrNotFound {
+		grpclog.Warningf("grpc-contrib.registry: multi get service %s error: %v", name, err)
+		return
+	}
+
+	prev, ok := mw.services[name]
+
+	var results []*registry.Result
+	if !ok && len(services) == 0 {
+		// the service is unknown to the watcher, pass the delete through
+		if t, err := res.EventType(); err == nil && t == registry.Delete {
+			results = append(results, res)
+		}
+	} else {
+		results = registry.Diff(prev, services)
+	}
+
+	if len(services) == 0 && len(mw.wo.Service) == 0 {
+		delete(mw.services, name)
+	} else {
+		mw.services[name] = services
+	}
+
+	for _, r := range results {
+		select {
+		case <-mw.exit:
+			return
+		case mw.next <- r:
+		}
+	}
+}
+
+func (mw *multiWatcher) run() {
+	for {
+		select {
+		case <-mw.exit:
+			return
+		case res := <-mw.events:
+			mw.handle(res)
+		}
+	}
+}
+
+func (mw *multiWatcher) Next() (*registry.Result, error) {
+	select {
+	case <-mw.exit:
+		return nil, registry.ErrWatcherStopped
+	case r := <-mw.next:
+		return r, nil
+	}
+}
+
+func (mw *multiWatcher) Stop() {
+	mw.once.Do(func() {
+		close(mw.exit)
+	})
+
+	mw.wg.Wait()
+}
@@ -7,11 +7,21 @@ import (
 )
 
 type Options struct {
-	Versions  []string
+	Versions []string
+	// Scheme of the targets and the resolver builder of the registry,
+	// each registry has its own by default, e.g. etcd or consul.
+	// NewTarget returns targets of this scheme instead of "registry",
+	// they are resolved once the builder is registered by RegisterBuilder.
+	Scheme string
+	// Namespace isolates the services, e.g. of an environment,
+	// it is the authority of the target
+	Namespace string
 	Addrs     []string
 	Timeout   time.Duration
 	Secure    bool
 	TLSConfig *tls.Config
+	// Codec encodes the stored services, DefaultCodec if nil
+	Codec Codec
 	// Other options for implementations of the interface
 	// can be stored in a context
 	Context context.Context
@@ -33,10 +43,47 @@ type WatchOptions struct {
 	Context context.Context
 }
 
+type RegistrarOptions struct {
+	// TTL of the registration, 0 registers without expiry
+	TTL time.Duration
+	// Interval of re-registering, defaults to a third of the TTL
+	Interval time.Duration
+	// MaxBackoff bounds the retry delay after a failed registration,
+	// defaults to the interval
+	MaxBackoff time.Duration
+	// RegisterOptions are passed to each Register call
+	RegisterOptions []RegisterOption
+	// Other options for implementations of the interface
+	// can be stored in a context
+	Context context.Context
+}
+
 // Versions is the target version filter
-func Versions(addrs ...string) Option {
+func Versions(versions ...string) Option {
 	return func(o *Options) {
-		o.Addrs = addrs
+		o.Versions = versions
+	}
+}
+
+// Scheme is the scheme of the registry, to resolve two registries
+// of the same kind apart
+func Scheme(scheme string) Option {
+	return func(o *Options) {
+		o.Scheme = scheme
+	}
+}
+
+// Namespace is the namespace of the registry or the target
+func Namespace(ns string) Option {
+	return func(o *Options) {
+		o.Namespace = ns
+	}
+}
+
+// WithCodec is the codec of the stored services
+func WithCodec(c Codec) Option {
+	return func(o *Options) {
+		o.Codec = c
 	}
 }
 
@@ -79,3 +126,31 @@ func WatchService(name string) WatchOption {
 		o.Service = name
 	}
 }
+
+// RegistrarTTL is the TTL the service is registered with
+func RegistrarTTL(t time.Duration) RegistrarOption {
+	return func(o *RegistrarOptions) {
+		o.TTL = t
+	}
+}
+
+// RegistrarInterval is the interval of re-registering the service
+func RegistrarInterval(t time.Duration) RegistrarOption {
+	return func(o *RegistrarOptions) {
+		o.Interval = t
+	}
+}
+
+// RegistrarMaxBackoff is the max retry delay after a failed registration
+func RegistrarMaxBackoff(t time.Duration) RegistrarOption {
+	return func(o *RegistrarOptions) {
+		o.MaxBackoff = t
+	}
+}
+
+// RegistrarRegisterOptions are passed to each Register call
+func RegistrarRegisterOptions(opts ...RegisterOption) RegistrarOption {
+	return func(o *RegistrarOptions) {
+		o.RegisterOptions = opts
+	}
+}
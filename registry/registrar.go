@@ -0,0 +1,205 @@
+package registry
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/grpclog"
+)
+
+var (
+	// registrar interval when the service is registered without TTL
+	registrarInterval = 30 * time.Second
+	// registrar first retry delay after a failed registration
+	registrarRetryTime = time.Second
+	// registrar jitter applied to each delay, as a fraction of it
+	registrarJitter = 0.1
+
+	// registrarRand is seeded per process so the instances don't re-register in step
+	registrarRand   = rand.New(rand.NewSource(time.Now().UnixNano()))
+	registrarRandMu sync.Mutex
+)
+
+// RegistrarStatus is the registration health of a service
+type RegistrarStatus struct {
+	// Registered is true if the last successful registration
+	// has not expired yet
+	Registered bool
+	// LastRegistered is the time of the last successful registration
+	LastRegistered time.Time
+	// LastError is the error of the last registration, nil if it succeeded
+	LastError error
+	// Failures is the number of consecutive failed registrations
+	Failures int
+}
+
+// Registrar keeps a service registered, it re-registers the service
+// at an interval derived from the TTL and deregisters it when stopped.
+type Registrar struct {
+	registry Registry
+	service  *Service
+	options  RegistrarOptions
+
+	sync.RWMutex
+	status  RegistrarStatus
+	running bool
+	exit    chan bool
+	done    chan bool
+}
+
+// NewRegistrar returns a registrar of the service in the registry
+func NewRegistrar(r Registry, s *Service, opts ...RegistrarOption) *Registrar {
+	options := RegistrarOptions{}
+	for _, o := range opts {
+		o(&options)
+	}
+
+	if options.Interval <= 0 {
+		if options.TTL > 0 {
+			options.Interval = options.TTL / 3
+		} else {
+			options.Interval = registrarInterval
+		}
+	}
+	if options.MaxBackoff <= 0 {
+		options.MaxBackoff = options.Interval
+	}
+
+	return &Registrar{
+		registry: r,
+		service:  s,
+		options:  options,
+	}
+}
+
+// jitter spreads the delay by registrarJitter in both directions
+func jitter(d time.Duration) time.Duration {
+	registrarRandMu.Lock()
+	f := registrarRand.Float64()
+	registrarRandMu.Unlock()
+
+	delta := time.Duration(float64(d) * registrarJitter * (2*f - 1))
+	return d + delta
+}
+
+// backoff returns the retry delay after the failures
+func (r *Registrar) backoff(failures int) time.Duration {
+	d := registrarRetryTime
+	for i := 1; i < failures && d < r.options.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > r.options.MaxBackoff {
+		d = r.options.MaxBackoff
+	}
+	return d
+}
+
+func (r *Registrar) register() error {
+	opts := r.options.RegisterOptions
+	if r.options.TTL > 0 {
+		opts = append([]RegisterOption{RegisterTTL(r.options.TTL)}, opts...)
+	}
+
+	err := r.registry.Register(r.service, opts...)
+
+	r.Lock()
+	r.status.LastError = err
+	if err != nil {
+		r.status.Failures++
+	} else {
+		r.status.Failures = 0
+		r.status.LastRegistered = time.Now()
+	}
+	r.Unlock()
+
+	return err
+}
+
+func (r *Registrar) run(exit, done chan bool) {
+	defer close(done)
+
+	for {
+		r.RLock()
+		failures := r.status.Failures
+		r.RUnlock()
+
+		d := r.options.Interval
+		if failures > 0 {
+			d = r.backoff(failures)
+		}
+
+		select {
+		case <-exit:
+			return
+		case <-time.After(jitter(d)):
+		}
+
+		if err := r.register(); err != nil {
+			grpclog.Warningf("grpc-contrib.registry: registrar register %s error: %v", r.service.Name, err)
+		}
+	}
+}
+
+// Start registers the service and keeps it registered until Stop,
+// the error of the first registration is returned but the registrar
+// keeps retrying in the background.
+func (r *Registrar) Start() error {
+	r.Lock()
+	if r.running {
+		r.Unlock()
+		return errors.New("registrar already started")
+	}
+	r.running = true
+	r.exit = make(chan bool)
+	r.done = make(chan bool)
+	exit, done := r.exit, r.done
+	r.Unlock()
+
+	err := r.register()
+
+	go r.run(exit, done)
+
+	return err
+}
+
+// Stop stops re-registering and deregisters the service
+func (r *Registrar) Stop() error {
+	r.Lock()
+	if !r.running {
+		r.Unlock()
+		return nil
+	}
+	r.running = false
+	close(r.exit)
+	done := r.done
+	r.Unlock()
+
+	<-done
+
+	err := r.registry.Deregister(r.service)
+
+	r.Lock()
+	r.status = RegistrarStatus{LastError: err}
+	r.Unlock()
+
+	return err
+}
+
+// Status returns the registration health of the service
+func (r *Registrar) Status() RegistrarStatus {
+	r.RLock()
+	defer r.RUnlock()
+
+	status := r.status
+	status.Registered = r.running && !status.LastRegistered.IsZero() &&
+		(r.options.TTL <= 0 || time.Since(status.LastRegistered) < r.options.TTL)
+
+	return status
+}
+
+// Healthy returns true if the service is registered
+func (r *Registrar) Healthy() bool {
+	return r.Status().Registered
+}
@@ -0,0 +1,136 @@
+package registry
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyRegistry fails the first registrations and counts the others,
+// the register options are dropped so the memory registry doesn't expire them
+type flakyRegistry struct {
+	Registry
+
+	sync.Mutex
+	fails int
+	count int
+	ttl   time.Duration
+	// registered is signaled on each registration, if set
+	registered chan struct{}
+}
+
+func (f *flakyRegistry) Register(s *Service, opts ...RegisterOption) error {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.fails > 0 {
+		f.fails--
+		return errors.New("registry is down")
+	}
+
+	var options RegisterOptions
+	for _, o := range opts {
+		o(&options)
+	}
+	f.ttl = options.TTL
+	f.count++
+	if f.registered != nil {
+		select {
+		case f.registered <- struct{}{}:
+		default:
+		}
+	}
+
+	return f.Registry.Register(s)
+}
+
+func TestRegistrar(t *testing.T) {
+	m := &flakyRegistry{Registry: NewRegistry(), registered: make(chan struct{}, 1)}
+	s := testService
+
+	start := time.Now()
+	r := NewRegistrar(m, s, RegistrarTTL(300*time.Millisecond))
+	if err := r.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Start(); err == nil {
+		t.Fatal("Expected error when starting twice")
+	}
+
+	// re-registered about every 100ms, a third of the TTL
+	deadline := time.After(5 * time.Second)
+	for registrations := 0; registrations < 5; registrations++ {
+		select {
+		case <-m.registered:
+		case <-deadline:
+			t.Fatalf("Expected 5 registrations, got %d", registrations)
+		}
+	}
+	if min, act := 3*90*time.Millisecond, time.Since(start); act < min {
+		t.Fatalf("Expected the registrations to take %v at least, took %v", min, act)
+	}
+
+	m.Lock()
+	ttl := m.ttl
+	m.Unlock()
+
+	if exp, act := 300*time.Millisecond, ttl; exp != act {
+		t.Fatalf("Expected TTL %v, got %v", exp, act)
+	}
+	if !r.Healthy() {
+		t.Fatalf("Expected registrar to be healthy, got %+v", r.Status())
+	}
+
+	if err := r.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.GetService(s.Name); err != ErrNotFound {
+		t.Fatalf("Expected %v after stop, got %v", ErrNotFound, err)
+	}
+	if r.Healthy() {
+		t.Fatal("Expected registrar to be unhealthy after stop")
+	}
+}
+
+func TestRegistrarBackoff(t *testing.T) {
+	registrarRetryTime = 10 * time.Millisecond
+	defer func() {
+		registrarRetryTime = time.Second
+	}()
+
+	m := &flakyRegistry{Registry: NewRegistry(), fails: 3}
+	s := testService
+
+	r := NewRegistrar(m, s, RegistrarTTL(time.Minute))
+	defer r.Stop()
+
+	if err := r.Start(); err == nil {
+		t.Fatal("Expected error of the first registration")
+	}
+
+	status := r.Status()
+	if status.Registered || status.Failures != 1 || status.LastError == nil {
+		t.Fatalf("Expected unhealthy status with 1 failure, got %+v", status)
+	}
+
+	// retried with backoff well before the interval
+	deadline := time.Now().Add(time.Second)
+	for !r.Healthy() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected registrar to recover, got %+v", r.Status())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := m.GetService(s.Name); err != nil {
+		t.Fatalf("Expected service to be registered, got %v", err)
+	}
+
+	if exp, act := 40*time.Millisecond, r.backoff(3); exp != act {
+		t.Fatalf("Expected backoff %v, got %v", exp, act)
+	}
+	if exp, act := 20*time.Second, r.backoff(100); exp != act {
+		t.Fatalf("Expected backoff %v, got %v", exp, act)
+	}
+}
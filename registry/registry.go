@@ -35,6 +35,8 @@ type RegisterOption func(*RegisterOptions)
 
 type WatchOption func(*WatchOptions)
 
+type RegistrarOption func(*RegistrarOptions)
+
 func NewTarget(s *Service, opts ...Option) string {
 	return DefaultRegistry.NewTarget(s, opts...)
 }
@@ -0,0 +1,36 @@
+package registry_test
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/hb-go/grpc-contrib/registry"
+	"github.com/hb-go/grpc-contrib/registry/memory"
+)
+
+// TestMain runs the tests of the registry, the internal ones too,
+// against the in-process registry
+func TestMain(m *testing.M) {
+	registry.NewDefault = memory.NewRegistry
+	registry.DefaultRegistry = memory.NewRegistry()
+	os.Exit(m.Run())
+}
+
+func TestVersions(t *testing.T) {
+	var o registry.Options
+	registry.Versions("1.0.0", "1.0.1")(&o)
+
+	// the versions are the filter of the target, not the addresses
+	if exp, act := []string{"1.0.0", "1.0.1"}, o.Versions; !reflect.DeepEqual(exp, act) {
+		t.Fatalf("Expected versions %v, got %v", exp, act)
+	}
+	if len(o.Addrs) != 0 {
+		t.Fatalf("Expected no addresses, got %v", o.Addrs)
+	}
+
+	s := &registry.Service{Name: "foo"}
+	if exp, act := "memory:///foo?version=1.0.0|1.0.1", registry.NewTarget(s, registry.Versions("1.0.0", "1.0.1")); exp != act {
+		t.Fatalf("Expected %s, got %s", exp, act)
+	}
+}
@@ -2,11 +2,14 @@ package registry
 
 import (
 	"context"
-	"errors"
+	"fmt"
+	"math/rand"
 	"net/url"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"golang.org/x/time/rate"
 	"google.golang.org/grpc/grpclog"
@@ -18,23 +21,50 @@ const watchLimit = 1.0
 const watchBurst = 3
 const queryValSeq = "|"
 
+// ResolveNow refreshes the service once per second at most
+const resolveNowLimit = 1.0
+
+// backoff of re-creating a failed watcher
+const (
+	watchBackoff    = time.Second
+	watchMaxBackoff = 2 * time.Minute
+)
+
 // implementation of grpc.resolve.Builder
 type registryBuilder struct {
 	registry Registry
+	scheme   string
 
 	mu        sync.RWMutex
 	resolvers map[string]*service
 }
 
 type service struct {
-	name string
+	// key of the service in registryBuilder.resolvers
+	key       string
+	name      string
+	namespace string
 
 	builder *registryBuilder
 
-	mu       sync.RWMutex
-	watching bool
-	nodes    map[string][]resolver.Address
-
+	// references of the resolvers, guarded by the lock of the builder
+	refs int
+
+	mu      sync.RWMutex
+	watcher Watcher
+	// done is closed when the service isn't resolved anymore
+	done chan struct{}
+	// limiter of the refreshes by ResolveNow
+	limiter *rate.Limiter
+	// resolveNow signals the watch loop to refresh, so the snapshot
+	// is changed by the watch loop only
+	resolveNow chan struct{}
+	// the snapshot of the addresses by version and node Id
+	versions map[string]map[string]resolver.Address
+
+	// serializes the updates of the ClientConns, so an older snapshot
+	// never arrives after a newer one
+	updateMu  sync.Mutex
 	conns     sync.Map
 	connIndex int64
 }
@@ -46,16 +76,28 @@ type registryResolver struct {
 
 	index int64
 	cc    resolver.ClientConn
+	once  sync.Once
 }
 
-// Scheme
+// Scheme is the scheme of the registry
 func (b *registryBuilder) Scheme() string {
-	return schema
+	return b.scheme
+}
+
+// aliasBuilder resolves the targets of another scheme by the builder
+type aliasBuilder struct {
+	*registryBuilder
+	scheme string
+}
+
+// Scheme is the alias
+func (b *aliasBuilder) Scheme() string {
+	return b.scheme
 }
 
 // Build to resolver.Resolver
-// target: {schema}://[authority]/{serviceName}[?version=v1]
-// target使用query参数做version筛选
+// target: {scheme}://[authority]/{serviceName}[?version=v1]
+// target使用query参数做version筛选, authority为namespace
 func (b *registryBuilder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
 	var serviceName string
 	var serviceVersion []string
@@ -74,96 +116,67 @@ func (b *registryBuilder) Build(target resolver.Target, cc resolver.ClientConn,
 
 	// TODO resolver 需要根据 endpoint 记录 ClientConn，版本等筛选信息属于 client
 
+	// services of different namespaces are resolved apart
+	key := target.Authority + "/" + serviceName
+
 	b.mu.Lock()
-	s, ok := b.resolvers[serviceName]
+	s, ok := b.resolvers[key]
+	if !ok {
+		s = &service{
+			key:       key,
+			name:      serviceName,
+			namespace: target.Authority,
+			builder:   b,
+			versions:  make(map[string]map[string]resolver.Address),
+			done:      make(chan struct{}),
+			limiter:   rate.NewLimiter(rate.Limit(resolveNowLimit), 1),
+
+			resolveNow: make(chan struct{}, 1),
+		}
+		b.resolvers[key] = s
+	}
+	// each resolver holds a reference of the service
+	s.refs++
+
 	if ok {
 		b.mu.Unlock()
 
 		// 使用当前service nodes
 		s.mu.Lock()
-		var ccNodes []resolver.Address
-		if len(serviceVersion) == 0 {
-			ccNodes = make([]resolver.Address, 0, len(s.nodes))
-			for _, v := range s.nodes {
-				ccNodes = append(ccNodes, v...)
-			}
-		} else {
-			for _, v := range serviceVersion {
-				if nodes, ok := s.nodes[v]; ok {
-					ccNodes = append(ccNodes, nodes...)
-				}
-			}
-		}
 
-		// TODO 检查watching状态?
-		if !s.watching {
-			err := s.watch()
-			if err != nil {
-				s.mu.Unlock()
-				return nil, err
-			}
-			s.watching = true
+		// the service failed to load meanwhile
+		if s.stopped() {
+			s.mu.Unlock()
+			b.release(s)
+			return b.Build(target, cc, opts)
 		}
-		s.mu.Unlock()
-
-		cc.UpdateState(resolver.State{Addresses: ccNodes})
 	} else {
-		s = &service{
-			name:    serviceName,
-			builder: b,
-			nodes:   make(map[string][]resolver.Address),
-		}
-		b.resolvers[s.name] = s
-
 		s.mu.Lock()
 		b.mu.Unlock()
 
-		// 从registry获取services
-		services, err := b.registry.GetService(s.name)
-		if err != nil {
-			s.mu.Unlock()
-			return nil, err
-		}
-
-		count := 0
-		for _, svc := range services {
-			nodes := make([]resolver.Address, 0, len(svc.Nodes))
-			for _, n := range svc.Nodes {
-				addr := resolver.Address{
-					Addr: n.Address,
-				}
-				nodes = append(nodes, addr)
+		// watch before the snapshot, the changes meanwhile are applied after it
+		err := s.watch()
+		if err == nil {
+			// 从registry获取services
+			var services []*Service
+			services, err = WithContext(b.registry).GetServiceContext(s.context(), s.name)
+			// a service without nodes yet is an empty snapshot, the watch adds them
+			if err == nil || err == ErrNotFound {
+				s.load(services)
+				err = nil
 			}
-			s.nodes[svc.Version] = nodes
-			count++
 		}
-
-		var ccNodes []resolver.Address
-		if len(serviceVersion) == 0 {
-			ccNodes = make([]resolver.Address, 0, count)
-			for _, v := range s.nodes {
-				ccNodes = append(ccNodes, v...)
-			}
-		} else {
-			for _, v := range serviceVersion {
-				if nodes, ok := s.nodes[v]; ok {
-					ccNodes = append(ccNodes, nodes...)
-				}
-			}
-		}
-
-		err = s.watch()
 		if err != nil {
+			// resolved by a new service next time
+			s.stop()
 			s.mu.Unlock()
+			b.release(s)
 			return nil, err
 		}
-
-		s.watching = true
-		s.mu.Unlock()
-
-		cc.UpdateState(resolver.State{Addresses: ccNodes})
 	}
 
+	s.mu.Unlock()
+
 	index := atomic.AddInt64(&s.connIndex, 1)
 	r := &registryResolver{
 		service:  s,
@@ -174,138 +187,398 @@ func (b *registryBuilder) Build(target resolver.Target, cc resolver.ClientConn,
 	}
 
 	s.conns.Store(index, r)
+	r.update()
 	return r, nil
 }
 
-// ResolveNow
+// ResolveNow refreshes the service by GetService in the watch loop,
+// rate limited as gRPC calls it on each connection failure
 func (r *registryResolver) ResolveNow(rn resolver.ResolveNowOptions) {
+	if !r.service.limiter.Allow() {
+		return
+	}
+
+	select {
+	case r.service.resolveNow <- struct{}{}:
+	default:
+	}
 }
 
-// Close
+// Close releases the service, the watcher is stopped with the last resolver
 func (r *registryResolver) Close() {
-	r.service.conns.Delete(r.index)
+	r.once.Do(func() {
+		r.service.conns.Delete(r.index)
+		r.service.builder.release(r.service)
+	})
+}
+
+// release releases a reference of the service, the last one stops
+// the watcher and evicts the service. A stopped service is evicted as well.
+func (b *registryBuilder) release(s *service) {
+	b.mu.Lock()
+	s.refs--
+	last := s.refs == 0
+	if (last || s.stopped()) && b.resolvers[s.key] == s {
+		delete(b.resolvers, s.key)
+	}
+	b.mu.Unlock()
+
+	if last {
+		s.mu.Lock()
+		s.stop()
+		s.mu.Unlock()
+	}
+}
+
+// context returns the context of the registry calls, scoped to the namespace of the target
+func (s *service) context() context.Context {
+	if len(s.namespace) == 0 {
+		return context.Background()
+	}
+	return NewNamespaceContext(context.Background(), s.namespace)
 }
 
+// watch starts the watch loop of the service, the caller must hold the lock
 func (s *service) watch() error {
-	watcher, err := s.builder.registry.Watch(WatchService(s.name))
+	watcher, err := WithContext(s.builder.registry).WatchContext(s.context(), WatchService(s.name))
 	if err != nil {
 		return err
 	}
+	s.watcher = watcher
+
+	go s.run(watcher)
+	return nil
+}
+
+// next is a result of a watcher
+type next struct {
+	result *Result
+	err    error
+}
+
+// pump sends the results of the watcher to the watch loop until it fails
+func pump(watcher Watcher, results chan<- next, done <-chan struct{}) {
+	for {
+		result, err := watcher.Next()
+		select {
+		case results <- next{result: result, err: err}:
+		case <-done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
 
-	go func(watcher Watcher) {
-		limiter := rate.NewLimiter(rate.Limit(watchLimit), watchBurst)
-		for {
-			limiter.Wait(context.Background())
-			if result, err := watcher.Next(); err == nil {
-				if err := s.process(result); err == nil {
-					s.conns.Range(func(key, value interface{}) bool {
-						if r, ok := value.(*registryResolver); ok {
-							var allNodes []resolver.Address
-							if len(r.versions) == 0 {
-								for _, v := range s.nodes {
-									allNodes = append(allNodes, v...)
-								}
-							} else {
-								for _, v := range r.versions {
-									if nodes, ok := s.nodes[v]; ok {
-										allNodes = append(allNodes, nodes...)
-									}
-								}
-							}
-
-							r.cc.UpdateState(resolver.State{Addresses: allNodes})
-						} else {
-							grpclog.Warning("grpc-contrib.registry: resolver conv error")
-						}
-
-						return true
-					})
+// run is the watch loop, it applies the results of the watcher and the
+// refreshes of ResolveNow in order. A failed watcher is re-created.
+func (s *service) run(watcher Watcher) {
+	limiter := rate.NewLimiter(rate.Limit(watchLimit), watchBurst)
+	results := make(chan next)
+	go pump(watcher, results, s.done)
+
+	for {
+		limiter.Wait(context.Background())
+
+		select {
+		case <-s.done:
+			return
+		case <-s.resolveNow:
+			if err := s.refresh(); err != nil {
+				grpclog.Warningf("grpc-contrib.registry: resolver refresh error: %v", err)
+				s.reportError(err)
+				continue
+			}
+			s.update()
+		case n := <-results:
+			if n.err == nil {
+				if err := s.process(n.result); err == nil {
+					s.update()
 				} else {
 					grpclog.Warningf("grpc-contrib.registry: %v", err)
+					s.reportError(err)
 				}
-			} else {
-				grpclog.Warningf("grpc-contrib.registry: resolver watch error: %v", err)
-				if err == ErrWatcherStopped {
-					return
-				}
+				continue
 			}
-		}
-	}(watcher)
 
-	return nil
-}
+			if s.stopped() {
+				return
+			}
 
-func (s *service) process(res *Result) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+			grpclog.Warningf("grpc-contrib.registry: resolver watch error: %v", n.err)
+			s.reportError(n.err)
+			watcher.Stop()
 
-	switch res.Action {
-	case "create", "update":
-		nodes := make([]resolver.Address, 0, len(res.Service.Nodes))
-		for _, n := range res.Service.Nodes {
-			node := resolver.Address{
-				Addr: n.Address,
+			if watcher = s.rewatch(); watcher == nil {
+				return
 			}
-			nodes = append(nodes, node)
+			results = make(chan next)
+			go pump(watcher, results, s.done)
 		}
+	}
+}
 
-		// append old nodes to new service
-		if curNodes, ok := s.nodes[res.Service.Version]; ok {
-			for _, node := range curNodes {
-				var seen bool
-				for _, n := range nodes {
-					if node.Addr == n.Addr {
-						seen = true
-						break
-					}
-				}
-
-				if !seen {
-					nodes = append(nodes, node)
-				}
-			}
+// rewatch re-creates the watcher with exponential backoff, nil if the
+// service is stopped. The snapshot is reloaded as the changes meanwhile are missed.
+func (s *service) rewatch() Watcher {
+	for retries := 0; ; retries++ {
+		select {
+		case <-s.done:
+			return nil
+		case <-time.After(backoff(retries)):
 		}
 
-		s.nodes[res.Service.Version] = nodes
-		return nil
+		watcher, err := WithContext(s.builder.registry).WatchContext(s.context(), WatchService(s.name))
+		if err != nil {
+			grpclog.Warningf("grpc-contrib.registry: resolver watch error: %v", err)
+			s.reportError(err)
+			continue
+		}
 
-	case "delete":
-		if curNodes, ok := s.nodes[res.Service.Version]; !ok {
+		s.mu.Lock()
+		if s.stopped() {
+			s.mu.Unlock()
+			watcher.Stop()
 			return nil
+		}
+		s.watcher = watcher
+		s.mu.Unlock()
+
+		if err := s.refresh(); err != nil {
+			grpclog.Warningf("grpc-contrib.registry: resolver refresh error: %v", err)
+			s.reportError(err)
 		} else {
-			var nodes []resolver.Address
-
-			// filter cur nodes to remove the dead one
-			for _, cur := range curNodes {
-				var seen bool
-				for _, del := range res.Service.Nodes {
-					if del.Address == cur.Addr {
-						seen = true
-						break
-					}
-				}
-				if !seen {
-					nodes = append(nodes, cur)
-				}
-			}
+			s.update()
+		}
+		return watcher
+	}
+}
 
-			s.nodes[res.Service.Version] = nodes
-			return nil
+// backoff returns the delay of the retry, doubled up to watchMaxBackoff with 20% jitter
+func backoff(retries int) time.Duration {
+	d := watchBackoff
+	for i := 0; i < retries && d < watchMaxBackoff; i++ {
+		d *= 2
+	}
+	if d > watchMaxBackoff {
+		d = watchMaxBackoff
+	}
+
+	jitter := 0.8 + 0.4*rand.Float64()
+	return time.Duration(float64(d) * jitter)
+}
+
+// stop stops the watcher of the service, the caller must hold the lock
+func (s *service) stop() {
+	if s.stopped() {
+		return
+	}
+
+	close(s.done)
+	if s.watcher != nil {
+		s.watcher.Stop()
+	}
+}
+
+func (s *service) stopped() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// reportError reports the discovery error to the ClientConns
+func (s *service) reportError(err error) {
+	s.conns.Range(func(key, value interface{}) bool {
+		if r, ok := value.(*registryResolver); ok {
+			r.cc.ReportError(err)
+		}
+		return true
+	})
+}
+
+// update updates the ClientConns with the addresses of their versions
+func (s *service) update() {
+	s.conns.Range(func(key, value interface{}) bool {
+		if r, ok := value.(*registryResolver); ok {
+			r.update()
+		} else {
+			grpclog.Warning("grpc-contrib.registry: resolver conv error")
+		}
+
+		return true
+	})
+}
+
+// update updates the ClientConn with the addresses of the current snapshot,
+// they are computed and sent under the update lock of the service
+func (r *registryResolver) update() {
+	s := r.service
+	s.updateMu.Lock()
+	defer s.updateMu.Unlock()
+
+	s.mu.RLock()
+	addrs := s.addresses(r.versions)
+	s.mu.RUnlock()
+
+	r.cc.UpdateState(resolver.State{Addresses: addrs})
+}
+
+// addresses returns the addresses of the versions, of all if none,
+// ordered by version and node Id. The caller must hold the lock.
+func (s *service) addresses(versions []string) []resolver.Address {
+	if len(versions) == 0 {
+		versions = make([]string, 0, len(s.versions))
+		for v := range s.versions {
+			versions = append(versions, v)
+		}
+		sort.Strings(versions)
+	}
+
+	var addrs []resolver.Address
+	for _, v := range versions {
+		nodes := s.versions[v]
+		ids := make([]string, 0, len(nodes))
+		for id := range nodes {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+
+		for _, id := range ids {
+			addrs = append(addrs, nodes[id])
+		}
+	}
+	return addrs
+}
+
+// load replaces the snapshot with the services, the caller must hold the lock
+func (s *service) load(services []*Service) {
+	s.versions = make(map[string]map[string]resolver.Address, len(services))
+	for _, svc := range services {
+		for _, n := range svc.Nodes {
+			s.put(svc, n)
+		}
+	}
+}
+
+// put puts the node into the snapshot, a node moved to another version
+// is removed from the old one. The caller must hold the lock.
+func (s *service) put(svc *Service, n *Node) {
+	for v := range s.versions {
+		if v != svc.Version {
+			s.remove(v, n.Id)
 		}
+	}
+
+	nodes, ok := s.versions[svc.Version]
+	if !ok {
+		nodes = make(map[string]resolver.Address)
+		s.versions[svc.Version] = nodes
+	}
+	nodes[n.Id] = newAddress(svc, n)
+}
+
+// remove removes the node from the version, the caller must hold the lock
+func (s *service) remove(version, id string) {
+	nodes, ok := s.versions[version]
+	if !ok {
+		return
+	}
+
+	delete(nodes, id)
+	if len(nodes) == 0 {
+		delete(s.versions, version)
+	}
+}
+
+// refresh reloads the snapshot by GetService
+func (s *service) refresh() error {
+	services, err := WithContext(s.builder.registry).GetServiceContext(s.context(), s.name)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+
+	s.mu.Lock()
+	s.load(services)
+	s.mu.Unlock()
+	return nil
+}
+
+// exact reports whether the nodes of the result are known by Id,
+// else the snapshot can't be patched by the result.
+func exact(res *Result) bool {
+	if res.Service == nil || len(res.Service.Nodes) == 0 {
+		return false
+	}
+	for _, n := range res.Service.Nodes {
+		if len(n.Id) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// process applies the result to the snapshot by node Id, the snapshot
+// is reloaded if the result doesn't tell the nodes, e.g. the entire service is deleted.
+func (s *service) process(res *Result) error {
+	action, err := res.EventType()
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case Create, Update, Delete:
 	default:
-		return errors.New("un supported result action")
+		return fmt.Errorf("unsupported event type %v", action)
+	}
+
+	if !exact(res) {
+		return s.refresh()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, n := range res.Service.Nodes {
+		if action == Delete {
+			s.remove(res.Service.Version, n.Id)
+		} else {
+			s.put(res.Service, n)
+		}
 	}
+	return nil
+}
+
+// schemeOf returns the scheme of the registry, "registry" if it has none
+func schemeOf(r Registry) string {
+	if scheme := r.Options().Scheme; len(scheme) > 0 {
+		return scheme
+	}
+	return schema
 }
 
 // newBuilder return resolver builder
 func newBuilder(r Registry) resolver.Builder {
 	return &registryBuilder{
 		registry:  r,
+		scheme:    schemeOf(r),
 		resolvers: make(map[string]*service),
 	}
 }
 
+// RegisterBuilder registers the resolver builder for the scheme of the registry,
+// so the registries of different schemes are resolved side by side.
+// The builder of the DefaultRegistry, or else of the first registry, resolves
+// the targets of the scheme "registry" as well. It must be called before
+// dialing the targets of NewTarget, they have the scheme of the registry.
 func RegisterBuilder(r Registry) {
-	b := newBuilder(r)
+	b := newBuilder(r).(*registryBuilder)
 	resolver.Register(b)
+
+	if b.scheme != schema && (r == DefaultRegistry || resolver.Get(schema) == nil) {
+		resolver.Register(&aliasBuilder{registryBuilder: b, scheme: schema})
+	}
 }
@@ -0,0 +1,407 @@
+package registry
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/resolver"
+)
+
+type testClientConn struct {
+	resolver.ClientConn
+
+	mu     sync.Mutex
+	states []resolver.State
+	errs   []error
+}
+
+func (cc *testClientConn) UpdateState(s resolver.State) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.states = append(cc.states, s)
+}
+
+func (cc *testClientConn) ReportError(err error) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.errs = append(cc.errs, err)
+}
+
+// state returns the last state, waits for it to be accepted if not
+func (cc *testClientConn) state(t *testing.T, accept func(resolver.State) bool) resolver.State {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		cc.mu.Lock()
+		var s resolver.State
+		if len(cc.states) > 0 {
+			s = cc.states[len(cc.states)-1]
+		}
+		cc.mu.Unlock()
+
+		if accept(s) {
+			return s
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Unexpected state %+v", s)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestResolverAttributes(t *testing.T) {
+	r := NewRegistry()
+	s := &Service{
+		Name:    "attrs",
+		Version: "1.0.0",
+		Nodes: []*Node{
+			{Id: "attrs-1", Address: "127.0.0.1:8080", Metadata: map[string]string{"zone": "a"}},
+		},
+	}
+	if err := r.Register(s); err != nil {
+		t.Fatal(err)
+	}
+
+	cc := &testClientConn{}
+	rr, err := newBuilder(r).Build(resolver.Target{Endpoint: "attrs"}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rr.Close()
+
+	state := cc.state(t, func(s resolver.State) bool { return len(s.Addresses) == 1 })
+	addr := state.Addresses[0]
+
+	if id, ok := NodeIdFromAddress(addr); !ok || id != "attrs-1" {
+		t.Fatalf("Expected node Id attrs-1, got %q", id)
+	}
+	if v, ok := VersionFromAddress(addr); !ok || v != "1.0.0" {
+		t.Fatalf("Expected version 1.0.0, got %q", v)
+	}
+	if md, ok := MetadataFromAddress(addr); !ok || md["zone"] != "a" {
+		t.Fatalf("Expected zone a, got %v", md)
+	}
+
+	if _, ok := NodeIdFromAddress(resolver.Address{Addr: addr.Addr}); ok {
+		t.Fatalf("Expected no node Id of an address without attributes")
+	}
+}
+
+func TestResolverSnapshot(t *testing.T) {
+	r := NewRegistry()
+	node := &Node{Id: "snap-1", Address: "127.0.0.1:8080"}
+	s := &Service{Name: "snap", Version: "1.0.0", Nodes: []*Node{node}}
+	if err := r.Register(s); err != nil {
+		t.Fatal(err)
+	}
+
+	cc := &testClientConn{}
+	rr, err := newBuilder(r).Build(resolver.Target{Endpoint: "snap"}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rr.Close()
+
+	addrs := func(s resolver.State) []string {
+		var as []string
+		for _, a := range s.Addresses {
+			as = append(as, a.Addr)
+		}
+		return as
+	}
+	equal := func(exp ...string) func(resolver.State) bool {
+		return func(s resolver.State) bool {
+			return reflect.DeepEqual(exp, addrs(s))
+		}
+	}
+
+	cc.state(t, equal("127.0.0.1:8080"))
+
+	// the node changes the address, the old one is removed
+	node.Address = "127.0.0.1:8081"
+	if err := r.Register(s); err != nil {
+		t.Fatal(err)
+	}
+	cc.state(t, equal("127.0.0.1:8081"))
+
+	other := &Service{Name: "snap", Version: "1.0.0", Nodes: []*Node{{Id: "snap-2", Address: "127.0.0.1:8082"}}}
+	if err := r.Register(other); err != nil {
+		t.Fatal(err)
+	}
+	cc.state(t, equal("127.0.0.1:8081", "127.0.0.1:8082"))
+
+	// and the deregistered nodes
+	if err := r.Deregister(s); err != nil {
+		t.Fatal(err)
+	}
+	cc.state(t, equal("127.0.0.1:8082"))
+
+	// a delete of the entire service reloads the snapshot
+	b := rr.(*registryResolver).service
+	if err := b.process(NewResult(Delete, &Service{Name: "snap"})); err != nil {
+		t.Fatal(err)
+	}
+	b.mu.RLock()
+	if exp, act := []string{"127.0.0.1:8082"}, addrs(resolver.State{Addresses: b.addresses(nil)}); !reflect.DeepEqual(exp, act) {
+		t.Fatalf("Expected %v, got %v", exp, act)
+	}
+	b.mu.RUnlock()
+}
+
+// testRegistry counts the calls, its watchers fail or block if set
+type testRegistry struct {
+	Registry
+
+	gets    int32
+	watches int32
+	// the number of watchers to fail
+	fail int32
+	// the watchers block without events
+	block bool
+	// the error of GetService
+	err error
+}
+
+type testWatcher struct {
+	err  error
+	exit chan struct{}
+	once sync.Once
+}
+
+func (w *testWatcher) Next() (*Result, error) {
+	if w.err != nil {
+		return nil, w.err
+	}
+	<-w.exit
+	return nil, ErrWatcherStopped
+}
+
+func (w *testWatcher) Stop() {
+	w.once.Do(func() { close(w.exit) })
+}
+
+func (r *testRegistry) GetService(name string) ([]*Service, error) {
+	atomic.AddInt32(&r.gets, 1)
+	if r.err != nil {
+		return nil, r.err
+	}
+	return r.Registry.GetService(name)
+}
+
+func (r *testRegistry) Watch(opts ...WatchOption) (Watcher, error) {
+	atomic.AddInt32(&r.watches, 1)
+	if atomic.AddInt32(&r.fail, -1) >= 0 {
+		return &testWatcher{err: errors.New("watch failed"), exit: make(chan struct{})}, nil
+	}
+	if r.block {
+		return &testWatcher{exit: make(chan struct{})}, nil
+	}
+	return r.Registry.Watch(opts...)
+}
+
+func TestResolverRewatch(t *testing.T) {
+	r := &testRegistry{Registry: NewRegistry(), fail: 1}
+	s := &Service{Name: "rewatch", Version: "1.0.0", Nodes: []*Node{{Id: "rewatch-1", Address: "127.0.0.1:8080"}}}
+	if err := r.Register(s); err != nil {
+		t.Fatal(err)
+	}
+
+	cc := &testClientConn{}
+	rr, err := newBuilder(r).Build(resolver.Target{Endpoint: "rewatch"}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rr.Close()
+
+	// the node registered while the watcher failed is reloaded by the new one
+	s.Nodes = append(s.Nodes, &Node{Id: "rewatch-2", Address: "127.0.0.1:8081"})
+	if err := r.Register(s); err != nil {
+		t.Fatal(err)
+	}
+	cc.state(t, func(s resolver.State) bool { return len(s.Addresses) == 2 })
+
+	if exp, act := int32(2), atomic.LoadInt32(&r.watches); exp != act {
+		t.Fatalf("Expected %d watches, got %d", exp, act)
+	}
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if len(cc.errs) == 0 || cc.errs[0].Error() != "watch failed" {
+		t.Fatalf("Expected the watch error to be reported, got %v", cc.errs)
+	}
+}
+
+func TestResolverResolveNow(t *testing.T) {
+	r := &testRegistry{Registry: NewRegistry(), block: true}
+	s := &Service{Name: "now", Version: "1.0.0", Nodes: []*Node{{Id: "now-1", Address: "127.0.0.1:8080"}}}
+	if err := r.Register(s); err != nil {
+		t.Fatal(err)
+	}
+
+	cc := &testClientConn{}
+	rr, err := newBuilder(r).Build(resolver.Target{Endpoint: "now"}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rr.Close()
+
+	s.Nodes = append(s.Nodes, &Node{Id: "now-2", Address: "127.0.0.1:8081"})
+	if err := r.Register(s); err != nil {
+		t.Fatal(err)
+	}
+
+	// the watcher doesn't tell, ResolveNow refreshes
+	rr.ResolveNow(resolver.ResolveNowOptions{})
+	cc.state(t, func(s resolver.State) bool { return len(s.Addresses) == 2 })
+
+	// rate limited
+	rr.ResolveNow(resolver.ResolveNowOptions{})
+	rr.ResolveNow(resolver.ResolveNowOptions{})
+	time.Sleep(100 * time.Millisecond)
+	if exp, act := int32(2), atomic.LoadInt32(&r.gets); exp != act {
+		t.Fatalf("Expected %d GetService, got %d", exp, act)
+	}
+}
+
+func TestResolverClose(t *testing.T) {
+	r := &testRegistry{Registry: NewRegistry(), block: true}
+	s := &Service{Name: "close", Version: "1.0.0", Nodes: []*Node{{Id: "close-1", Address: "127.0.0.1:8080"}}}
+	if err := r.Register(s); err != nil {
+		t.Fatal(err)
+	}
+
+	b := newBuilder(r).(*registryBuilder)
+	r1, err := b.Build(resolver.Target{Endpoint: "close"}, &testClientConn{}, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, err := b.Build(resolver.Target{Endpoint: "close?version=1.0.0"}, &testClientConn{}, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	svc := r1.(*registryResolver).service
+	if svc != r2.(*registryResolver).service {
+		t.Fatalf("Expected the resolvers to share the service")
+	}
+	if exp, act := int32(1), atomic.LoadInt32(&r.watches); exp != act {
+		t.Fatalf("Expected %d watches, got %d", exp, act)
+	}
+
+	// the service is kept while resolved
+	r1.Close()
+	r1.Close()
+	b.mu.RLock()
+	if _, ok := b.resolvers["/close"]; !ok || svc.refs != 1 {
+		t.Fatalf("Expected the service to be kept with 1 reference, got %d", svc.refs)
+	}
+	b.mu.RUnlock()
+
+	// and evicted with the watcher stopped by the last resolver
+	r2.Close()
+	b.mu.RLock()
+	if _, ok := b.resolvers["/close"]; ok {
+		t.Fatalf("Expected the service to be evicted")
+	}
+	b.mu.RUnlock()
+	if !svc.stopped() {
+		t.Fatalf("Expected the service to be stopped")
+	}
+	select {
+	case <-svc.watcher.(*testWatcher).exit:
+	default:
+		t.Fatalf("Expected the watcher to be stopped")
+	}
+
+	// a new resolver watches again
+	r3, err := b.Build(resolver.Target{Endpoint: "close"}, &testClientConn{}, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r3.Close()
+	if exp, act := int32(2), atomic.LoadInt32(&r.watches); exp != act {
+		t.Fatalf("Expected %d watches, got %d", exp, act)
+	}
+}
+
+func TestResolverBuildError(t *testing.T) {
+	errDown := errors.New("registry is down")
+	r := &testRegistry{Registry: NewRegistry(), block: true, err: errDown}
+
+	b := newBuilder(r).(*registryBuilder)
+	if _, err := b.Build(resolver.Target{Endpoint: "missing"}, &testClientConn{}, resolver.BuildOptions{}); err != errDown {
+		t.Fatalf("Expected %v, got %v", errDown, err)
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if len(b.resolvers) != 0 {
+		t.Fatalf("Expected the failed service to be evicted, got %v", b.resolvers)
+	}
+}
+
+func TestResolverRegisterAfterDial(t *testing.T) {
+	r := NewRegistry()
+
+	// the service isn't registered yet, the resolver keeps watching
+	cc := &testClientConn{}
+	rr, err := newBuilder(r).Build(resolver.Target{Endpoint: "later"}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rr.Close()
+
+	s := &Service{Name: "later", Version: "1.0.0", Nodes: []*Node{{Id: "later-1", Address: "127.0.0.1:8080"}}}
+	if err := r.Register(s); err != nil {
+		t.Fatal(err)
+	}
+
+	state := cc.state(t, func(s resolver.State) bool { return len(s.Addresses) == 1 })
+	if exp, act := "127.0.0.1:8080", state.Addresses[0].Addr; exp != act {
+		t.Fatalf("Expected %s, got %s", exp, act)
+	}
+}
+
+func TestRegisterBuilder(t *testing.T) {
+	// restore the global builders of grpc
+	for _, scheme := range []string{"one", "two", schema} {
+		prev := resolver.Get(scheme)
+		defer func(scheme string) {
+			if prev != nil {
+				resolver.Register(prev)
+			} else {
+				resolver.UnregisterForTesting(scheme)
+			}
+		}(scheme)
+	}
+
+	one := NewRegistry(Scheme("one"))
+	two := NewRegistry(Scheme("two"))
+	RegisterBuilder(one)
+	RegisterBuilder(two)
+
+	for _, r := range []Registry{one, two} {
+		b, ok := resolver.Get(r.Options().Scheme).(*registryBuilder)
+		if !ok || b.registry != r {
+			t.Fatalf("Expected the builder of %s", r.Options().Scheme)
+		}
+	}
+
+	// the first registry is the default
+	alias, ok := resolver.Get(schema).(*aliasBuilder)
+	if !ok || alias.registry != one {
+		t.Fatalf("Expected %s to be the alias of one", schema)
+	}
+
+	s := &Service{Name: "foo"}
+	if exp, act := "two:///foo?version=1.0.0|1.0.1", two.NewTarget(s, Versions("1.0.0", "1.0.1")); exp != act {
+		t.Fatalf("Expected %s, got %s", exp, act)
+	}
+	if exp, act := "memory:///foo", NewRegistry().NewTarget(s); exp != act {
+		t.Fatalf("Expected %s, got %s", exp, act)
+	}
+}
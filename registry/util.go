@@ -7,6 +7,15 @@ func CopyService(service *Service) *Service {
 	*s = *service
 
 	// copy nodes
+	nodes := make([]*Node, len(service.Nodes))
+	for i, node := range service.Nodes {
+		n := new(Node)
+		*n = *node
+		nodes[i] = n
+	}
+	s.Nodes = nodes
+
+	// copy methods
 	methods := make([]*Method, len(service.Methods))
 	for i, method := range service.Methods {
 		m := new(Method)
@@ -18,9 +27,11 @@ func CopyService(service *Service) *Service {
 			r := new(Binding)
 			*r = *route
 
-			p := new(PathTmpl)
-			*p = *route.PathTmpl
-			r.PathTmpl = p
+			if route.PathTmpl != nil {
+				p := new(PathTmpl)
+				*p = *route.PathTmpl
+				r.PathTmpl = p
+			}
 
 			bindings[j] = r
 		}
@@ -41,3 +52,91 @@ func Copy(current []*Service) []*Service {
 	}
 	return services
 }
+
+// serviceKey identifies a version of a service
+type serviceKey struct {
+	name    string
+	version string
+}
+
+// Diff compares two snapshots of services and returns the results
+// which turn the old snapshot into the new one. It is shared by the
+// watchers which poll or coalesce the snapshots, e.g. of a file or DNS.
+// Services are matched by name and version, nodes by id.
+func Diff(old, new []*Service) []*Result {
+	key := func(s *Service) serviceKey {
+		return serviceKey{name: s.Name, version: s.Version}
+	}
+
+	oldMap := make(map[serviceKey]*Service, len(old))
+	for _, s := range old {
+		oldMap[key(s)] = s
+	}
+
+	var results []*Result
+	newMap := make(map[serviceKey]*Service, len(new))
+
+	for _, cur := range new {
+		newMap[key(cur)] = cur
+
+		prev, ok := oldMap[key(cur)]
+		if !ok {
+			results = append(results, NewResult(Create, cur))
+			continue
+		}
+
+		oldNodes := make(map[string]*Node, len(prev.Nodes))
+		for _, n := range prev.Nodes {
+			oldNodes[n.Id] = n
+		}
+
+		changed := len(prev.Nodes) != len(cur.Nodes) || !equalMetadata(prev.Metadata, cur.Metadata)
+		for _, n := range cur.Nodes {
+			pn, ok := oldNodes[n.Id]
+			if !ok {
+				changed = true
+				continue
+			}
+			if pn.Address != n.Address || !equalMetadata(pn.Metadata, n.Metadata) {
+				changed = true
+			}
+			delete(oldNodes, n.Id)
+		}
+
+		// nodes left are not in the new snapshot
+		if len(oldNodes) > 0 {
+			del := CopyService(prev)
+			del.Nodes = make([]*Node, 0, len(oldNodes))
+			for _, n := range prev.Nodes {
+				if _, ok := oldNodes[n.Id]; ok {
+					del.Nodes = append(del.Nodes, n)
+				}
+			}
+			results = append(results, NewResult(Delete, del))
+		}
+
+		if changed && len(cur.Nodes) > 0 {
+			results = append(results, NewResult(Update, cur))
+		}
+	}
+
+	for _, prev := range old {
+		if _, ok := newMap[key(prev)]; !ok {
+			results = append(results, NewResult(Delete, prev))
+		}
+	}
+
+	return results
+}
+
+func equalMetadata(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
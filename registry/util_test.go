@@ -0,0 +1,81 @@
+package registry
+
+import (
+	"testing"
+)
+
+func TestCopyService(t *testing.T) {
+	s := &Service{
+		Name:    "foo",
+		Version: "1.0.0",
+		Nodes:   []*Node{{Id: "foo-1", Address: "127.0.0.1:8080"}},
+		Methods: []*Method{{
+			Name:     "Hello",
+			Bindings: []*Binding{{Method: "GET"}},
+		}},
+	}
+
+	// the nodes, the methods and the bindings are copied, a binding may have no PathTmpl
+	c := CopyService(s)
+	c.Nodes[0].Address = "127.0.0.1:8081"
+	c.Methods[0].Bindings[0].Method = "POST"
+
+	if exp, act := "127.0.0.1:8080", s.Nodes[0].Address; exp != act {
+		t.Fatalf("Expected %s, got %s", exp, act)
+	}
+	if exp, act := "GET", s.Methods[0].Bindings[0].Method; exp != act {
+		t.Fatalf("Expected %s, got %s", exp, act)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	old := []*Service{
+		{Name: "a", Version: "1.0", Nodes: []*Node{{Id: "a-1", Address: "127.0.0.1:8080"}, {Id: "a-2", Address: "127.0.0.1:8081"}}},
+		{Name: "b", Version: "1.0", Nodes: []*Node{{Id: "b-1", Address: "127.0.0.1:8082"}}},
+		{Name: "c", Version: "1.0", Nodes: []*Node{{Id: "c-1", Address: "127.0.0.1:8083"}}},
+	}
+	cur := []*Service{
+		// a-2 is removed, a-1 changed
+		{Name: "a", Version: "1.0", Nodes: []*Node{{Id: "a-1", Address: "127.0.0.1:9090"}}},
+		// unchanged
+		{Name: "b", Version: "1.0", Nodes: []*Node{{Id: "b-1", Address: "127.0.0.1:8082"}}},
+		// c is removed, d is created
+		{Name: "d", Version: "1.0", Nodes: []*Node{{Id: "d-1", Address: "127.0.0.1:8084"}}},
+	}
+
+	type result struct {
+		action, name string
+		nodes        int
+	}
+	var act []result
+	for _, r := range Diff(old, cur) {
+		act = append(act, result{r.Action, r.Service.Name, len(r.Service.Nodes)})
+	}
+
+	exp := []result{
+		{"delete", "a", 1},
+		{"update", "a", 1},
+		{"create", "d", 1},
+		{"delete", "c", 1},
+	}
+	if len(exp) != len(act) {
+		t.Fatalf("Expected %v, got %v", exp, act)
+	}
+	for i := range exp {
+		if exp[i] != act[i] {
+			t.Fatalf("Expected %v, got %v", exp, act)
+		}
+	}
+
+	// services are matched by name and version, the keys don't collide
+	if results := Diff(
+		[]*Service{{Name: "a/b", Version: "c", Nodes: []*Node{{Id: "1"}}}},
+		[]*Service{{Name: "a", Version: "b/c", Nodes: []*Node{{Id: "1"}}}},
+	); len(results) != 2 || results[0].Action != "create" || results[1].Action != "delete" {
+		t.Fatalf("Expected the services to differ, got %v", results)
+	}
+
+	if results := Diff(cur, cur); len(results) != 0 {
+		t.Fatalf("Expected no results, got %v", results)
+	}
+}
@@ -1,6 +1,10 @@
 package registry
 
-import "time"
+import (
+	"errors"
+	"fmt"
+	"time"
+)
 
 // Watcher is an interface that returns updates
 // about services within the registry.
@@ -13,16 +17,72 @@ type Watcher interface {
 // Result is returned by a call to Next on
 // the watcher. Actions can be create, update, delete
 type Result struct {
+	// Action is the string form of Type, kept for the existing consumers
 	Action  string
 	Service *Service
+	// Type is the typed action, use EventType to read it
+	Type EventType
+	// Timestamp is the time the change was observed
+	Timestamp time.Time
+	// Revision is the backend revision or index of the change, 0 if unknown
+	Revision uint64
+}
+
+// NewResult returns a result of the event type observed now
+func NewResult(t EventType, s *Service) *Result {
+	return &Result{
+		Action:    t.String(),
+		Service:   s,
+		Type:      t,
+		Timestamp: time.Now(),
+	}
 }
 
-// EventType defines registry event type
+// EventType returns the event type of the result, it is parsed from
+// Action for the watchers which only set the action.
+func (r *Result) EventType() (EventType, error) {
+	if len(r.Action) == 0 {
+		if r.Type == Unknown {
+			return Unknown, errors.New("event type is not set")
+		}
+		return r.Type, nil
+	}
+	return ParseEventType(r.Action)
+}
+
+// Event returns the result as an event
+func (r *Result) Event() (*Event, error) {
+	t, err := r.EventType()
+	if err != nil {
+		return nil, err
+	}
+
+	var id string
+	if r.Service != nil {
+		id = r.Service.Name
+	}
+
+	return &Event{
+		Id:        id,
+		Type:      t,
+		Timestamp: r.Timestamp,
+		Revision:  r.Revision,
+		Service:   r.Service,
+	}, nil
+}
+
+// EventType defines registry event type. Unknown took the zero value,
+// so Create, Delete and Update are 1, 2 and 3 instead of 0, 1 and 2 of
+// the earlier releases, an EventType stored or sent as a number must be
+// written by the same release which reads it. Use String and
+// ParseEventType to exchange it.
 type EventType int
 
 const (
+	// Unknown is the zero value, the event type isn't set
+	Unknown EventType = iota
 	// Create is emitted when a new service is registered
-	Create EventType = iota
+	Create
 	// Delete is emitted when an existing service is deregsitered
 	Delete
 	// Update is emitted when an existing servicec is updated
@@ -43,14 +103,31 @@ func (t EventType) String() string {
 	}
 }
 
+// ParseEventType returns the event type of the human readable form
+func ParseEventType(s string) (EventType, error) {
+	switch s {
+	case "create":
+		return Create, nil
+	case "delete":
+		return Delete, nil
+	case "update":
+		return Update, nil
+	default:
+		return Unknown, fmt.Errorf("unsupported event type %q", s)
+	}
+}
+
 // Event is registry event
 type Event struct {
-	// Id is registry id
+	// Id is the name of the changed service, Result.Event sets it
+	// for the results of every registry
 	Id string
 	// Type defines type of event
 	Type EventType
 	// Timestamp is event timestamp
 	Timestamp time.Time
+	// Revision is the backend revision or index of the event, 0 if unknown
+	Revision uint64
 	// Service is registry service
 	Service *Service
 }
@@ -0,0 +1,65 @@
+package registry
+
+import (
+	"testing"
+)
+
+func TestResultEventType(t *testing.T) {
+	testData := []struct {
+		res *Result
+		exp EventType
+		err bool
+	}{
+		// typed result
+		{NewResult(Update, &Service{Name: "foo"}), Update, false},
+		// result of a watcher setting the type only
+		{&Result{Type: Delete}, Delete, false},
+		// result of a watcher setting the action only
+		{&Result{Action: "delete"}, Delete, false},
+		{&Result{Action: "create"}, Create, false},
+		{&Result{Action: "unknown"}, Unknown, true},
+		// a result without a type
+		{&Result{}, Unknown, true},
+	}
+
+	for _, d := range testData {
+		act, err := d.res.EventType()
+		if d.err {
+			if err == nil {
+				t.Fatalf("Expected error for action %q", d.res.Action)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if act != d.exp {
+			t.Fatalf("Expected %v, got %v", d.exp, act)
+		}
+	}
+
+	// the zero value isn't a valid event type
+	if Create == Unknown || EventType(0) != Unknown || Unknown.String() != "unknown" {
+		t.Fatalf("Expected the zero event type to be unknown")
+	}
+
+	// the values are exchanged as numbers, they must not change again
+	if Create != 1 || Delete != 2 || Update != 3 {
+		t.Fatalf("Expected create, delete and update to be 1, 2 and 3, got %d, %d and %d", Create, Delete, Update)
+	}
+
+	res := NewResult(Create, &Service{Name: "foo"})
+	res.Revision = 10
+
+	if res.Action != "create" || res.Timestamp.IsZero() {
+		t.Fatalf("Expected create action with timestamp, got %+v", res)
+	}
+
+	ev, err := res.Event()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.Id != "foo" || ev.Type != Create || ev.Revision != 10 || ev.Timestamp != res.Timestamp {
+		t.Fatalf("Unexpected event %+v", ev)
+	}
+}
@@ -0,0 +1,44 @@
+package zookeeper
+
+import (
+	"github.com/go-zookeeper/zk"
+)
+
+// conn is the part of the zookeeper client used by the registry
+type conn interface {
+	Exists(path string) (bool, *zk.Stat, error)
+	ExistsW(path string) (bool, *zk.Stat, <-chan zk.Event, error)
+	Get(path string) ([]byte, *zk.Stat, error)
+	GetW(path string) ([]byte, *zk.Stat, <-chan zk.Event, error)
+	Children(path string) ([]string, *zk.Stat, error)
+	ChildrenW(path string) ([]string, *zk.Stat, <-chan zk.Event, error)
+	Create(path string, data []byte, flags int32, acl []zk.ACL) (string, error)
+	Set(path string, data []byte, version int32) (*zk.Stat, error)
+	Delete(path string, version int32) error
+	SessionID() int64
+	Close()
+}
+
+// errConn fails every call with the error of the configuration,
+// until Init configures the registry successfully
+type errConn struct {
+	err error
+}
+
+func (c errConn) Exists(string) (bool, *zk.Stat, error) { return false, nil, c.err }
+func (c errConn) ExistsW(string) (bool, *zk.Stat, <-chan zk.Event, error) {
+	return false, nil, nil, c.err
+}
+func (c errConn) Get(string) ([]byte, *zk.Stat, error) { return nil, nil, c.err }
+func (c errConn) GetW(string) ([]byte, *zk.Stat, <-chan zk.Event, error) {
+	return nil, nil, nil, c.err
+}
+func (c errConn) Children(string) ([]string, *zk.Stat, error) { return nil, nil, c.err }
+func (c errConn) ChildrenW(string) ([]string, *zk.Stat, <-chan zk.Event, error) {
+	return nil, nil, nil, c.err
+}
+func (c errConn) Create(string, []byte, int32, []zk.ACL) (string, error) { return "", c.err }
+func (c errConn) Set(string, []byte, int32) (*zk.Stat, error)            { return nil, c.err }
+func (c errConn) Delete(string, int32) error                             { return c.err }
+func (c errConn) SessionID() int64                                       { return 0 }
+func (c errConn) Close()                                                 {}
@@ -0,0 +1,36 @@
+package zookeeper
+
+import (
+	"context"
+
+	"github.com/hb-go/grpc-contrib/registry"
+)
+
+type prefixKey struct{}
+
+type authKey struct{}
+
+type authCreds struct {
+	Scheme string
+	Auth   []byte
+}
+
+// Prefix sets the znode path the services are stored under
+func Prefix(p string) registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, prefixKey{}, p)
+	}
+}
+
+// Auth allows you to specify the zookeeper auth scheme, e.g. `digest` and `user:password`
+func Auth(scheme string, auth []byte) registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, authKey{}, &authCreds{Scheme: scheme, Auth: auth})
+	}
+}
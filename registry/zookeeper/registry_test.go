@@ -0,0 +1,93 @@
+package zookeeper
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hb-go/grpc-contrib/registry"
+)
+
+// zookeeperAddr is the test server, e.g. `docker run -p 2181:2181 zookeeper`
+func zookeeperAddr(t *testing.T) string {
+	addr := os.Getenv("ZOOKEEPER_ADDR")
+	if len(addr) == 0 {
+		addr = "127.0.0.1:2181"
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Skipf("zookeeper is not available at %s: %v", addr, err)
+	}
+	conn.Close()
+
+	return addr
+}
+
+func TestZookeeperRegistry(t *testing.T) {
+	addr := zookeeperAddr(t)
+
+	r := NewRegistry(registry.Addrs(addr), Prefix("/grpc/registry-test"))
+
+	service := &registry.Service{
+		Name:    "test1",
+		Version: "1.0.1",
+		Nodes: []*registry.Node{
+			{
+				Id:      "node-1",
+				Address: "127.0.0.1:8080",
+			},
+			{
+				Id:      "node-2",
+				Address: "127.0.0.1:8081",
+			},
+		},
+	}
+
+	w, err := r.Watch(registry.WatchService(service.Name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	if err := r.Register(service); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := w.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Action != "create" && res.Action != "update" {
+		t.Fatalf("Expected create event got %s", res.Action)
+	}
+
+	services, err := r.GetService(service.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp, act := 1, len(services); exp != act {
+		t.Fatalf("Expected len of svc to be `%d`, got `%d`.", exp, act)
+	}
+	if exp, act := 2, len(services[0].Nodes); exp != act {
+		t.Fatalf("Expected len of nodes to be `%d`, got `%d`.", exp, act)
+	}
+
+	if err := r.Deregister(service); err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		res, err := w.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Action != "delete" {
+			continue
+		}
+		if _, err := r.GetService(service.Name); err == registry.ErrNotFound {
+			break
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package zookeeper
+
+import (
+	"errors"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-zookeeper/zk"
+
+	"github.com/hb-go/grpc-contrib/registry"
+)
+
+type fakeNode struct {
+	data  []byte
+	owner int64
+}
+
+// fakeConn is an in-memory zookeeper of one session,
+// its one-time watches fire like the ones of zookeeper
+type fakeConn struct {
+	mu      sync.Mutex
+	session int64
+	nodes   map[string]*fakeNode
+	// path -> pending watches of the node and of its children
+	dataW  map[string][]chan zk.Event
+	childW map[string][]chan zk.Event
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{
+		session: 1,
+		nodes:   make(map[string]*fakeNode),
+		dataW:   make(map[string][]chan zk.Event),
+		childW:  make(map[string][]chan zk.Event),
+	}
+}
+
+// watch adds a one-time watch of the path
+func (c *fakeConn) watch(watches map[string][]chan zk.Event, p string) <-chan zk.Event {
+	ch := make(chan zk.Event, 1)
+	c.mu.Lock()
+	watches[p] = append(watches[p], ch)
+	c.mu.Unlock()
+	return ch
+}
+
+// fire triggers the watches of the path, called with the lock held
+func (c *fakeConn) fire(watches map[string][]chan zk.Event, p string, t zk.EventType) {
+	for _, ch := range watches[p] {
+		ch <- zk.Event{Type: t, Path: p}
+	}
+	delete(watches, p)
+}
+
+// remove deletes the node, called with the lock held
+func (c *fakeConn) remove(p string) {
+	delete(c.nodes, p)
+	c.fire(c.dataW, p, zk.EventNodeDeleted)
+	c.fire(c.childW, p, zk.EventNodeDeleted)
+	c.fire(c.childW, path.Dir(p), zk.EventNodeChildrenChanged)
+}
+
+// expire expires the session, its ephemeral nodes are deleted
+func (c *fakeConn) expire() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for p, n := range c.nodes {
+		if n.owner == c.session {
+			c.remove(p)
+		}
+	}
+	c.session++
+}
+
+func (c *fakeConn) owner(p string) (int64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n, ok := c.nodes[p]
+	if !ok {
+		return 0, false
+	}
+	return n.owner, true
+}
+
+func (c *fakeConn) Exists(p string) (bool, *zk.Stat, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n, ok := c.nodes[p]
+	if !ok {
+		return false, nil, nil
+	}
+	return true, &zk.Stat{EphemeralOwner: n.owner}, nil
+}
+
+func (c *fakeConn) ExistsW(p string) (bool, *zk.Stat, <-chan zk.Event, error) {
+	ch := c.watch(c.dataW, p)
+	exists, stat, err := c.Exists(p)
+	return exists, stat, ch, err
+}
+
+func (c *fakeConn) Get(p string) ([]byte, *zk.Stat, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n, ok := c.nodes[p]
+	if !ok {
+		return nil, nil, zk.ErrNoNode
+	}
+	return n.data, &zk.Stat{EphemeralOwner: n.owner}, nil
+}
+
+func (c *fakeConn) GetW(p string) ([]byte, *zk.Stat, <-chan zk.Event, error) {
+	ch := c.watch(c.dataW, p)
+	data, stat, err := c.Get(p)
+	return data, stat, ch, err
+}
+
+func (c *fakeConn) Children(p string) ([]string, *zk.Stat, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.nodes[p]; !ok {
+		return nil, nil, zk.ErrNoNode
+	}
+	var children []string
+	for np := range c.nodes {
+		if path.Dir(np) == p {
+			children = append(children, path.Base(np))
+		}
+	}
+	sort.Strings(children)
+	return children, &zk.Stat{}, nil
+}
+
+func (c *fakeConn) ChildrenW(p string) ([]string, *zk.Stat, <-chan zk.Event, error) {
+	ch := c.watch(c.childW, p)
+	children, stat, err := c.Children(p)
+	return children, stat, ch, err
+}
+
+func (c *fakeConn) Create(p string, data []byte, flags int32, acl []zk.ACL) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.nodes[p]; ok {
+		return "", zk.ErrNodeExists
+	}
+	if dir := path.Dir(p); dir != "/" {
+		if _, ok := c.nodes[dir]; !ok {
+			return "", zk.ErrNoNode
+		}
+	}
+
+	n := &fakeNode{data: data}
+	if flags&zk.FlagEphemeral != 0 {
+		n.owner = c.session
+	}
+	c.nodes[p] = n
+	c.fire(c.dataW, p, zk.EventNodeCreated)
+	c.fire(c.childW, path.Dir(p), zk.EventNodeChildrenChanged)
+	return p, nil
+}
+
+func (c *fakeConn) Set(p string, data []byte, version int32) (*zk.Stat, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n, ok := c.nodes[p]
+	if !ok {
+		return nil, zk.ErrNoNode
+	}
+	n.data = data
+	c.fire(c.dataW, p, zk.EventNodeDataChanged)
+	return &zk.Stat{EphemeralOwner: n.owner}, nil
+}
+
+func (c *fakeConn) Delete(p string, version int32) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.nodes[p]; !ok {
+		return zk.ErrNoNode
+	}
+	c.remove(p)
+	return nil
+}
+
+func (c *fakeConn) SessionID() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.session
+}
+
+func (c *fakeConn) Close() {}
+
+func newFakeRegistry() (*zookeeperRegistry, *fakeConn) {
+	c := newFakeConn()
+	return &zookeeperRegistry{
+		client:   c,
+		options:  registry.Options{Scheme: schema},
+		prefix:   DefaultPrefix,
+		codec:    registry.DefaultCodec,
+		register: make(map[string]uint64),
+		nodes:    make(map[string]*registry.Service),
+	}, c
+}
+
+func TestSessionExpired(t *testing.T) {
+	z, c := newFakeRegistry()
+
+	service := &registry.Service{
+		Name:    "session",
+		Version: "1.0.0",
+		Nodes: []*registry.Node{
+			{Id: "node-1", Address: "127.0.0.1:8080"},
+			{Id: "node-2", Address: "127.0.0.1:8081"},
+		},
+	}
+	if err := z.Register(service); err != nil {
+		t.Fatal(err)
+	}
+
+	// the session expired, its ephemeral nodes are gone
+	z.sessionEvent(zk.Event{Type: zk.EventSession, State: zk.StateExpired})
+	c.expire()
+	if _, err := z.GetService(service.Name); err != registry.ErrNotFound {
+		t.Fatalf("Expected %v, got %v", registry.ErrNotFound, err)
+	}
+
+	// the nodes are re-created with the new session
+	z.sessionEvent(zk.Event{Type: zk.EventSession, State: zk.StateHasSession})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for _, n := range service.Nodes {
+		for {
+			if owner, ok := c.owner(z.nodePath(service.Name, n.Id)); ok && owner == c.SessionID() {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected %s to be re-registered", n.Id)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	services, err := z.GetService(service.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp, act := 2, len(services[0].Nodes); exp != act {
+		t.Fatalf("Expected %d nodes, got %d", exp, act)
+	}
+
+	// the deregistered nodes aren't re-created
+	if err := z.Deregister(service); err != nil {
+		t.Fatal(err)
+	}
+	z.sessionEvent(zk.Event{Type: zk.EventSession, State: zk.StateExpired})
+	c.expire()
+	z.sessionEvent(zk.Event{Type: zk.EventSession, State: zk.StateHasSession})
+	time.Sleep(50 * time.Millisecond)
+	if _, err := z.GetService(service.Name); err != registry.ErrNotFound {
+		t.Fatalf("Expected %v, got %v", registry.ErrNotFound, err)
+	}
+
+	// a new session without an expiry keeps the nodes
+	if err := z.Register(service); err != nil {
+		t.Fatal(err)
+	}
+	z.sessionEvent(zk.Event{Type: zk.EventSession, State: zk.StateHasSession})
+	if owner, _ := c.owner(z.nodePath(service.Name, "node-1")); owner != c.SessionID() {
+		t.Fatalf("Expected the node of the session")
+	}
+}
+
+func TestConfigureError(t *testing.T) {
+	r := NewRegistry(registry.Addrs("[::1"))
+
+	// the error of the configuration is returned by the calls
+	err := r.Register(&registry.Service{Name: "foo", Nodes: []*registry.Node{{Id: "1"}}})
+	if err == nil || !strings.Contains(err.Error(), "::1") {
+		t.Fatalf("Expected the configure error, got %v", err)
+	}
+	if _, err := r.GetService("foo"); err == nil || errors.Is(err, registry.ErrNotFound) {
+		t.Fatalf("Expected the configure error, got %v", err)
+	}
+	if err := r.Init(registry.Addrs("[::1")); err == nil {
+		t.Fatalf("Expected the configure error")
+	}
+}
+
+func TestWatcherEvents(t *testing.T) {
+	z, _ := newFakeRegistry()
+
+	w, err := z.Watch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	service := &registry.Service{
+		Name:    "watch",
+		Version: "1.0.0",
+		Nodes:   []*registry.Node{{Id: "node-1", Address: "127.0.0.1:8080"}},
+	}
+
+	next := func(exp registry.EventType) *registry.Result {
+		results := make(chan *registry.Result, 1)
+		go func() {
+			if res, err := w.Next(); err == nil {
+				results <- res
+			}
+		}()
+
+		select {
+		case res := <-results:
+			if act, err := res.EventType(); err != nil || exp != act {
+				t.Fatalf("Expected %v event, got %v %v", exp, act, err)
+			}
+			return res
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected %v event", exp)
+		}
+		return nil
+	}
+
+	if err := z.Register(service); err != nil {
+		t.Fatal(err)
+	}
+	next(registry.Create)
+
+	// a changed node is set in place
+	service.Nodes[0].Metadata = map[string]string{"weight": "2"}
+	if err := z.Register(service); err != nil {
+		t.Fatal(err)
+	}
+	res := next(registry.Update)
+	if exp, act := "2", res.Service.Nodes[0].Metadata["weight"]; exp != act {
+		t.Fatalf("Expected weight %s, got %s", exp, act)
+	}
+
+	if err := z.Deregister(service); err != nil {
+		t.Fatal(err)
+	}
+	next(registry.Delete)
+}
@@ -0,0 +1,282 @@
+package zookeeper
+
+import (
+	"path"
+	"strings"
+	"time"
+
+	"github.com/go-zookeeper/zk"
+	"google.golang.org/grpc/grpclog"
+
+	"github.com/hb-go/grpc-contrib/registry"
+)
+
+// retryInterval is the delay before the watches are re-armed after a failure
+var retryInterval = time.Second
+
+type zookeeperWatcher struct {
+	r  *zookeeperRegistry
+	wo registry.WatchOptions
+
+	exit   chan bool
+	events chan zk.Event
+	next   chan *registry.Result
+
+	// paths with a pending zookeeper watch
+	armed map[string]bool
+	// service znode name -> services
+	services map[string][]*registry.Service
+}
+
+func newZookeeperWatcher(r *zookeeperRegistry, opts ...registry.WatchOption) (registry.Watcher, error) {
+	var wo registry.WatchOptions
+	for _, o := range opts {
+		o(&wo)
+	}
+
+	zw := &zookeeperWatcher{
+		r:        r,
+		wo:       wo,
+		exit:     make(chan bool),
+		events:   make(chan zk.Event),
+		next:     make(chan *registry.Result),
+		armed:    make(map[string]bool),
+		services: make(map[string][]*registry.Service),
+	}
+
+	// the current state is the baseline, only changes are emitted
+	if err := zw.refreshAll(false); err != nil {
+		close(zw.exit)
+		return nil, err
+	}
+
+	go zw.run()
+
+	return zw, nil
+}
+
+// arm forwards the event of a one-time zookeeper watch to the run loop
+func (zw *zookeeperWatcher) arm(p string, ch <-chan zk.Event) {
+	zw.armed[p] = true
+
+	go func() {
+		select {
+		case <-zw.exit:
+		case ev := <-ch:
+			select {
+			case <-zw.exit:
+			case zw.events <- ev:
+			}
+		}
+	}()
+}
+
+// children lists the children of the path and arms a child watch,
+// an exists watch is armed if the path does not exist yet.
+func (zw *zookeeperWatcher) children(p string) ([]string, error) {
+	if zw.armed[p] {
+		children, _, err := zw.r.getClient().Children(p)
+		if err == zk.ErrNoNode {
+			return nil, nil
+		}
+		return children, err
+	}
+
+	for {
+		children, _, ch, err := zw.r.getClient().ChildrenW(p)
+		if err == nil {
+			zw.arm(p, ch)
+			return children, nil
+		}
+		if err != zk.ErrNoNode {
+			return nil, err
+		}
+
+		exists, _, ch, err := zw.r.getClient().ExistsW(p)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			zw.arm(p, ch)
+			return nil, nil
+		}
+		// created in the meantime, set the child watch again
+	}
+}
+
+// refresh reads a service and sends the changes since the last read
+func (zw *zookeeperWatcher) refresh(name string, emit bool) error {
+	dir := path.Join(zw.r.prefix, name)
+
+	nodes, err := zw.children(dir)
+	if err != nil {
+		return err
+	}
+
+	serviceMap := map[string]*registry.Service{}
+
+	for _, node := range nodes {
+		p := path.Join(dir, node)
+
+		var data []byte
+		if zw.armed[p] {
+			data, _, err = zw.r.getClient().Get(p)
+		} else {
+			var ch <-chan zk.Event
+			data, _, ch, err = zw.r.getClient().GetW(p)
+			if err == nil {
+				zw.arm(p, ch)
+			}
+		}
+		if err == zk.ErrNoNode {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		sn, err := zw.r.codec.Unmarshal(data)
+		if err != nil || sn == nil {
+			grpclog.Warningf("grpc-contrib.registry: zookeeper decode node %s error: %v", p, err)
+			continue
+		}
+
+		s, ok := serviceMap[sn.Version]
+		if !ok {
+			s = &registry.Service{
+				Name:     sn.Name,
+				Version:  sn.Version,
+				Metadata: sn.Metadata,
+				Methods:  sn.Methods,
+			}
+			serviceMap[s.Version] = s
+		}
+		s.Nodes = append(s.Nodes, sn.Nodes...)
+	}
+
+	services := make([]*registry.Service, 0, len(serviceMap))
+	for _, s := range serviceMap {
+		services = append(services, s)
+	}
+
+	return zw.update(name, services, emit)
+}
+
+// update diffs the services against the last read and sends the results
+func (zw *zookeeperWatcher) update(name string, services []*registry.Service, emit bool) error {
+	results := registry.Diff(zw.services[name], services)
+
+	if len(services) == 0 {
+		delete(zw.services, name)
+	} else {
+		zw.services[name] = services
+	}
+
+	if !emit {
+		return nil
+	}
+
+	for _, r := range results {
+		select {
+		case <-zw.exit:
+			return registry.ErrWatcherStopped
+		case zw.next <- r:
+		}
+	}
+
+	return nil
+}
+
+// refreshAll reads all the watched services
+func (zw *zookeeperWatcher) refreshAll(emit bool) error {
+	if len(zw.wo.Service) > 0 {
+		return zw.refresh(path.Base(zw.r.servicePath(zw.wo.Service)), emit)
+	}
+
+	names, err := zw.children(zw.r.prefix)
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		seen[name] = true
+		if err := zw.refresh(name, emit); err != nil {
+			return err
+		}
+	}
+
+	// services removed while not watching
+	for name := range zw.services {
+		if !seen[name] {
+			if err := zw.update(name, nil, emit); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (zw *zookeeperWatcher) handle(ev zk.Event) error {
+	delete(zw.armed, ev.Path)
+
+	if ev.Type == zk.EventNotWatching {
+		// the session expired, the watches are re-armed by a resync
+		return ev.Err
+	}
+
+	if ev.Path == zw.r.prefix {
+		return zw.refreshAll(true)
+	}
+
+	rel := strings.TrimPrefix(ev.Path, zw.r.prefix+"/")
+	return zw.refresh(strings.SplitN(rel, "/", 2)[0], true)
+}
+
+func (zw *zookeeperWatcher) run() {
+	for {
+		var err error
+
+		select {
+		case <-zw.exit:
+			return
+		case ev := <-zw.events:
+			err = zw.handle(ev)
+		}
+
+		for err != nil {
+			if err == registry.ErrWatcherStopped {
+				return
+			}
+			grpclog.Warningf("grpc-contrib.registry: zookeeper watch error: %v", err)
+
+			select {
+			case <-zw.exit:
+				return
+			case <-time.After(retryInterval):
+			}
+
+			// re-arm the watches and resync the changes missed
+			err = zw.refreshAll(true)
+		}
+	}
+}
+
+func (zw *zookeeperWatcher) Next() (*registry.Result, error) {
+	select {
+	case <-zw.exit:
+		return nil, registry.ErrWatcherStopped
+	case r := <-zw.next:
+		return r, nil
+	}
+}
+
+func (zw *zookeeperWatcher) Stop() {
+	select {
+	case <-zw.exit:
+		return
+	default:
+		close(zw.exit)
+	}
+}
@@ -0,0 +1,423 @@
+// Package zookeeper provides a zookeeper service registry
+package zookeeper
+
+import (
+	"errors"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-zookeeper/zk"
+	hash "github.com/mitchellh/hashstructure"
+	"google.golang.org/grpc/grpclog"
+
+	"github.com/hb-go/grpc-contrib/registry"
+)
+
+const schema = "zookeeper"
+const queryValSeq = "|"
+
+var (
+	// DefaultPrefix is the znode path the services are stored under
+	DefaultPrefix = "/grpc/registry"
+)
+
+type zookeeperRegistry struct {
+	// cmu guards the client, Init replaces it
+	cmu     sync.RWMutex
+	client  conn
+	options registry.Options
+	prefix  string
+	codec   registry.Codec
+
+	sync.Mutex
+	register map[string]uint64
+	// registered nodes, re-created when the session expired
+	nodes map[string]*registry.Service
+	// expired is set when the session expired until a new session is established
+	expired bool
+}
+
+func NewRegistry(opts ...registry.Option) registry.Registry {
+	z := &zookeeperRegistry{
+		options:  registry.Options{},
+		prefix:   DefaultPrefix,
+		codec:    registry.DefaultCodec,
+		register: make(map[string]uint64),
+		nodes:    make(map[string]*registry.Service),
+	}
+	if err := configure(z, opts...); err != nil {
+		grpclog.Warningf("grpc-contrib.registry: zookeeper configure error: %v", err)
+		// the calls fail with the error until Init succeeds
+		z.client = errConn{err: err}
+	}
+	return z
+}
+
+// logger writes the zookeeper client logs to grpclog
+type logger struct{}
+
+func (logger) Printf(format string, v ...interface{}) {
+	grpclog.Infof("grpc-contrib.registry: zookeeper "+format, v...)
+}
+
+func configure(z *zookeeperRegistry, opts ...registry.Option) error {
+	for _, o := range opts {
+		o(&z.options)
+	}
+
+	// the scheme of the targets and the resolver builder
+	if len(z.options.Scheme) == 0 {
+		z.options.Scheme = schema
+	}
+
+	if z.options.Timeout == 0 {
+		z.options.Timeout = 5 * time.Second
+	}
+
+	if z.options.Codec != nil {
+		z.codec = z.options.Codec
+	}
+
+	var auth *authCreds
+	if z.options.Context != nil {
+		if p, ok := z.options.Context.Value(prefixKey{}).(string); ok && len(p) > 0 {
+			z.prefix = path.Join("/", p)
+		}
+		if a, ok := z.options.Context.Value(authKey{}).(*authCreds); ok {
+			auth = a
+		}
+	}
+
+	var cAddrs []string
+	for _, addr := range z.options.Addrs {
+		if len(addr) == 0 {
+			continue
+		}
+		cAddrs = append(cAddrs, addr)
+	}
+
+	if len(cAddrs) == 0 {
+		cAddrs = []string{"127.0.0.1:2181"}
+	}
+
+	c, _, err := zk.Connect(cAddrs, z.options.Timeout, zk.WithLogger(logger{}), zk.WithEventCallback(z.sessionEvent))
+	if err != nil {
+		return err
+	}
+
+	if auth != nil {
+		if err := c.AddAuth(auth.Scheme, auth.Auth); err != nil {
+			c.Close()
+			return err
+		}
+	}
+
+	z.cmu.Lock()
+	old := z.client
+	z.client = c
+	z.cmu.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+
+	return nil
+}
+
+func (z *zookeeperRegistry) getClient() conn {
+	z.cmu.RLock()
+	defer z.cmu.RUnlock()
+	return z.client
+}
+
+// sessionEvent re-creates the ephemeral nodes once a new session
+// is established after the previous one expired.
+func (z *zookeeperRegistry) sessionEvent(ev zk.Event) {
+	if ev.Type != zk.EventSession {
+		return
+	}
+
+	z.Lock()
+	defer z.Unlock()
+
+	switch ev.State {
+	case zk.StateExpired:
+		z.expired = true
+	case zk.StateHasSession:
+		if !z.expired {
+			return
+		}
+		z.expired = false
+
+		services := make([]*registry.Service, 0, len(z.nodes))
+		for _, s := range z.nodes {
+			services = append(services, s)
+		}
+
+		// the callback runs on the event loop of the client, don't block it
+		go func() {
+			for _, s := range services {
+				if err := z.registerNode(s, s.Nodes[0], true); err != nil {
+					grpclog.Warningf("grpc-contrib.registry: zookeeper re-register %s %s error: %v", s.Name, s.Nodes[0].Id, err)
+				}
+			}
+		}()
+	}
+}
+
+func (z *zookeeperRegistry) nodePath(s, id string) string {
+	service := strings.Replace(s, "/", "-", -1)
+	node := strings.Replace(id, "/", "-", -1)
+	return path.Join(z.prefix, service, node)
+}
+
+func (z *zookeeperRegistry) servicePath(s string) string {
+	return path.Join(z.prefix, strings.Replace(s, "/", "-", -1))
+}
+
+// createParents creates the persistent parents of the path
+func (z *zookeeperRegistry) createParents(p string) error {
+	name := ""
+	parts := strings.Split(strings.Trim(p, "/"), "/")
+	for _, v := range parts[:len(parts)-1] {
+		name += "/" + v
+
+		exists, _, err := z.getClient().Exists(name)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+
+		_, err = z.getClient().Create(name, []byte{}, 0, zk.WorldACL(zk.PermAll))
+		if err != nil && err != zk.ErrNodeExists {
+			return err
+		}
+	}
+	return nil
+}
+
+func (z *zookeeperRegistry) Init(opts ...registry.Option) error {
+	return configure(z, opts...)
+}
+
+func (z *zookeeperRegistry) Options() registry.Options {
+	return z.options
+}
+
+// NewTarget return grpc.Dial target
+func (z *zookeeperRegistry) NewTarget(s *registry.Service, opts ...registry.Option) string {
+	options := registry.Options{}
+	for _, o := range opts {
+		o(&options)
+	}
+
+	if len(options.Versions) == 0 {
+		return z.options.Scheme + ":///" + s.Name
+	}
+
+	return z.options.Scheme + ":///" + s.Name + "?version=" + strings.Join(options.Versions, queryValSeq)
+}
+
+func (z *zookeeperRegistry) registerNode(s *registry.Service, node *registry.Node, force bool) error {
+	service := &registry.Service{
+		Name:     s.Name,
+		Version:  s.Version,
+		Metadata: s.Metadata,
+		Methods:  s.Methods,
+		Nodes:    []*registry.Node{node},
+	}
+
+	// create hash of service; uint64
+	h, err := hash.Hash(service, nil)
+	if err != nil {
+		return err
+	}
+
+	z.Lock()
+	v, ok := z.register[s.Name+node.Id]
+	z.Unlock()
+
+	p := z.nodePath(s.Name, node.Id)
+
+	exists, stat, err := z.getClient().Exists(p)
+	if err != nil {
+		return err
+	}
+
+	// the node is unchanged and still owned by our session, skip registering
+	owned := exists && stat.EphemeralOwner == z.getClient().SessionID()
+	if ok && v == h && owned && !force {
+		return nil
+	}
+
+	data, err := z.codec.Marshal(service)
+	if err != nil {
+		return err
+	}
+
+	if owned {
+		if _, err := z.getClient().Set(p, data, -1); err != nil {
+			return err
+		}
+	} else {
+		// the node belongs to an expired or another session
+		if exists {
+			if err := z.getClient().Delete(p, -1); err != nil && err != zk.ErrNoNode {
+				return err
+			}
+		}
+
+		if err := z.createParents(p); err != nil {
+			return err
+		}
+
+		if _, err := z.getClient().Create(p, data, zk.FlagEphemeral, zk.WorldACL(zk.PermAll)); err != nil {
+			return err
+		}
+	}
+
+	z.Lock()
+	z.register[s.Name+node.Id] = h
+	z.nodes[s.Name+node.Id] = service
+	z.Unlock()
+
+	return nil
+}
+
+func (z *zookeeperRegistry) Register(s *registry.Service, opts ...registry.RegisterOption) error {
+	if len(s.Nodes) == 0 {
+		return errors.New("require at least one node")
+	}
+
+	var gerr error
+
+	// register each node individually
+	for _, node := range s.Nodes {
+		if err := z.registerNode(s, node, false); err != nil {
+			gerr = err
+		}
+	}
+
+	return gerr
+}
+
+func (z *zookeeperRegistry) Deregister(s *registry.Service) error {
+	if len(s.Nodes) == 0 {
+		return errors.New("require at least one node")
+	}
+
+	for _, node := range s.Nodes {
+		z.Lock()
+		delete(z.register, s.Name+node.Id)
+		delete(z.nodes, s.Name+node.Id)
+		z.Unlock()
+
+		err := z.getClient().Delete(z.nodePath(s.Name, node.Id), -1)
+		if err != nil && err != zk.ErrNoNode {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getService reads all the nodes of a service, grouped by version
+func (z *zookeeperRegistry) getService(name string) ([]*registry.Service, error) {
+	nodes, _, err := z.getClient().Children(z.servicePath(name))
+	if err != nil {
+		if err == zk.ErrNoNode {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	serviceMap := map[string]*registry.Service{}
+
+	for _, node := range nodes {
+		data, _, err := z.getClient().Get(path.Join(z.servicePath(name), node))
+		if err != nil {
+			// removed in the meantime
+			if err == zk.ErrNoNode {
+				continue
+			}
+			return nil, err
+		}
+
+		sn, err := z.codec.Unmarshal(data)
+		if err != nil || sn == nil {
+			grpclog.Warningf("grpc-contrib.registry: zookeeper decode node %s error: %v", node, err)
+			continue
+		}
+
+		s, ok := serviceMap[sn.Version]
+		if !ok {
+			s = &registry.Service{
+				Name:     sn.Name,
+				Version:  sn.Version,
+				Metadata: sn.Metadata,
+				Methods:  sn.Methods,
+			}
+			serviceMap[s.Version] = s
+		}
+
+		s.Nodes = append(s.Nodes, sn.Nodes...)
+	}
+
+	services := make([]*registry.Service, 0, len(serviceMap))
+	for _, service := range serviceMap {
+		sort.Slice(service.Nodes, func(i, j int) bool { return service.Nodes[i].Id < service.Nodes[j].Id })
+		services = append(services, service)
+	}
+
+	return services, nil
+}
+
+func (z *zookeeperRegistry) GetService(name string) ([]*registry.Service, error) {
+	services, err := z.getService(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(services) == 0 {
+		return nil, registry.ErrNotFound
+	}
+
+	return services, nil
+}
+
+func (z *zookeeperRegistry) ListServices() ([]*registry.Service, error) {
+	names, _, err := z.getClient().Children(z.prefix)
+	if err != nil {
+		if err == zk.ErrNoNode {
+			return []*registry.Service{}, nil
+		}
+		return nil, err
+	}
+
+	var services []*registry.Service
+	for _, name := range names {
+		svcs, err := z.getService(name)
+		if err != nil {
+			return nil, err
+		}
+		services = append(services, svcs...)
+	}
+
+	// sort the services
+	sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+
+	return services, nil
+}
+
+func (z *zookeeperRegistry) Watch(opts ...registry.WatchOption) (registry.Watcher, error) {
+	return newZookeeperWatcher(z, opts...)
+}
+
+func (z *zookeeperRegistry) String() string {
+	return "zookeeper"
+}